@@ -0,0 +1,88 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// backoff spaces out the attempts to connect to Pgpool-II: the delay after
+// each consecutive failure doubles from base up to max, and a random jitter
+// keeps exporters which lost Pgpool-II at the same time from reconnecting
+// in lockstep.
+type backoff struct {
+	mutex    sync.Mutex
+	base     time.Duration
+	max      time.Duration
+	failures int
+	next     time.Time
+}
+
+// Return a backoff doubling the delay from base up to max.
+func newBackoff(base time.Duration, max time.Duration) *backoff {
+	return &backoff{base: base, max: max}
+}
+
+// Delay after the given number of consecutive failures, between half and
+// all of the exponential delay.
+func (b *backoff) delay(failures int) time.Duration {
+	d := b.max
+	if failures < 32 {
+		if exp := b.base << failures; exp > 0 && exp < b.max {
+			d = exp
+		}
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Record a failed attempt and return the time of the next one.
+func (b *backoff) failed() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.next = time.Now().Add(b.delay(b.failures))
+	b.failures++
+	return b.next
+}
+
+// Record a successful attempt.
+func (b *backoff) succeeded() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures = 0
+	b.next = time.Time{}
+}
+
+// Whether the next attempt is due, and if not, when it is.
+func (b *backoff) due() (bool, time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return !time.Now().Before(b.next), b.next
+}
@@ -0,0 +1,160 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Return the metrics of the last scrape if it is younger than
+// --metrics.cache-ttl, or scrape Pgpool-II again. Concurrent callers wait
+// for a single scrape and share its result.
+func (e *Exporter) cachedMetrics(ctx context.Context) []prometheus.Metric {
+	e.cacheMutex.Lock()
+	defer e.cacheMutex.Unlock()
+
+	if e.cache == nil || time.Since(e.cacheTime) >= e.cacheTTL {
+		e.cache = e.gather(ctx)
+		e.cacheTime = time.Now()
+	}
+
+	return e.cache
+}
+
+// Return the metrics of the latest background scrape. If no background
+// scrape has finished yet, Pgpool-II is scraped right away.
+func (e *Exporter) snapshot(ctx context.Context) []prometheus.Metric {
+	e.cacheMutex.Lock()
+	defer e.cacheMutex.Unlock()
+
+	if e.cache == nil {
+		e.cache = e.gather(ctx)
+		e.cacheTime = time.Now()
+	}
+
+	return e.cache
+}
+
+// A scrape shared by the collections which start while it is running.
+type flight struct {
+	done    chan struct{}
+	metrics []prometheus.Metric
+}
+
+// Scrape Pgpool-II and return the collected metrics. Collections which
+// start while a scrape is running wait for it and share its result rather
+// than querying Pgpool-II again. Each collection stops waiting when its
+// ctx is done, which returns no metrics, while the scrape goes on for the
+// others.
+func (e *Exporter) sharedMetrics(ctx context.Context) []prometheus.Metric {
+	e.flightMutex.Lock()
+	f := e.flight
+	if f != nil {
+		e.coalesced.Inc()
+	} else {
+		f = &flight{done: make(chan struct{})}
+		e.flight = f
+		go e.fly(ctx, f)
+	}
+	e.flightMutex.Unlock()
+
+	select {
+	case <-f.done:
+		return f.metrics
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// Run the scrape of f. It is detached from the ctx of the collection which
+// started it, keeping only its values such as the scrape ID, so that
+// cancelling that collection does not fail the others waiting for f.
+// Instead it is bounded by --scrape.timeout and cancelled when the
+// exporter is closed.
+func (e *Exporter) fly(ctx context.Context, f *flight) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	stop := context.AfterFunc(e.ctx, cancel)
+	defer stop()
+	if e.scrapeTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, e.scrapeTimeout)
+		defer cancel()
+	}
+
+	f.metrics = e.gather(ctx)
+
+	e.flightMutex.Lock()
+	e.flight = nil
+	e.flightMutex.Unlock()
+	close(f.done)
+}
+
+// Scrape Pgpool-II every interval until the exporter is closed.
+func (e *Exporter) collectLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		metrics := e.gather(e.ctx)
+
+		e.cacheMutex.Lock()
+		e.cache = metrics
+		e.cacheTime = time.Now()
+		e.cacheMutex.Unlock()
+
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Scrape Pgpool-II and return the collected metrics. The scrape logs with
+// the scrape ID of ctx, e.g. that of the /probe request, or a new one.
+func (e *Exporter) gather(ctx context.Context) []prometheus.Metric {
+	if scrapeID(ctx) == "" {
+		ctx = withScrapeID(ctx, newScrapeID())
+	}
+
+	var metrics []prometheus.Metric
+
+	metricCh := make(chan prometheus.Metric)
+	doneCh := make(chan struct{})
+
+	go func() {
+		for m := range metricCh {
+			metrics = append(metrics, m)
+		}
+		close(doneCh)
+	}()
+
+	e.collectUncached(ctx, metricCh)
+	close(metricCh)
+	<-doneCh
+
+	return metrics
+}
@@ -0,0 +1,105 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+
+	fixtures "github.com/pgpool/pgpool2_exporter/testutil"
+)
+
+// blockingQuerier holds the queries until release is closed.
+type blockingQuerier struct {
+	Querier
+	started chan struct{}
+	release chan struct{}
+}
+
+func (q *blockingQuerier) Query(ctx context.Context, query string) (Rows, error) {
+	select {
+	case q.started <- struct{}{}:
+	default:
+	}
+	select {
+	case <-q.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return q.Querier.Query(ctx, query)
+}
+
+func TestSharedMetricsOutliveCancelledCollection(t *testing.T) {
+	db, err := fixtures.OpenVersion("4.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := &blockingQuerier{Querier: NewSQLQuerier(db), started: make(chan struct{}, 1), release: make(chan struct{})}
+	e := newExporter("postgresql://pgpool@localhost:9999/postgres", WithQuerier(q))
+	defer e.Close()
+
+	// The collection starting the scrape is cancelled while another one
+	// waits for it.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan []prometheus.Metric)
+	go func() { first <- e.sharedMetrics(ctx) }()
+	<-q.started
+
+	second := make(chan []prometheus.Metric)
+	go func() { second <- e.sharedMetrics(context.Background()) }()
+	for testutil.ToFloat64(e.coalesced) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case metrics := <-first:
+		if metrics != nil {
+			t.Errorf("cancelled collection got %d metrics, want none", len(metrics))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled collection still waiting for the scrape")
+	}
+
+	close(q.release)
+	var up *dto.Metric
+	for _, m := range <-second {
+		if strings.Contains(m.Desc().String(), `"pgpool2_up"`) {
+			up = &dto.Metric{}
+			if err := m.Write(up); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if up == nil || up.GetGauge().GetValue() != 1 {
+		t.Errorf("pgpool2_up = %v, want 1 for the waiting collection", up)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons of the capabilities which do not change until Pgpool-II or the
+// privileges of the exporter user change. The namespaces unavailable for
+// these reasons are not queried again until the next probe.
+var permanentCapabilityReasons = map[string]bool{
+	"unsupported":       true,
+	"permission_denied": true,
+}
+
+// Capability tells whether the SHOW command of a namespace can be run by the
+// exporter user, as probed after connecting to Pgpool-II.
+type Capability struct {
+	Command   string `json:"command"`
+	Available bool   `json:"available"`
+	// available, query_cache_disabled, requires_<version>, unsupported,
+	// permission_denied or error
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Capabilities are the capabilities of a Pgpool-II instance as returned by
+// /api/v1/capabilities, by namespace.
+type Capabilities struct {
+	Instance string                `json:"instance"`
+	Version  string                `json:"version,omitempty"`
+	ProbedAt *time.Time            `json:"probed_at,omitempty"`
+	Commands map[string]Capability `json:"commands"`
+}
+
+// CapabilitiesHandler returns a handler which answers with the Capabilities
+// of each Pgpool-II instance of exporters as a JSON array, as last probed.
+// Pgpool-II is not queried.
+func CapabilitiesHandler(exporters []*Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		capabilities := make([]Capabilities, 0, len(exporters))
+		for _, e := range exporters {
+			capabilities = append(capabilities, e.Capabilities())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(capabilities)
+	}
+}
+
+// Capabilities returns the capabilities of Pgpool-II found by the last
+// probe, with no commands if Pgpool-II was not probed yet.
+func (e *Exporter) Capabilities() Capabilities {
+	_, dsn := e.connection()
+
+	e.capsMutex.Lock()
+	defer e.capsMutex.Unlock()
+
+	c := Capabilities{
+		Instance: DSNLabel(dsn),
+		Commands: make(map[string]Capability, len(e.capabilities)),
+	}
+	if !e.capsTime.IsZero() {
+		probedAt := e.capsTime
+		c.ProbedAt = &probedAt
+		c.Version = e.capsVersion.String()
+	}
+	for namespace, capability := range e.capabilities {
+		c.Commands[namespace] = capability
+	}
+	return c
+}
+
+// Whether namespace is worth querying: it was not found permanently
+// unavailable by the last probe.
+func (e *Exporter) capable(namespace string) bool {
+	e.capsMutex.Lock()
+	defer e.capsMutex.Unlock()
+
+	capability, ok := e.capabilities[namespace]
+	return !ok || capability.Available || !permanentCapabilityReasons[capability.Reason]
+}
+
+// Run the SHOW command of every namespace once, and record which ones the
+// exporter user can run on this version of Pgpool-II. Namespaces with other
+// queries, e.g. from --extend.query-path, are not probed. The capabilities
+// are logged when they differ from those of the previous probe. Returns an
+// error, keeping the capabilities of the last probe, if there is no
+// connection to Pgpool-II.
+func (e *Exporter) probeCapabilities(ctx context.Context) error {
+	db, _ := e.connection()
+	if db == nil {
+		return errors.New("Error probing capabilities: no connection to Pgpool-II")
+	}
+
+	capabilities := make(map[string]Capability, len(e.metricMap))
+	for namespace := range e.metricMap {
+		query := e.namespaceQuery(namespace)
+		if !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "SHOW ") {
+			continue
+		}
+		capability := Capability{Command: strings.TrimSuffix(strings.TrimSpace(query), ";")}
+
+		if supported, reason := collectorSupport(namespace, e.version); !supported {
+			capability.Reason = reason
+			capabilities[namespace] = capability
+			continue
+		}
+
+		_, err := countRows(ctx, db, query)
+		switch {
+		case err == nil:
+			capability.Available = true
+			capability.Reason = "available"
+		case namespace == "pool_cache" && isQueryCacheDisabled(err):
+			// Still queried, for pgpool2_query_cache_enabled.
+			capability.Available = true
+			capability.Reason = "query_cache_disabled"
+		default:
+			capability.Reason = capabilityReason(err)
+			capability.Error = err.Error()
+		}
+		capabilities[namespace] = capability
+	}
+
+	var available, unavailable []string
+	for namespace, capability := range capabilities {
+		if capability.Available {
+			available = append(available, namespace)
+		} else {
+			unavailable = append(unavailable, fmt.Sprintf("%s:%s", namespace, capability.Reason))
+		}
+	}
+	sort.Strings(available)
+	sort.Strings(unavailable)
+
+	e.capsMutex.Lock()
+	changed := !e.capsVersion.Equals(e.version) || !sameCapabilities(e.capabilities, capabilities)
+	e.capabilities = capabilities
+	e.capsVersion = e.version
+	e.capsTime = time.Now()
+	e.capsMutex.Unlock()
+
+	logger := level.Debug(e.log(ctx))
+	if changed {
+		logger = level.Info(e.log(ctx))
+	}
+	logger.Log("msg", "Capabilities of Pgpool-II", "version", e.version,
+		"available", strings.Join(available, ","), "unavailable", strings.Join(unavailable, ","))
+	return nil
+}
+
+// Whether the capabilities a and b have the same availability and reason
+// for every namespace.
+func sameCapabilities(a, b map[string]Capability) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for namespace, capability := range a {
+		other, ok := b[namespace]
+		if !ok || other.Available != capability.Available || other.Reason != capability.Reason {
+			return false
+		}
+	}
+	return true
+}
+
+// Classify the error of a probed SHOW command.
+func capabilityReason(err error) string {
+	switch sqlState(err) {
+	case "42501":
+		return "permission_denied"
+	case "42704", "42601", "0A000":
+		return "unsupported"
+	}
+
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "permission denied"), strings.Contains(msg, "must be superuser"):
+		return "permission_denied"
+	case strings.Contains(msg, "unrecognized configuration parameter"), strings.Contains(msg, "not supported"):
+		return "unsupported"
+	}
+	return "error"
+}
+
+// Export the capabilities of the last probe.
+func (e *Exporter) collectCapabilities(ch chan<- prometheus.Metric) {
+	e.capsMutex.Lock()
+	defer e.capsMutex.Unlock()
+
+	desc := e.newDesc("collector", "available", "Whether the exporter user can run the SHOW command of the collector on Pgpool-II (1 for yes, 0 for no), as probed after connecting, with the reason as a label", []string{"collector", "reason"})
+	for namespace, capability := range e.capabilities {
+		var value float64
+		if capability.Available {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, namespace, capability.Reason)
+	}
+}
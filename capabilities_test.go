@@ -0,0 +1,55 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pgpool/pgpool2_exporter/testutil"
+)
+
+func TestProbeCapabilitiesWithoutConnection(t *testing.T) {
+	e := newExporter("postgresql://pgpool@localhost:9999/postgres")
+	defer e.Close()
+
+	if err := e.probeCapabilities(context.Background()); err == nil {
+		t.Error("probing without a connection succeeded")
+	}
+	if c := e.Capabilities(); c.ProbedAt != nil || len(c.Commands) > 0 {
+		t.Errorf("capabilities recorded without a connection: %+v", c)
+	}
+
+	db, err := testutil.OpenVersion("4.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	e.setDB(NewSQLQuerier(db))
+	if err := e.probeCapabilities(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c := e.Capabilities(); !c.Commands["pool_nodes"].Available {
+		t.Errorf("pool_nodes not available: %+v", c.Commands["pool_nodes"])
+	}
+}
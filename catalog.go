@@ -0,0 +1,251 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/blang/semver"
+)
+
+// CatalogMetric describes a metric exported for Pgpool-II.
+type CatalogMetric struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Help   string   `json:"help"`
+	Labels []string `json:"labels"`
+	// Collector or flag the metric depends on, if any
+	Collector string `json:"collector"`
+	// Minimum Pgpool-II version reporting the metric, empty for custom
+	// queries
+	MinVersion string `json:"min_version"`
+}
+
+// Metrics built by the handlers of the namespaces and the optional
+// collectors instead of the column mappings, without the namespace
+// prefix. Labels of the form "<namespace>" stand for the label columns of
+// the namespace.
+var handlerMetrics = []CatalogMetric{
+	{"up", "gauge", "Whether the Pgpool-II server is up (1 for yes, 0 for no).", nil, "", ""},
+	{"version_info", "gauge", "Version of Pgpool-II as labels", []string{"version", "short_version"}, "", ""},
+	{"collector_supported", "gauge", "Whether the collector can run on the version of Pgpool-II (1 for yes, 0 for no), with the reason as a label", []string{"collector", "reason"}, "", ""},
+	{"collector_available", "gauge", "Whether the exporter user can run the SHOW command of the collector on Pgpool-II (1 for yes, 0 for no), as probed after connecting, with the reason as a label", []string{"collector", "reason"}, "", ""},
+	{"unknown_status_values_total", "counter", "Total number of status values reported by Pgpool-II which are not known to the exporter, converted to 0.", []string{"value"}, "", ""},
+	{"stale_data", "gauge", "Whether the Pgpool-II metrics are those of the last successful scrape, as Pgpool-II is unreachable (1 for yes, 0 for no)", nil, "metrics.serve-stale-for", ""},
+	{"last_successful_scrape_timestamp_seconds", "gauge", "Time of the last successful scrape of Pgpool-II since unix epoch in seconds", nil, "metrics.serve-stale-for", ""},
+	{"fleet_clusters", "gauge", "Number of Pgpool-II clusters scraped by the exporter", nil, "metrics.fleet-cluster-label", ""},
+	{"fleet_clusters_without_primary", "gauge", "Number of Pgpool-II clusters with no backend up in the primary role, including those whose Pgpool-II is down", nil, "metrics.fleet-cluster-label", ""},
+	{"fleet_instances_up", "gauge", "Number of Pgpool-II instances up across all clusters", nil, "metrics.fleet-cluster-label", ""},
+	{"fleet_backends_up", "gauge", "Number of backends up across all clusters", nil, "metrics.fleet-cluster-label", ""},
+
+	{"pool_nodes_status_code", "gauge", "Whether the backend is in the state given by the state label (1 for yes, 0 for no)", []string{"<pool_nodes>", "state"}, "pool_nodes", ""},
+	{"pool_nodes_status_info", "gauge", "Status of the backend as reported by Pgpool-II (e.g. up, waiting) as a label", []string{"<pool_nodes>", "status_name"}, "pool_nodes", ""},
+	{"pool_nodes_pg_role", "gauge", "Role reported by PostgreSQL (primary or standby) as a label", []string{"<pool_nodes>", "pg_role"}, "pool_nodes", "4.3"},
+	{"pool_nodes_replication_state_info", "gauge", "Replication state and synchronization state of the backend as labels", []string{"<pool_nodes>", "state", "sync_state"}, "pool_nodes", "4.1"},
+	{"pool_nodes_status_changes_total", "counter", "Total number of backend status changes observed between scrapes, e.g. failovers and failbacks.", []string{"hostname", "port", "from", "to"}, "pool_nodes", ""},
+	{"primary_nodes", "gauge", "Number of backends up in the primary (or main) role", nil, "pool_nodes", ""},
+	{"standby_nodes", "gauge", "Number of backends up in the standby (or replica) role", nil, "pool_nodes", ""},
+	{"replication_delay_seconds", "histogram", "Replication delay of the backends observed on every scrape.", []string{"hostname", "port"}, "metrics.replication-delay-histogram", ""},
+
+	{"backend_by_process_used", "gauge", "Number of backend connection slots in use", []string{"pool_pid", "pool_id", "backend_id", "username", "database"}, "pool_pools", ""},
+	{"backend_by_process_used_ratio", "gauge", "Number of backend connection slots in use", []string{"pool_pid"}, "pool_pools", ""},
+	{"backend_by_process_total", "gauge", "Number of backend connection slots in use", []string{"pool_pid"}, "pool_pools", ""},
+	{"backend_by_user_used", "gauge", "Number of backend connection slots in use for each backend node, user and database", []string{"backend_id", "username", "database"}, "metrics.aggregate-pools", ""},
+	{"backend_by_database_used", "gauge", "Number of backend connection slots in use for each database", []string{"database"}, "pool_pools", ""},
+	{"backend_total", "gauge", "Number of total possible backend connection slots", nil, "pool_pools", ""},
+	{"backend_used", "gauge", "Number of backend connection slots in use", nil, "pool_pools", ""},
+	{"backend_used_ratio", "gauge", "Ratio of backend connections in use to total backend connection slots", nil, "pool_pools", ""},
+	{"backend_slots_saturation_ratio", "gauge", "Ratio of backend connection slots in use to the slots allowed by num_init_children and max_pool", nil, "pool_pools", ""},
+	{"backend_connection_age_seconds", "histogram", "Age of the backend connections in use", nil, "pool_pools", ""},
+	{"backend_connection_reuse", "histogram", "Number of times the backend connections in use were reused (pool_counter)", nil, "pool_pools", ""},
+	{"backend_by_node_used", "gauge", "Number of backend connection slots in use for each backend node", []string{"backend_id", "hostname"}, "pool_pools", ""},
+	{"backend_by_node_total", "gauge", "Number of total possible backend connection slots for each backend node", []string{"backend_id", "hostname"}, "pool_pools", ""},
+
+	{"frontend_used", "gauge", "Number of used child processes", []string{"username", "database"}, "pool_processes", ""},
+	{"connections_by_database", "gauge", "Number of client connections to each database", []string{"database"}, "pool_processes", ""},
+	{"frontend_age_seconds", "histogram", "Age of the child processes", nil, "pool_processes", ""},
+	{"frontend_by_status", "gauge", "Number of child processes in each status (e.g. Idle, Execute command)", []string{"status"}, "pool_processes", "4.2"},
+	{"frontend_connections", "gauge", "Number of frontend connections from each client host", []string{"client_host"}, "collector.pool_processes.client-host", "4.2"},
+	{"frontend_total", "gauge", "Number of total child processed", nil, "pool_processes", ""},
+	{"frontend_used_ratio", "gauge", "Ratio of child processes to total processes", nil, "pool_processes", ""},
+	{"frontend_saturation_ratio", "gauge", "Ratio of child processes in use to the connections accepted by num_init_children and reserved_connections", nil, "pool_processes", ""},
+
+	{"query_cache_enabled", "gauge", "Whether the query cache is enabled (1 for yes, 0 for no)", nil, "pool_cache", ""},
+	{"pool_status_info", "gauge", "Pgpool-II configuration parameter value", []string{"parameter", "value"}, "pool_status", ""},
+
+	{"process_count", "gauge", "Number of Pgpool-II processes read from /proc.", []string{"role"}, "collector.process", ""},
+	{"process_resident_memory_bytes", "gauge", "Resident memory size of the Pgpool-II processes in bytes.", []string{"role"}, "collector.process", ""},
+	{"process_cpu_seconds", "gauge", "User and system CPU time spent by the live Pgpool-II processes in seconds.", []string{"role"}, "collector.process", ""},
+	{"process_open_fds", "gauge", "Number of open file descriptors of the Pgpool-II processes.", []string{"role"}, "collector.process", ""},
+	{"process_scrape_duration_seconds", "gauge", "Duration of the last read of the Pgpool-II processes.", nil, "collector.process", ""},
+
+	{"backend_crosscheck_up", "gauge", "Whether the backend could be queried directly (1 for yes, 0 for no).", []string{"node_id", "hostname", "port"}, "collector.backend-crosscheck", ""},
+	{"backend_crosscheck_in_recovery", "gauge", "Whether PostgreSQL reports the backend as a standby (1 for yes, 0 for no).", []string{"node_id", "hostname", "port"}, "collector.backend-crosscheck", ""},
+	{"backend_crosscheck_wal_lsn_bytes", "gauge", "WAL position of the backend: replayed on a standby, written on a primary.", []string{"node_id", "hostname", "port"}, "collector.backend-crosscheck", ""},
+	{"backend_crosscheck_connections", "gauge", "Number of client connections reported by PostgreSQL.", []string{"node_id", "hostname", "port"}, "collector.backend-crosscheck", ""},
+
+	{"pcp_up", "gauge", "Whether the last PCP query succeeded (1 for yes, 0 for no).", nil, "pcp.host", ""},
+	{"pcp_scrape_duration_seconds", "gauge", "Duration of the last PCP query.", nil, "pcp.host", ""},
+	{"pcp_node_count", "gauge", "Number of backend nodes", nil, "pcp.host", ""},
+	{"pcp_node_status", "gauge", "Backend node status reported by PCP (1 for up or waiting, 0 for down or unused)", []string{"node_id", "hostname", "port"}, "pcp.host", ""},
+	{"pcp_process_count", "gauge", "Number of Pgpool-II child processes", nil, "pcp.host", ""},
+	{"pcp_watchdog_node_info", "gauge", "Watchdog node and its state as labels", []string{"node_id", "node_name", "hostname", "state"}, "pcp.host", ""},
+	{"watchdog_quorum_status", "gauge", "Quorum status of the watchdog cluster (1 for quorum exists, 0 for quorum on the edge, -1 for quorum absent)", nil, "pcp.host", ""},
+	{"watchdog_quorum_exists", "gauge", "Whether the watchdog cluster holds the quorum (1 for yes, 0 for no)", nil, "pcp.host", ""},
+	{"watchdog_remote_nodes", "gauge", "Number of remote watchdog nodes configured", nil, "pcp.host", ""},
+	{"watchdog_alive_nodes", "gauge", "Number of alive remote watchdog nodes", nil, "pcp.host", ""},
+	{"watchdog_leader_info", "gauge", "Watchdog leader node as the node_name label", []string{"node_name"}, "pcp.host", ""},
+	{"watchdog_leader", "gauge", "Whether the local Pgpool-II is the watchdog leader (1 for yes, 0 for no)", nil, "pcp.host", ""},
+	{"watchdog_standby", "gauge", "Whether the local Pgpool-II is a watchdog standby (1 for yes, 0 for no)", nil, "pcp.host", ""},
+	{"watchdog_local_state_info", "gauge", "Watchdog state of the local Pgpool-II as the state label", []string{"state"}, "pcp.host", ""},
+	{"watchdog_delegate_ip_up", "gauge", "Whether the local Pgpool-II holds the delegate IP (1 for yes, 0 for no)", []string{"delegate_ip"}, "pcp.host", ""},
+}
+
+// Name of the Prometheus type of the metric of a column
+func usageType(usage columnUsage) string {
+	if usage == COUNTER {
+		return "counter"
+	}
+	return "gauge"
+}
+
+// Minimum Pgpool-II version reporting a column of a namespace
+func columnMinVersion(namespace string, column string) semver.Version {
+	v := version36
+	if minVersion, ok := namespaceMinVersions[namespace]; ok && minVersion.GT(v) {
+		v = minVersion
+	}
+	if minVersion, ok := columnMinVersions[namespace][column]; ok && minVersion.GT(v) {
+		v = minVersion
+	}
+	return v
+}
+
+// MetricCatalog returns the metrics exported for Pgpool-II with the current
+// flags, from the column mappings and the metrics built by the handlers,
+// sorted by name.
+func MetricCatalog(namespace string) ([]CatalogMetric, error) {
+	mapped, err := mappedMetrics(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var catalog []CatalogMetric
+	labels := make(map[string][]string)
+	for _, m := range mapped {
+		labels[m.collector] = m.labels
+		metric := CatalogMetric{
+			Name:      m.name,
+			Type:      usageType(m.usage),
+			Help:      m.help,
+			Labels:    m.labels,
+			Collector: m.collector,
+		}
+		if _, ok := metricMaps[m.collector]; ok {
+			v := columnMinVersion(m.collector, m.column)
+			metric.MinVersion = fmt.Sprintf("%d.%d", v.Major, v.Minor)
+		}
+		catalog = append(catalog, metric)
+	}
+
+	for _, m := range handlerMetrics {
+		if enabled, ok := collectorState[m.Collector]; ok && !*enabled {
+			continue
+		}
+		m.Name = namespace + "_" + m.Name
+		var metricLabels []string
+		for _, label := range m.Labels {
+			if strings.HasPrefix(label, "<") {
+				metricLabels = append(metricLabels, labels[strings.Trim(label, "<>")]...)
+			} else {
+				metricLabels = append(metricLabels, label)
+			}
+		}
+		m.Labels = metricLabels
+		if m.MinVersion == "" {
+			v := columnMinVersion(m.Collector, "")
+			m.MinVersion = fmt.Sprintf("%d.%d", v.Major, v.Minor)
+		}
+		catalog = append(catalog, m)
+	}
+
+	if *collectorState["pool_status"] {
+		items := make([]string, 0, len(poolStatusGauges))
+		for item := range poolStatusGauges {
+			items = append(items, item)
+		}
+		sort.Strings(items)
+		for _, item := range items {
+			catalog = append(catalog, CatalogMetric{
+				Name:       fmt.Sprintf("%s_pool_status_%s", namespace, item),
+				Type:       "gauge",
+				Help:       poolStatusGauges[item],
+				Collector:  "pool_status",
+				MinVersion: "3.6",
+			})
+		}
+	}
+
+	sort.SliceStable(catalog, func(i, j int) bool {
+		return catalog[i].Name < catalog[j].Name
+	})
+
+	return catalog, nil
+}
+
+// ListMetrics writes the metric catalog to w as JSON or as a Markdown
+// table.
+func ListMetrics(w io.Writer, namespace string, format string) error {
+	catalog, err := MetricCatalog(namespace)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(catalog)
+	}
+
+	fmt.Fprintln(w, "name | type | Pgpool-II version | labels | collector | description")
+	fmt.Fprintln(w, ":---|:---|:---|:---|:---|:---")
+	for _, m := range catalog {
+		version := "custom"
+		if m.MinVersion != "" {
+			version = m.MinVersion + "+"
+		}
+		var labels []string
+		for _, label := range m.Labels {
+			labels = append(labels, "`"+label+"`")
+		}
+		_, err := fmt.Fprintf(w, "%s | %s | %s | %s | %s | %s\n", m.Name, m.Type, version, strings.Join(labels, ", "), m.Collector, m.Help)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
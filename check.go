@@ -0,0 +1,115 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Check connects to the Pgpool-II instance at dsn, runs the query of every
+// enabled namespace once and writes a report of the results to w: the
+// Pgpool-II version, and the result, row count and duration of each query.
+// It returns an error if the connection or a query failed.
+func Check(ctx context.Context, w io.Writer, dsn string, opts ...Option) error {
+	e := newExporter(dsn, opts...)
+	defer e.Close()
+
+	fmt.Fprintf(w, "Pgpool-II: %s\n", MaskPassword(dsn))
+
+	if e.DB == nil {
+		begun := time.Now()
+		db, err := e.connect(ctx)
+		if err != nil {
+			fmt.Fprintf(w, "Connection: %s error: %s\n", errorType(err), err)
+			return err
+		}
+		e.DB = db
+		fmt.Fprintf(w, "Connection: ok (%s)\n", time.Since(begun).Round(time.Microsecond))
+	}
+
+	failed := 0
+	v, err := QueryVersion(ctx, e.DB)
+	if err != nil {
+		failed++
+		fmt.Fprintf(w, "Version: error: %s\n", err)
+	} else {
+		e.version = v
+		fmt.Fprintf(w, "Version: %s\n", v)
+	}
+
+	namespaces := make([]string, 0, len(e.metricMap))
+	for namespace := range e.metricMap {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nNAMESPACE\tROWS\tDURATION\tRESULT")
+	for _, namespace := range namespaces {
+		if !namespaceSupported(namespace, e.version) {
+			fmt.Fprintf(tw, "%s\t-\t-\tskipped: requires Pgpool-II %s\n", namespace, namespaceMinVersions[namespace])
+			continue
+		}
+
+		begun := time.Now()
+		count, err := countRows(ctx, e.DB, e.namespaceQuery(namespace))
+		duration := time.Since(begun).Round(time.Microsecond)
+		switch {
+		case err == nil:
+			fmt.Fprintf(tw, "%s\t%d\t%s\tok\n", namespace, count, duration)
+		case namespace == "pool_cache" && isQueryCacheDisabled(err):
+			fmt.Fprintf(tw, "%s\t-\t%s\tok: query cache disabled\n", namespace, duration)
+		default:
+			failed++
+			fmt.Fprintf(tw, "%s\t-\t%s\t%s error: %s\n", namespace, duration, errorType(err), err)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of the queries failed", failed)
+	}
+	return nil
+}
+
+// Run query and return the number of rows of its result.
+func countRows(ctx context.Context, db Querier, query string) (int, error) {
+	rows, err := db.Query(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	return count, rows.Err()
+}
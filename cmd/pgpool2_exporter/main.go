@@ -1,18 +1,30 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/pprof"
 	"os"
-	"net/url"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
-	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/exporter-toolkit/web"
 
 	exp "github.com/pgpool/pgpool2_exporter"
 )
@@ -20,46 +32,466 @@ import (
 func main() {
 	promlogConfig := &promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, promlogConfig)
-	kingpin.Version(version.Print("pgpool2_exporter"))
+	versionFormat := kingpin.Flag("format", "Output format of --version, one of [text, json].").Default("text").Enum("text", "json")
+	kingpin.Flag("version", "Show application version.").PreAction(func(*kingpin.ParseContext) error {
+		printVersion(*versionFormat)
+		os.Exit(0)
+		return nil
+	}).Bool()
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	kingpin.Command("serve", "Serve the metrics of Pgpool-II (default).").Default()
+	generate := kingpin.Command("generate", "Print monitoring configuration matching the exported metrics.")
+	generateDashboard := generate.Command("dashboard", "Print a Grafana dashboard.")
+	generateAlerts := generate.Command("alerts", "Print Prometheus alerting rules.")
+	scrape := kingpin.Command("scrape", "Scrape Pgpool-II once, print the metrics in the Prometheus text format and exit.")
+	check := kingpin.Command("check", "Connect to Pgpool-II, run every query once, print the results and exit (non-zero on failure).")
+	listMetrics := kingpin.Command("list-metrics", "Print the metrics exported for Pgpool-II.")
+	listMetricsFormat := listMetrics.Flag("output", "Output format, one of [markdown, json].").Default("markdown").Enum("markdown", "json")
+	exp.AddEnvars(kingpin.CommandLine)
+	command := kingpin.Parse()
 
-	exp.Logger = promlog.New(promlogConfig)
+	logger := promlog.New(promlogConfig)
 
-	var dsn = os.Getenv("DATA_SOURCE_NAME")
+	switch command {
+	case generateDashboard.FullCommand(), generateAlerts.FullCommand():
+		generator := exp.GenerateDashboard
+		if command == generateAlerts.FullCommand() {
+			generator = exp.GenerateAlerts
+		}
+		if err := generator(os.Stdout, exp.Namespace); err != nil {
+			level.Error(logger).Log("msg", "Error generating "+command, "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case listMetrics.FullCommand():
+		if err := exp.ListMetrics(os.Stdout, exp.Namespace, *listMetricsFormat); err != nil {
+			level.Error(logger).Log("msg", "Error listing metrics", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *exp.ListRenames {
+		renames := exp.MetricRenames(exp.Namespace)
+		legacyNames := make([]string, 0, len(renames))
+		for legacy := range renames {
+			legacyNames = append(legacyNames, legacy)
+		}
+		sort.Strings(legacyNames)
+		for _, legacy := range legacyNames {
+			fmt.Println(legacy, renames[legacy])
+		}
+		os.Exit(0)
+	}
 
-	if len(dsn) == 0 {
-		var user = os.Getenv("DATA_SOURCE_USER")
-		var pass = os.Getenv("DATA_SOURCE_PASS")
-		var uri = os.Getenv("DATA_SOURCE_URI")
-		ui := url.UserPassword(user, pass).String()
+	var cfg *exp.Config
+	if *exp.ConfigFile != "" {
+		var err error
+		cfg, err = exp.LoadConfig(*exp.ConfigFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error loading config file", "file", *exp.ConfigFile, "err", err)
+			os.Exit(1)
+		}
+		cfg.Apply()
+	}
+	if *exp.PgpoolConfFile != "" {
+		conf, err := exp.LoadPgpoolConf(*exp.PgpoolConfFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error loading pgpool.conf", "file", *exp.PgpoolConfFile, "err", err)
+			os.Exit(1)
+		}
+		cfg = conf.Apply(cfg)
+	}
 
-		dsn = "postgresql://" + ui + "@" + uri
+	// Read after the config file and pgpool.conf are applied to the flags.
+	flagOpts, err := exp.FlagOptions()
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid flags", "err", err)
+		os.Exit(1)
 	}
 
-	exporter := exp.NewExporter(dsn, exp.Namespace)
+	labels, err := exp.ConstantLabels(cfg)
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid constant labels", "err", err)
+		os.Exit(1)
+	}
+
+	dsns, err := exp.DataSourceNames(cfg)
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid data source", "err", err)
+		os.Exit(1)
+	}
+	for _, dsn := range dsns {
+		if err := exp.ValidateDSN(dsn, logger); err != nil {
+			level.Error(logger).Log("msg", "Invalid data source", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	exporters := make([]*exp.Exporter, 0, len(dsns))
 	defer func() {
-		exporter.DB.Close()
+		for _, exporter := range exporters {
+			exporter.Close()
+		}
 	}()
-	prometheus.MustRegister(exporter)
+	opts := append([]exp.Option{exp.WithLogger(logger)}, flagOpts...)
+	opts = append(opts, cfg.Options()...)
+	// The exporters of /probe targets share the options which do not
+	// depend on the data sources.
+	probeOpts := append([]exp.Option{}, opts...)
+	if *exp.PCPHost != "" {
+		if len(dsns) > 1 || *exp.TargetsFile != "" {
+			level.Error(logger).Log("msg", "--pcp.host cannot be used with several Pgpool-II instances")
+			os.Exit(1)
+		}
+		opts = append(opts, exp.WithPCP(*exp.PCPHost, *exp.PCPPort, *exp.PCPUser, *exp.PCPPasswordFile))
+	}
+	if *exp.SSHHost != "" {
+		dial, err := exp.NewSSHDialer(*exp.SSHHost, *exp.SSHUser, *exp.SSHKeyFile, *exp.SSHKnownHostsFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error setting up the SSH tunnel", "err", err)
+			os.Exit(1)
+		}
+		opts = append(opts, exp.WithDialer(dial))
+		probeOpts = append(probeOpts, exp.WithDialer(dial))
+	}
 
-	// Retrieve Pgpool-II version
-	v, err := exp.QueryVersion(exporter.DB)
-	if err != nil {
-		level.Error(exp.Logger).Log("err", err)
+	if command == check.FullCommand() {
+		os.Exit(runCheck(dsns, opts, logger))
+	}
+
+	// Only the leader of an HA pair runs the heavy collectors. Started
+	// before the exporters connect, so that the first scrapes already know
+	// the leader.
+	electionCtx, stopElection := context.WithCancel(context.Background())
+	electionDone := make(chan struct{})
+	var leader *exp.Leader
+	if *exp.HALock != "" && command != scrape.FullCommand() {
+		if *exp.HALeaseDuration < time.Second {
+			level.Error(logger).Log("msg", "--ha.lease-duration must be at least 1s")
+			os.Exit(1)
+		}
+		identity := *exp.HAIdentity
+		if identity == "" {
+			identity, _ = os.Hostname()
+		}
+		elector, err := exp.NewElector(*exp.HALock, identity)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error setting up the HA lock", "err", err)
+			os.Exit(1)
+		}
+		var namespaces []string
+		for _, namespace := range strings.Split(*exp.HALeaderCollectors, ",") {
+			if namespace = strings.TrimSpace(namespace); namespace != "" {
+				namespaces = append(namespaces, namespace)
+			}
+		}
+		leader = exp.NewLeader(elector, *exp.HALeaseDuration, logger)
+		opts = append(opts, exp.WithLeaderCollectors(leader.IsLeader, namespaces))
+		level.Info(logger).Log("msg", "Electing the HA leader", "lock", *exp.HALock, "identity", identity, "collectors", strings.Join(namespaces, ","))
+		go func() {
+			leader.Run(electionCtx)
+			close(electionDone)
+		}()
+	}
+	defer stopElection()
+
+	// The metrics of the exporter itself are kept apart from the Pgpool-II
+	// metrics with --web.exporter-metrics-path and
+	// --web.disable-exporter-metrics, and left out of one-shot scrapes, e.g.
+	// so that the Go metrics do not collide with those of node_exporter
+	// when written for its textfile collector.
+	registry := prometheus.NewRegistry()
+	exporterRegistry := registry
+	if *exp.ExporterMetricsPath != "" || *exp.NoExporterMetrics || command == scrape.FullCommand() {
+		exporterRegistry = prometheus.NewRegistry()
+		opts = append(opts, exp.WithoutExporterMetrics())
+	}
+	exporterRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		version.NewCollector("pgpool2_exporter"),
+	)
+	if leader != nil {
+		exporterRegistry.MustRegister(leader)
+	}
+
+	if *exp.PgpoolConfFile != "" {
+		prometheus.WrapRegistererWith(labels, registry).MustRegister(exp.NewPgpoolConfCollector(*exp.PgpoolConfFile, logger))
+	}
+	if *exp.LogFile != "" {
+		prometheus.WrapRegistererWith(labels, registry).MustRegister(exp.NewLogFileCollector(*exp.LogFile, logger))
 	}
-	exp.PgpoolSemver = v
 
-	level.Info(exp.Logger).Log("msg", "Starting pgpool2_exporter", "version", version.Info(), "dsn", exp.MaskPassword(dsn))
-	level.Info(exp.Logger).Log("msg", "Listening on address", "address", *exp.ListenAddress)
+	for i, dsn := range dsns {
+		exporter := exp.NewExporter(dsn, opts...)
+		exporters = append(exporters, exporter)
 
-	http.Handle(*exp.MetricsPath, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(fmt.Sprintf(exp.LandingPage, *exp.MetricsPath)))
+		exporter.SetDSNSource(func() (string, error) {
+			dsns, err := exp.ReloadDataSourceNames()
+			if err != nil {
+				return "", err
+			}
+			if i >= len(dsns) {
+				return "", fmt.Errorf("data source %d is no longer configured", i)
+			}
+			return dsns[i], nil
+		})
+
+		// Tell the metrics of several Pgpool-II instances apart.
+		exporterLabels := prometheus.Labels{}
+		for name, value := range labels {
+			exporterLabels[name] = value
+		}
+		if len(dsns) > 1 || *exp.TargetsFile != "" {
+			exporterLabels["pgpool_host"] = exp.DSNLabel(dsn)
+		}
+		prometheus.WrapRegistererWith(exporterLabels, registry).MustRegister(exporter)
+		if exporterRegistry != registry {
+			prometheus.WrapRegistererWith(exporterLabels, exporterRegistry).MustRegister(exporter.ExporterMetrics())
+		}
+
+		level.Info(logger).Log("msg", "Scraping Pgpool-II", "dsn", exp.MaskPassword(dsn))
+	}
+
+	var gatherer prometheus.Gatherer = registry
+	if *exp.TargetsFile != "" {
+		targets, err := exp.NewTargetManager(*exp.TargetsFile, dsns[0], labels, logger, opts...)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error loading targets file", "file", *exp.TargetsFile, "err", err)
+			os.Exit(1)
+		}
+		defer targets.Close()
+		go targets.Run(context.Background(), *exp.TargetsRefresh)
+		gatherer = prometheus.Gatherers{registry, targets}
+	}
+	if *exp.FleetClusterLabel != "" {
+		gatherer = exp.NewFleetGatherer(gatherer, exp.Namespace, *exp.FleetClusterLabel)
+	}
+
+	// Labels are redacted before the metric_relabel rules can rename them.
+	relabel := exp.RedactRules()
+	if cfg != nil {
+		relabel = append(relabel, cfg.Relabel...)
+	}
+	if len(relabel) > 0 {
+		var err error
+		gatherer, err = exp.NewRelabelGatherer(gatherer, relabel, []byte(*exp.HashKey))
+		if err != nil {
+			level.Error(logger).Log("msg", "Error loading metric_relabel or --metrics.redact-labels", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if command == scrape.FullCommand() {
+		code := 0
+		if err := writeMetrics(os.Stdout, gatherer); err != nil {
+			level.Error(logger).Log("msg", "Error gathering metrics", "err", err)
+			code = 1
+		}
+		for _, exporter := range exporters {
+			exporter.Close()
+		}
+		os.Exit(code)
+	}
+
+	level.Info(logger).Log("msg", "Starting pgpool2_exporter", "version", version.Info())
+
+	// Only the endpoints which scrape Pgpool-II are limited.
+	limiter := exp.NewLimiter(*exp.MaxRequestsInFlight, *exp.ClientRateLimit, *exp.ClientRateBurst, logger)
+	exporterRegistry.MustRegister(limiter)
+
+	// The handlers are served from their own mux rather than
+	// http.DefaultServeMux, on which importing net/http/pprof registers the
+	// profiling endpoints whether or not --web.enable-pprof is set.
+	mux := http.NewServeMux()
+	mux.Handle(*exp.MetricsPath, limiter.Wrap(promhttp.InstrumentMetricHandler(
+		exporterRegistry,
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}),
+	)))
+	if *exp.ExporterMetricsPath != "" {
+		mux.Handle(*exp.ExporterMetricsPath, promhttp.HandlerFor(exporterRegistry, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	}
+	var allowedTargets []string
+	for _, pattern := range strings.Split(*exp.ProbeAllowedTargets, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			allowedTargets = append(allowedTargets, pattern)
+		}
+	}
+	var authModules map[string]exp.AuthModule
+	if cfg != nil {
+		authModules = cfg.AuthModules
+	}
+	var probe http.Handler = exp.ProbeHandler(dsns, allowedTargets, authModules, labels, probeOpts...)
+	if *exp.ScrapeIDHeader != "" {
+		probe = exp.ScrapeIDHandler(*exp.ScrapeIDHeader, probe)
+	}
+	mux.Handle("/probe", limiter.Wrap(probe))
+	mux.Handle("/api/v1/status", limiter.Wrap(exp.StatusHandler(exporters)))
+	mux.Handle("/api/v1/capabilities", exp.CapabilitiesHandler(exporters))
+	if *exp.K8sSelector != "" {
+		discovery, err := exp.NewKubernetesDiscovery(*exp.K8sNamespace, *exp.K8sSelector, *exp.K8sPort, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error setting up the Kubernetes discovery", "err", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Discovering Pgpool-II in Kubernetes", "selector", *exp.K8sSelector)
+		go discovery.Run(context.Background(), *exp.K8sRefreshInterval)
+		mux.Handle("/discovery/targets", discovery)
+	}
+	mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Healthy"))
 	})
+	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		for _, exporter := range exporters {
+			if !exporter.Ready() {
+				http.Error(w, "Pgpool-II is not reachable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Ready"))
+	})
+	if *exp.EnablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+		// Runtime metrics are kept apart from the default registry, which
+		// only has the basic Go and process metrics.
+		debugRegistry := prometheus.NewRegistry()
+		debugRegistry.MustRegister(
+			collectors.NewGoCollector(collectors.WithGoCollectorRuntimeMetrics(collectors.MetricsAll)),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+		mux.Handle("/debug/metrics", promhttp.HandlerFor(debugRegistry, promhttp.HandlerOpts{}))
+	}
 
-	if err := http.ListenAndServe(*exp.ListenAddress, nil); err != nil {
-		level.Error(exp.Logger).Log("err", err)
+	landingPage, err := exp.NewLandingPage(dsns, exporters[0].Collectors())
+	if err != nil {
+		level.Error(logger).Log("msg", "Error creating landing page", "err", err)
 		os.Exit(1)
 	}
+	mux.Handle("/", landingPage)
+
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := web.ListenAndServe(srv, exp.WebFlags, logger); err != nil && err != http.ErrServerClosed {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+	}()
+
+	pushCtx, stopPush := context.WithCancel(context.Background())
+	defer stopPush()
+	if *exp.PushURL != "" {
+		pusher, err := exp.NewPusher(*exp.PushURL, *exp.PushProtocol, *exp.PushJob, gatherer, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error setting up the push of the metrics", "err", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Pushing metrics", "url", exp.MaskPassword(*exp.PushURL), "protocol", *exp.PushProtocol, "interval", *exp.PushInterval)
+		go pusher.Run(pushCtx, *exp.PushInterval)
+	}
+	if *exp.OTLPEndpoint != "" {
+		url, err := exp.OTLPMetricsURL(*exp.OTLPEndpoint)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid OTLP endpoint", "err", err)
+			os.Exit(1)
+		}
+		pusher, err := exp.NewPusher(url, "otlp", "", gatherer, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error setting up the push of the metrics", "err", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Pushing metrics", "url", exp.MaskPassword(url), "protocol", "otlp", "interval", *exp.PushInterval)
+		go pusher.Run(pushCtx, *exp.PushInterval)
+	}
+	if *exp.StatsdAddress != "" {
+		pusher, err := exp.NewStatsdPusher(*exp.StatsdAddress, *exp.StatsdTagFormat, gatherer, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error setting up the statsd sink", "err", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Sending metrics to statsd", "address", *exp.StatsdAddress, "tag_format", *exp.StatsdTagFormat, "interval", *exp.PushInterval)
+		go pusher.Run(pushCtx, *exp.PushInterval)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	level.Info(logger).Log("msg", "Shutting down", "signal", sig)
+
+	// Stop accepting scrapes and wait for the scrapes in progress. Queries
+	// still running after the timeout are cancelled when the exporters are
+	// closed.
+	ctx, cancel := context.WithTimeout(context.Background(), *exp.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		level.Error(logger).Log("msg", "Error shutting down HTTP server", "err", err)
+	}
+
+	// Release the HA lock, so that the other exporter takes over right
+	// away.
+	if leader != nil {
+		stopElection()
+		<-electionDone
+	}
+}
+
+// printVersion writes the build information in the requested format.
+func printVersion(format string) {
+	if format != "json" {
+		fmt.Println(version.Print("pgpool2_exporter"))
+		return
+	}
+	info := map[string]string{
+		"version":   version.Version,
+		"revision":  version.Revision,
+		"branch":    version.Branch,
+		"buildUser": version.BuildUser,
+		"buildDate": version.BuildDate,
+		"goVersion": version.GoVersion,
+		"goOS":      version.GoOS,
+		"goArch":    version.GoArch,
+	}
+	json.NewEncoder(os.Stdout).Encode(info)
+}
+
+// Gather the metrics of g and write them to w in the Prometheus text
+// format. The metrics gathered despite an error are written too.
+func writeMetrics(w io.Writer, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	encoder := expfmt.NewEncoder(w, expfmt.FmtText)
+	for _, mf := range mfs {
+		if eerr := encoder.Encode(mf); eerr != nil {
+			return eerr
+		}
+	}
+	return err
+}
+
+// Check every data source and return the exit code of the check command.
+func runCheck(dsns []string, opts []exp.Option, logger log.Logger) int {
+	ctx := context.Background()
+	if *exp.ScrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *exp.ScrapeTimeout)
+		defer cancel()
+	}
+
+	code := 0
+	for i, dsn := range dsns {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := exp.Check(ctx, os.Stdout, dsn, opts...); err != nil {
+			level.Error(logger).Log("msg", "Check failed", "dsn", exp.MaskPassword(dsn), "err", err)
+			code = 1
+		}
+	}
+	return code
 }
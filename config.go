@@ -0,0 +1,465 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the content of the file given by --config.file. Values given
+// on the command line or in DATA_SOURCE_* environment variables take
+// precedence over the file. Environment variables referenced as ${VAR} in
+// the file are expanded, and $${VAR} is kept as a literal ${VAR}.
+type Config struct {
+	DataSource DataSourceConfig  `yaml:"data_source"`
+	Scrape     ScrapeConfig      `yaml:"scrape"`
+	Collectors map[string]bool   `yaml:"collectors"`
+	Labels     map[string]string `yaml:"labels"`
+	Relabel    []RelabelConfig   `yaml:"metric_relabel"`
+	// Values of the backend statuses, e.g. waiting: 0, overriding and
+	// extending those of the exporter
+	StatusValues map[string]float64 `yaml:"status_values"`
+	// Columns exported as metrics by namespace, e.g. pool_backend_stats
+	// without panic_cnt
+	Columns map[string]ColumnFilter `yaml:"columns"`
+	// Credentials of the /probe targets by name, selected with the
+	// auth_module parameter
+	AuthModules map[string]AuthModule `yaml:"auth_modules"`
+}
+
+// ColumnFilter selects the columns of a namespace exported as metrics: only
+// those of Include if set, or all but those of Exclude. Label columns are
+// always kept.
+type ColumnFilter struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// Whether the metric of column is exported.
+func (f ColumnFilter) exports(column string) bool {
+	if len(f.Include) > 0 {
+		return slices.Contains(f.Include, column)
+	}
+	return !slices.Contains(f.Exclude, column)
+}
+
+// AuthModule holds the credentials used to connect to the /probe targets
+// which select it with the auth_module parameter, in place of those of the
+// data source.
+type AuthModule struct {
+	// userpass, or tls for client certificate authentication
+	Type     string       `yaml:"type"`
+	UserPass UserPassAuth `yaml:"userpass"`
+	TLS      TLSAuth      `yaml:"tls"`
+	// Other connection parameters, e.g. connect_timeout
+	Options map[string]string `yaml:"options"`
+	// Addresses (host:port, with * and ? as wildcards) of the targets
+	// probed with the module
+	Targets []string `yaml:"targets"`
+}
+
+// UserPassAuth is the user name and password of an AuthModule. The password
+// file is read on every connection attempt.
+type UserPassAuth struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// TLSAuth is the TLS settings of an AuthModule.
+type TLSAuth struct {
+	SSLMode     string `yaml:"sslmode"`
+	SSLCert     string `yaml:"sslcert"`
+	SSLKey      string `yaml:"sslkey"`
+	SSLRootCert string `yaml:"sslrootcert"`
+}
+
+// Check the settings of the auth module name.
+func (m AuthModule) validate(name string) error {
+	switch m.Type {
+	case "userpass":
+		if m.UserPass.Username == "" {
+			return fmt.Errorf("auth module %s in config file: userpass.username is missing", name)
+		}
+		if m.UserPass.Password != "" && m.UserPass.PasswordFile != "" {
+			return fmt.Errorf("auth module %s in config file: both userpass.password and userpass.password_file given", name)
+		}
+	case "tls":
+		if m.TLS.SSLCert == "" || m.TLS.SSLKey == "" {
+			return fmt.Errorf("auth module %s in config file: tls.sslcert and tls.sslkey are required", name)
+		}
+	default:
+		return fmt.Errorf("auth module %s in config file: unknown type %q (one of userpass, tls)", name, m.Type)
+	}
+	if len(m.Targets) == 0 {
+		return fmt.Errorf("auth module %s in config file: targets is missing", name)
+	}
+	for _, pattern := range m.Targets {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("auth module %s in config file: invalid target %q: %s", name, pattern, err)
+		}
+	}
+	if m.TLS.SSLMode != "" && !sslModes[m.TLS.SSLMode] {
+		return fmt.Errorf("auth module %s in config file: invalid tls.sslmode %q", name, m.TLS.SSLMode)
+	}
+	for key := range m.Options {
+		if addressParams[key] {
+			return fmt.Errorf("auth module %s in config file: option %s would connect to other hosts than the target", name, key)
+		}
+	}
+	return nil
+}
+
+// Connection parameters which choose the host connected to, or the
+// password sent to it, other than the host and port of the target
+var addressParams = map[string]bool{
+	"host":        true,
+	"hostaddr":    true,
+	"port":        true,
+	"service":     true,
+	"servicefile": true,
+	"passfile":    true,
+}
+
+// Check that dsn only connects to a single host matching the targets of
+// the module, so that its credentials are not sent to other hosts.
+func (m AuthModule) checkAddress(dsn string) error {
+	params, err := dsnParams(dsn)
+	if err != nil {
+		return errors.New(fmt.Sprintln("Error parsing DSN:", err))
+	}
+	for key := range params {
+		if key != "host" && key != "port" && addressParams[key] {
+			return fmt.Errorf("target %s is not allowed with an auth module: %s is set", DSNLabel(dsn), key)
+		}
+	}
+	address := DSNLabel(dsn)
+	if strings.Contains(address, ",") || !targetAllowed(m.Targets, address) {
+		return fmt.Errorf("target %s is not allowed: list it in the targets of the auth module", address)
+	}
+	return nil
+}
+
+// Set the credentials and connection parameters of the module in dsn. The
+// password of dsn is not kept, so that it is not sent to the targets of
+// other clusters.
+func (m AuthModule) apply(dsn string) (string, error) {
+	password := m.UserPass.Password
+	if m.UserPass.PasswordFile != "" {
+		content, err := os.ReadFile(m.UserPass.PasswordFile)
+		if err != nil {
+			return "", errors.New(fmt.Sprintln("Error reading password file of auth module:", err))
+		}
+		password = strings.TrimRight(string(content), "\r\n")
+	}
+	dsn, err := replaceDSNCredentials(dsn, m.UserPass.Username, password)
+	if err != nil {
+		return "", err
+	}
+
+	params := map[string]string{
+		"sslmode":     m.TLS.SSLMode,
+		"sslcert":     m.TLS.SSLCert,
+		"sslkey":      m.TLS.SSLKey,
+		"sslrootcert": m.TLS.SSLRootCert,
+	}
+	for key, value := range m.Options {
+		params[key] = value
+	}
+	dsn = setDSNParams(dsn, params, true)
+	if err := m.checkAddress(dsn); err != nil {
+		return "", err
+	}
+	return dsn, nil
+}
+
+// DataSourceConfig describes how to connect to Pgpool-II.
+type DataSourceConfig struct {
+	DSN         string   `yaml:"dsn"`
+	DSNs        []string `yaml:"dsns"`
+	User        string   `yaml:"user"`
+	Password    string   `yaml:"password"`
+	URI         string   `yaml:"uri"`
+	SSLMode     string   `yaml:"sslmode"`
+	SSLCert     string   `yaml:"sslcert"`
+	SSLKey      string   `yaml:"sslkey"`
+	SSLRootCert string   `yaml:"sslrootcert"`
+}
+
+// ScrapeConfig describes how Pgpool-II is scraped.
+type ScrapeConfig struct {
+	Timeout model.Duration `yaml:"timeout"`
+	// Interval of the background scrapes, as --collect.interval
+	Interval model.Duration `yaml:"interval"`
+}
+
+// References to environment variables in the config file, ${VAR}, and
+// escaped ones, $${VAR}
+var envReference = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Replace the ${VAR} references of content with the value of the
+// environment variables, and $${VAR} with a literal ${VAR}. Other dollar
+// signs, e.g. in a password such as pa$$word, are kept as they are.
+func expandEnv(content string) string {
+	return envReference.ReplaceAllStringFunc(content, func(ref string) string {
+		m := envReference.FindStringSubmatch(ref)
+		if m[1] != "" {
+			return ref[1:]
+		}
+		return os.Getenv(m[2])
+	})
+}
+
+// LoadConfig reads and validates the config file at path.
+func LoadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintln("Error reading config file:", err))
+	}
+
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict([]byte(expandEnv(string(content))), cfg); err != nil {
+		return nil, errors.New(fmt.Sprintln("Error parsing config file:", err))
+	}
+
+	for name := range cfg.Collectors {
+		if _, ok := collectorState[name]; !ok {
+			return nil, fmt.Errorf("unknown collector in config file: %s", name)
+		}
+	}
+	for name := range cfg.Labels {
+		if !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("invalid label name in config file: %s", name)
+		}
+	}
+	for _, c := range cfg.Relabel {
+		if _, err := c.compile(); err != nil {
+			return nil, err
+		}
+	}
+	for namespace, filter := range cfg.Columns {
+		if len(filter.Include) > 0 && len(filter.Exclude) > 0 {
+			return nil, fmt.Errorf("both include and exclude given for the columns of %s in config file", namespace)
+		}
+		// The columns of custom queries are only known once they are
+		// loaded.
+		mappings, ok := metricMaps[namespace]
+		if !ok {
+			continue
+		}
+		for _, column := range append(append([]string{}, filter.Include...), filter.Exclude...) {
+			mapping, ok := mappings[column]
+			if !ok {
+				return nil, fmt.Errorf("unknown column of %s in config file: %s", namespace, column)
+			}
+			if mapping.usage == LABEL || mapping.usage == DISCARD {
+				return nil, fmt.Errorf("column %s of %s in config file is not exported as a metric", column, namespace)
+			}
+		}
+	}
+	for name, module := range cfg.AuthModules {
+		if err := module.validate(name); err != nil {
+			return nil, err
+		}
+	}
+	for value := range cfg.StatusValues {
+		if strings.TrimSpace(value) == "" {
+			return nil, errors.New("empty status value in config file")
+		}
+	}
+
+	return cfg, nil
+}
+
+// Apply sets the collector toggles and the scrape timeout and interval from
+// the config file, unless they were given on the command line or in the
+// environment.
+func (c *Config) Apply() {
+	for name, enabled := range c.Collectors {
+		if !*collectorSetByUser[name] && !envarSet("collector."+name) {
+			*collectorState[name] = enabled
+		}
+	}
+
+	if !scrapeTimeoutSet && !envarSet("scrape.timeout") && c.Scrape.Timeout != 0 {
+		*ScrapeTimeout = time.Duration(c.Scrape.Timeout)
+	}
+	if !collectIntervalSet && !envarSet("collect.interval") && c.Scrape.Interval != 0 {
+		*CollectInterval = time.Duration(c.Scrape.Interval)
+	}
+}
+
+// Options returns the options of the exporters set by cfg, which may be
+// nil: the status values and the column filters.
+func (c *Config) Options() []Option {
+	if c == nil {
+		return nil
+	}
+	return []Option{WithStatusValues(c.StatusValues), WithColumnFilters(c.Columns)}
+}
+
+// ConstantLabels returns the labels added to every metric: the labels of
+// cfg, which may be nil, overridden by those given with
+// --metrics.constant-labels as a comma-separated list of name=value pairs.
+func ConstantLabels(cfg *Config) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	if cfg != nil {
+		for name, value := range cfg.Labels {
+			labels[name] = value
+		}
+	}
+
+	if *ConstantLabelsFlag == "" {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(*ConstantLabelsFlag, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("invalid constant label: %q", pair)
+		}
+		labels[name] = value
+	}
+
+	return labels, nil
+}
+
+// DataSourceNames returns the DSNs of the Pgpool-II instances to scrape.
+// --pgpool.dsn, which may be repeated, takes precedence over
+// DATA_SOURCE_NAME, a single DSN. Both take precedence over the other
+// DATA_SOURCE_* environment variables and cfg, which may be nil. The TLS
+// settings given by the --db.ssl* flags override those of the DSNs.
+func DataSourceNames(cfg *Config) ([]string, error) {
+	tlsParams := map[string]string{
+		"sslmode":     *SSLMode,
+		"sslcert":     *SSLCert,
+		"sslkey":      *SSLKey,
+		"sslrootcert": *SSLRootCert,
+	}
+
+	names, err := dataSourceNames(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var dsns []string
+	for _, dsn := range names {
+		dsns = append(dsns, setDSNParams(dsn, tlsParams, true))
+	}
+
+	return dsns, nil
+}
+
+// Collect the DSNs of the Pgpool-II instances to scrape.
+func dataSourceNames(cfg *Config) ([]string, error) {
+	if len(*DataSourceNameFlags) > 0 {
+		return *DataSourceNameFlags, nil
+	}
+
+	// A single DSN, which may list several hosts of a multi-host
+	// connection, e.g. "postgresql://pgpool1:9999,pgpool2:9999/postgres".
+	if dsn := strings.TrimSpace(os.Getenv("DATA_SOURCE_NAME")); dsn != "" {
+		return []string{dsn}, nil
+	}
+
+	_, uriSet := os.LookupEnv("DATA_SOURCE_URI")
+	if cfg != nil && len(cfg.DataSource.DSNs) > 0 && !uriSet {
+		return cfg.DataSource.DSNs, nil
+	}
+
+	dsn, err := dataSourceName(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return []string{dsn}, nil
+}
+
+// ReloadDataSourceNames loads the config file and pgpool.conf again, if
+// any, and returns the DSNs of the Pgpool-II instances to scrape.
+func ReloadDataSourceNames() ([]string, error) {
+	var cfg *Config
+	if *ConfigFile != "" {
+		var err error
+		if cfg, err = LoadConfig(*ConfigFile); err != nil {
+			return nil, err
+		}
+	}
+	if *PgpoolConfFile != "" {
+		conf, err := LoadPgpoolConf(*PgpoolConfFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg = conf.applyDataSource(cfg)
+	}
+
+	return DataSourceNames(cfg)
+}
+
+// Build a single DSN from the DATA_SOURCE_USER, DATA_SOURCE_PASS and
+// DATA_SOURCE_URI environment variables and cfg.
+func dataSourceName(cfg *Config) (string, error) {
+	var ds DataSourceConfig
+	if cfg != nil {
+		ds = cfg.DataSource
+	}
+	if user, ok := os.LookupEnv("DATA_SOURCE_USER"); ok {
+		ds.User = user
+	}
+	if pass, ok := os.LookupEnv("DATA_SOURCE_PASS"); ok {
+		ds.Password = pass
+	}
+	if uri, ok := os.LookupEnv("DATA_SOURCE_URI"); ok {
+		ds.URI = uri
+		ds.DSN = ""
+	}
+
+	dsn := ds.DSN
+	if dsn == "" {
+		if isSocketDir(ds.URI) {
+			dsn = socketURIDSN(url.UserPassword(ds.User, ds.Password).String(), ds.URI)
+		} else {
+			var err error
+			if dsn, err = uriDSN(ds.User, ds.Password, ds.URI); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return setDSNParams(dsn, map[string]string{
+		"sslmode":     ds.SSLMode,
+		"sslcert":     ds.SSLCert,
+		"sslkey":      ds.SSLKey,
+		"sslrootcert": ds.SSLRootCert,
+	}, false), nil
+}
@@ -0,0 +1,197 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterState is the state of an accumulated counter.
+type counterState struct {
+	Last   float64 `json:"last"`
+	Offset float64 `json:"offset"`
+}
+
+// counterAccumulator keeps counters monotonic across Pgpool-II restarts.
+// When a counter goes down, its last value is added to an offset which is
+// applied to every later value.
+type counterAccumulator struct {
+	mutex  sync.Mutex
+	once   sync.Once
+	path   string
+	logger log.Logger
+	dirty  bool
+	states map[string]*counterState
+}
+
+// Return an accumulator saving its state to path, if not empty.
+func newCounterAccumulator(path string) *counterAccumulator {
+	return &counterAccumulator{path: path, states: make(map[string]*counterState)}
+}
+
+// Load the state saved in the file of the accumulator, if any. Only the
+// first call has an effect; errors loading and saving the state are logged
+// to logger.
+func (a *counterAccumulator) load(logger log.Logger) {
+	a.once.Do(func() {
+		a.logger = logger
+		if a.path == "" {
+			return
+		}
+
+		content, err := os.ReadFile(a.path)
+		if errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		if err == nil {
+			a.mutex.Lock()
+			err = json.Unmarshal(content, &a.states)
+			a.mutex.Unlock()
+		}
+		if err != nil {
+			level.Error(a.logger).Log("msg", "Error loading counter state", "file", a.path, "err", err)
+		}
+	})
+}
+
+// Save the state to the file it was loaded from, if it changed.
+func (a *counterAccumulator) save() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.path == "" || !a.dirty {
+		return
+	}
+
+	content, err := json.Marshal(a.states)
+	if err == nil {
+		// Write to a temporary file first so that a crash never leaves a
+		// truncated state file behind.
+		tmp := filepath.Join(filepath.Dir(a.path), "."+filepath.Base(a.path)+".tmp")
+		if err = os.WriteFile(tmp, content, 0600); err == nil {
+			err = os.Rename(tmp, a.path)
+		}
+	}
+	if err != nil {
+		level.Error(a.logger).Log("msg", "Error saving counter state", "file", a.path, "err", err)
+		return
+	}
+	a.dirty = false
+}
+
+// Return m with its value adjusted if it is a counter. instance tells
+// counters of different Pgpool-II instances apart.
+func (a *counterAccumulator) adjust(instance string, m prometheus.Metric) prometheus.Metric {
+	var metric dto.Metric
+	if err := m.Write(&metric); err != nil || metric.Counter == nil {
+		return m
+	}
+
+	labels := make([]string, 0, len(metric.Label))
+	for _, l := range metric.Label {
+		labels = append(labels, l.GetName()+"="+l.GetValue())
+	}
+	sort.Strings(labels)
+	// The help text is left out of the key, so that rewording it does not
+	// reset the counters.
+	key := fmt.Sprintf("%s|%s|%s", instance, descName(m.Desc()), strings.Join(labels, ","))
+
+	value := metric.Counter.GetValue()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	state, ok := a.states[key]
+	if !ok {
+		state = &counterState{}
+		a.states[key] = state
+	}
+	if value < state.Last {
+		// The counter was reset by a Pgpool-II restart.
+		state.Offset += state.Last
+	}
+	if !ok || value != state.Last {
+		a.dirty = true
+	}
+	state.Last = value
+
+	return accumulatedCounter{m, value + state.Offset}
+}
+
+// Return the fully-qualified name of the metrics of desc, which has no
+// accessor for it.
+func descName(desc *prometheus.Desc) string {
+	var name string
+	if _, err := fmt.Sscanf(desc.String(), "Desc{fqName: %q", &name); err != nil {
+		return desc.String()
+	}
+	return name
+}
+
+// Forward the metrics sent to the returned channel to ch, adjusting
+// counters on the way. The returned function must be called once all
+// metrics have been sent.
+func (a *counterAccumulator) forward(instance string, ch chan<- prometheus.Metric) (chan<- prometheus.Metric, func()) {
+	metricCh := make(chan prometheus.Metric)
+	doneCh := make(chan struct{})
+
+	go func() {
+		for m := range metricCh {
+			ch <- a.adjust(instance, m)
+		}
+		close(doneCh)
+	}()
+
+	return metricCh, func() {
+		close(metricCh)
+		<-doneCh
+		a.save()
+	}
+}
+
+// accumulatedCounter is a counter metric with its value replaced.
+type accumulatedCounter struct {
+	prometheus.Metric
+	value float64
+}
+
+// Write implements prometheus.Metric.
+func (c accumulatedCounter) Write(out *dto.Metric) error {
+	if err := c.Metric.Write(out); err != nil {
+		return err
+	}
+	out.Counter.Value = &c.value
+	return nil
+}
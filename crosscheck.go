@@ -0,0 +1,156 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Query of the view of a backend on itself: whether it is a standby, its
+// WAL position (replayed on a standby, written on a primary) and its number
+// of client connections.
+const backendCrosscheckQuery = `SELECT pg_is_in_recovery(),
+	((CASE WHEN pg_is_in_recovery() THEN pg_last_wal_replay_lsn() ELSE pg_current_wal_lsn() END) - '0/0')::float8,
+	(SELECT count(*) FROM pg_stat_activity WHERE backend_type = 'client backend')::float8`
+
+// A backend listed by "SHOW pool_nodes"
+type poolNode struct {
+	id       string
+	hostname string
+	port     string
+	status   string
+}
+
+// Connect directly to every backend up, with the credentials and options of
+// the DSN of Pgpool-II, and export its own view of its role, WAL position
+// and connections, to be compared with the view of Pgpool-II.
+func (e *Exporter) collectBackendCrosscheck(ctx context.Context, ch chan<- prometheus.Metric) {
+	nodes, err := e.poolNodes(ctx)
+	if err != nil {
+		level.Error(e.log(ctx)).Log("msg", "Error listing the backends to cross-check", "err", err)
+		e.scrapeErrors.WithLabelValues(errorType(err)).Inc()
+		return
+	}
+
+	labels := []string{"node_id", "hostname", "port"}
+	for _, node := range nodes {
+		if !e.isUp(node.status) {
+			continue
+		}
+		labelValues := []string{node.id, node.hostname, node.port}
+
+		inRecovery, lsn, connections, err := e.queryBackend(ctx, node)
+		up := 1.0
+		if err != nil {
+			level.Error(e.log(ctx)).Log("msg", "Error cross-checking backend", "hostname", node.hostname, "port", node.port, "err", err)
+			up = 0
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.newDesc("backend_crosscheck", "up", "Whether the backend could be queried directly (1 for yes, 0 for no).", labels),
+			prometheus.GaugeValue,
+			up,
+			labelValues...,
+		)
+		if err != nil {
+			continue
+		}
+
+		recovery := 0.0
+		if inRecovery {
+			recovery = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.newDesc("backend_crosscheck", "in_recovery", "Whether PostgreSQL reports the backend as a standby (1 for yes, 0 for no).", labels),
+			prometheus.GaugeValue,
+			recovery,
+			labelValues...,
+		)
+		if lsn.Valid {
+			ch <- prometheus.MustNewConstMetric(
+				e.newDesc("backend_crosscheck", "wal_lsn_bytes", "WAL position of the backend: replayed on a standby, written on a primary.", labels),
+				prometheus.GaugeValue,
+				lsn.Float64,
+				labelValues...,
+			)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.newDesc("backend_crosscheck", "connections", "Number of client connections reported by PostgreSQL.", labels),
+			prometheus.GaugeValue,
+			connections,
+			labelValues...,
+		)
+	}
+}
+
+// Run backendCrosscheckQuery on node, over a connection closed afterwards.
+func (e *Exporter) queryBackend(ctx context.Context, node poolNode) (bool, sql.NullFloat64, float64, error) {
+	var (
+		inRecovery  bool
+		lsn         sql.NullFloat64
+		connections float64
+	)
+
+	dsn, err := setDSNHost(e.dsn, net.JoinHostPort(node.hostname, node.port))
+	if err != nil {
+		return inRecovery, lsn, connections, err
+	}
+	db, err := e.openDB(dsn)
+	if err != nil {
+		return inRecovery, lsn, connections, err
+	}
+	defer db.Close()
+
+	err = db.QueryRowContext(ctx, backendCrosscheckQuery).Scan(&inRecovery, &lsn, &connections)
+	return inRecovery, lsn, connections, err
+}
+
+// The backends listed by "SHOW pool_nodes"
+func (e *Exporter) poolNodes(ctx context.Context) ([]poolNode, error) {
+	rows, err := e.query(ctx, "pool_nodes", e.namespaceQuery("pool_nodes"))
+	if err != nil {
+		return nil, fmt.Errorf("Error running query on database: %s %w", "pool_nodes", err)
+	}
+	defer rows.Close()
+
+	var nodes []poolNode
+	for rows.Next() {
+		var node poolNode
+		if err := scanColumns(rows, map[string]*string{
+			"node_id":  &node.id,
+			"hostname": &node.hostname,
+			"port":     &node.port,
+			"status":   &node.status,
+		}); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+
+	return nodes, rows.Err()
+}
@@ -0,0 +1,230 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// KubernetesDiscovery lists the Pgpool-II pods behind the Kubernetes
+// services matching a label selector, and serves them as targets of the
+// /probe endpoint in the Prometheus HTTP service discovery format.
+type KubernetesDiscovery struct {
+	client    *kubeClient
+	namespace string
+	selector  string
+	port      string
+	logger    log.Logger
+
+	mutex   sync.Mutex
+	targets []TargetGroup
+}
+
+// TargetGroup is a target in the Prometheus HTTP service discovery format.
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// EndpointSlice of the discovery.k8s.io/v1 API, with the fields used here
+type endpointSlice struct {
+	Metadata struct {
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+		TargetRef *struct {
+			Kind      string `json:"kind"`
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"targetRef"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name string `json:"name"`
+		Port int    `json:"port"`
+	} `json:"ports"`
+}
+
+// NewKubernetesDiscovery returns a discovery of the endpoints of the
+// services matching selector in namespace, or in the namespace of the
+// exporter if empty. port is the name or number of the Pgpool-II port of
+// the services, or empty if they have a single port.
+func NewKubernetesDiscovery(namespace, selector, port string, logger log.Logger) (*KubernetesDiscovery, error) {
+	client, err := inClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		content, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, errors.New(fmt.Sprintln("Error reading the namespace of the exporter:", err))
+		}
+		namespace = strings.TrimSpace(string(content))
+	}
+
+	return &KubernetesDiscovery{
+		client:    client,
+		namespace: namespace,
+		selector:  selector,
+		port:      port,
+		logger:    logger,
+		targets:   []TargetGroup{},
+	}, nil
+}
+
+// Run lists the endpoints every interval until ctx is done.
+func (d *KubernetesDiscovery) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.refresh(ctx); err != nil {
+			// The targets of the last successful listing are kept.
+			level.Error(d.logger).Log("msg", "Error listing the Kubernetes endpoints", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// List the endpoints and replace the targets.
+func (d *KubernetesDiscovery) refresh(ctx context.Context) error {
+	var list struct {
+		Items []endpointSlice `json:"items"`
+	}
+	path := "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(d.namespace) + "/endpointslices?labelSelector=" + url.QueryEscape(d.selector)
+	if _, err := d.client.do(ctx, http.MethodGet, path, nil, &list); err != nil {
+		return err
+	}
+
+	var targets []TargetGroup
+	for _, slice := range list.Items {
+		service := slice.Metadata.Labels["kubernetes.io/service-name"]
+		port, err := d.slicePort(slice)
+		if err != nil {
+			level.Warn(d.logger).Log("msg", "Skipping Kubernetes service", "service", service, "err", err)
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			// Endpoints which are not ready are not sent traffic either.
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, address := range endpoint.Addresses {
+				target := net.JoinHostPort(address, strconv.Itoa(port))
+				labels := map[string]string{
+					"instance":  target,
+					"namespace": d.namespace,
+					"service":   service,
+				}
+				// Named after the pod rather than its address, which
+				// changes when the pod is recreated.
+				if ref := endpoint.TargetRef; ref != nil && ref.Kind == "Pod" {
+					labels["instance"] = ref.Namespace + "/" + ref.Name
+					labels["pod"] = ref.Name
+				}
+				targets = append(targets, TargetGroup{Targets: []string{target}, Labels: labels})
+			}
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Targets[0] < targets[j].Targets[0]
+	})
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	previous := make(map[string]bool, len(d.targets))
+	for _, t := range d.targets {
+		previous[t.Targets[0]] = true
+	}
+	current := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		current[t.Targets[0]] = true
+		if !previous[t.Targets[0]] {
+			level.Info(d.logger).Log("msg", "Discovered Pgpool-II target", "target", t.Targets[0], "instance", t.Labels["instance"])
+		}
+	}
+	for target := range previous {
+		if !current[target] {
+			level.Info(d.logger).Log("msg", "Removed Pgpool-II target", "target", target)
+		}
+	}
+	if targets == nil {
+		targets = []TargetGroup{}
+	}
+	d.targets = targets
+
+	return nil
+}
+
+// Return the Pgpool-II port of the endpoints of slice.
+func (d *KubernetesDiscovery) slicePort(slice endpointSlice) (int, error) {
+	if number, err := strconv.Atoi(d.port); err == nil {
+		return number, nil
+	}
+	for _, p := range slice.Ports {
+		if d.port == "" && len(slice.Ports) == 1 || p.Name == d.port {
+			return p.Port, nil
+		}
+	}
+	if d.port == "" {
+		return 0, errors.New("several ports: the Pgpool-II port must be given with --discovery.kubernetes.port")
+	}
+	return 0, fmt.Errorf("no port named %q", d.port)
+}
+
+// Targets returns the discovered targets.
+func (d *KubernetesDiscovery) Targets() []TargetGroup {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.targets
+}
+
+// ServeHTTP implements http.Handler, serving the targets in the Prometheus
+// HTTP service discovery format.
+func (d *KubernetesDiscovery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d.Targets())
+}
@@ -0,0 +1,69 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"os"
+	"strings"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+// EnvarPrefix is the prefix of the environment variables equivalent to the
+// flags.
+const EnvarPrefix = "PGPOOL2_EXPORTER_"
+
+// Flags which only make sense on the command line
+var commandLineFlags = map[string]bool{
+	"help":      true,
+	"help-long": true,
+	"help-man":  true,
+	"version":   true,
+	"format":    true,
+}
+
+// Envar returns the environment variable equivalent to the flag name, e.g.
+// PGPOOL2_EXPORTER_WEB_TELEMETRY_PATH for --web.telemetry-path.
+func Envar(name string) string {
+	return EnvarPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// AddEnvars lets every flag of app be set with the environment variable
+// given by Envar, except the flags which already have an environment
+// variable, such as --db.password-file (DATA_SOURCE_PASS_FILE). It must be
+// called after all the flags are defined, before parsing them.
+func AddEnvars(app *kingpin.Application) {
+	for _, flag := range app.Model().Flags {
+		if flag.Envar != "" || flag.Hidden || commandLineFlags[flag.Name] {
+			continue
+		}
+		app.GetFlag(flag.Name).Envar(Envar(flag.Name))
+	}
+}
+
+// Whether the flag name was given with its environment variable, which
+// overrides the config file like the command line.
+func envarSet(name string) bool {
+	_, ok := os.LookupEnv(Envar(name))
+	return ok
+}
@@ -0,0 +1,130 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+var (
+	// A column value could not be converted to a metric value.
+	errParse = errors.New("Unexpected error parsing column")
+	// A column this Pgpool-II version should report is missing.
+	errMissingColumn = errors.New("Column missing from the result of")
+	// The Pgpool-II version could not be determined.
+	errUnsupportedVersion = errors.New("Unsupported Pgpool-II version")
+)
+
+// A column value of a namespace which could not be converted, counted in
+// pgpool2_exporter_parse_errors_total.
+type parseError struct {
+	namespace string
+	column    string
+	value     interface{}
+}
+
+func (e *parseError) Error() string {
+	return fmt.Sprintf("%s: %s %s %v", errParse, e.namespace, e.column, e.value)
+}
+
+func (e *parseError) Unwrap() error {
+	return errParse
+}
+
+// Types of the scrape errors counted in pgpool2_exporter_scrape_errors_total
+var errorTypes = []string{"auth", "network", "timeout", "parse", "unsupported_version", "query"}
+
+// Classify a scrape error, to tell an unreachable Pgpool-II apart from a
+// misconfigured exporter.
+func errorType(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case isAuthError(err):
+		return "auth"
+	case errors.Is(err, errParse):
+		return "parse"
+	case errors.Is(err, errMissingColumn), errors.Is(err, errUnsupportedVersion):
+		return "unsupported_version"
+	case isNetworkError(err):
+		return "network"
+	default:
+		return "query"
+	}
+}
+
+// Whether err comes from connecting to or talking to Pgpool-II over the
+// network.
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	var connectErr *pgconn.ConnectError
+	return errors.As(err, &netErr) || errors.As(err, &connectErr)
+}
+
+// Whether err is a failure of the connection a query ran on, which the
+// same query on a new connection may not hit, e.g. as the Pgpool-II child
+// process serving it exited after child_life_time or child_max_connections.
+func isTransientError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+
+	// The connection was terminated by Pgpool-II or PostgreSQL.
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "57P01" || pgErr.Code == "08006"
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "57P01" || pqErr.Code == "08006"
+	}
+
+	return pgconn.SafeToRetry(err)
+}
+
+// SQLSTATE code of an error returned by Pgpool-II or PostgreSQL, or "" if
+// err carries none.
+func sqlState(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	return ""
+}
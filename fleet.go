@@ -0,0 +1,133 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// State of a cluster of Pgpool-II instances, as seen by the exporter
+type fleetCluster struct {
+	instancesUp float64
+	backendsUp  float64
+	primary     bool
+}
+
+// NewFleetGatherer returns a Gatherer adding to the metrics of g aggregates
+// across all the Pgpool-II instances scraped, exported with namespace as
+// those of the instances. The instances with the same value of clusterLabel
+// are those of one cluster: they see the same backends, which are only
+// counted once.
+func NewFleetGatherer(g prometheus.Gatherer, namespace string, clusterLabel string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		mfs = append(mfs, fleetFamilies(mfs, namespace, clusterLabel)...)
+		sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+		return mfs, err
+	})
+}
+
+// Compute the fleet aggregates from the metrics of the instances.
+func fleetFamilies(mfs []*dto.MetricFamily, namespace string, clusterLabel string) []*dto.MetricFamily {
+	clusters := make(map[string]*fleetCluster)
+	cluster := func(m *dto.Metric) *fleetCluster {
+		var name string
+		for _, l := range m.Label {
+			if l.GetName() == clusterLabel {
+				name = l.GetValue()
+			}
+		}
+		c, ok := clusters[name]
+		if !ok {
+			c = &fleetCluster{}
+			clusters[name] = c
+		}
+		return c
+	}
+
+	// The backends up seen by each instance of a cluster, of which the
+	// largest number is taken for the cluster.
+	backends := make(map[*fleetCluster]map[string]float64)
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case namespace + "_up":
+			for _, m := range mf.Metric {
+				cluster(m).instancesUp += m.GetGauge().GetValue()
+			}
+		case namespace + "_primary_nodes", namespace + "_standby_nodes":
+			for _, m := range mf.Metric {
+				c := cluster(m)
+				if backends[c] == nil {
+					backends[c] = make(map[string]float64)
+				}
+				backends[c][instanceKey(m)] += m.GetGauge().GetValue()
+				if mf.GetName() == namespace+"_primary_nodes" && m.GetGauge().GetValue() > 0 {
+					c.primary = true
+				}
+			}
+		}
+	}
+
+	var instancesUp, backendsUp, withoutPrimary float64
+	for _, c := range clusters {
+		for _, n := range backends[c] {
+			c.backendsUp = max(c.backendsUp, n)
+		}
+		instancesUp += c.instancesUp
+		backendsUp += c.backendsUp
+		if !c.primary {
+			withoutPrimary++
+		}
+	}
+
+	gauge := func(name, help string, value float64) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name:   proto.String(namespace + "_fleet_" + name),
+			Help:   proto.String(help),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(value)}}},
+		}
+	}
+	return []*dto.MetricFamily{
+		gauge("clusters", "Number of Pgpool-II clusters scraped by the exporter", float64(len(clusters))),
+		gauge("clusters_without_primary", "Number of Pgpool-II clusters with no backend up in the primary role, including those whose Pgpool-II is down", withoutPrimary),
+		gauge("instances_up", "Number of Pgpool-II instances up across all clusters", instancesUp),
+		gauge("backends_up", "Number of backends up across all clusters", backendsUp),
+	}
+}
+
+// Identify the instance of m by its labels, which are the same for the
+// metrics of one instance apart from the metric name.
+func instanceKey(m *dto.Metric) string {
+	pairs := make([]string, 0, len(m.Label))
+	for _, l := range m.Label {
+		pairs = append(pairs, l.GetName()+"="+l.GetValue())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xff")
+}
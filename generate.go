@@ -0,0 +1,342 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Metric exported for a column of a namespace
+type mappedMetric struct {
+	name      string
+	collector string
+	column    string
+	usage     columnUsage
+	help      string
+	labels    []string
+}
+
+// Metrics exported for the columns of the namespaces, including the custom
+// queries of --extend.query-path, sorted by collector and name. Disabled
+// collectors are skipped.
+func mappedMetrics(namespace string) ([]mappedMetric, error) {
+	maps := metricMaps
+	if *QueryPath != "" {
+		userMaps, _, _, err := addQueries(*QueryPath, metricMaps, columnValueMappings)
+		if err != nil {
+			return nil, err
+		}
+		maps = userMaps
+	}
+	if *NodeIDLabel {
+		maps = withNodeIDLabel(maps)
+	}
+
+	var metrics []mappedMetric
+	for metricNamespace, mappings := range maps {
+		if enabled, ok := collectorState[metricNamespace]; ok && !*enabled {
+			continue
+		}
+
+		var labels []string
+		for columnName, columnMapping := range mappings {
+			if columnMapping.usage == LABEL {
+				labels = append(labels, columnName)
+			}
+		}
+		sort.Strings(labels)
+
+		for columnName, columnMapping := range mappings {
+			if columnMapping.usage == DISCARD || columnMapping.usage == LABEL {
+				continue
+			}
+			metrics = append(metrics, mappedMetric{
+				name:      metricName(namespace, metricNamespace, columnName, columnMapping.usage, *LegacyNames),
+				collector: metricNamespace,
+				column:    columnName,
+				usage:     columnMapping.usage,
+				help:      columnMapping.description,
+				labels:    labels,
+			})
+		}
+	}
+
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].collector != metrics[j].collector {
+			return metrics[i].collector < metrics[j].collector
+		}
+		return metrics[i].name < metrics[j].name
+	})
+
+	return metrics, nil
+}
+
+// GenerateDashboard writes a Grafana dashboard of the metrics exported for
+// the namespaces, with a row for each collector, named as they are
+// exported with the current flags (e.g. --metrics.legacy-names).
+func GenerateDashboard(w io.Writer, namespace string) error {
+	metrics, err := mappedMetrics(namespace)
+	if err != nil {
+		return err
+	}
+
+	datasource := map[string]string{"type": "prometheus", "uid": "${datasource}"}
+	var panels []map[string]interface{}
+	y := 0
+
+	addRow := func(title string) {
+		panels = append(panels, map[string]interface{}{
+			"id":        len(panels) + 1,
+			"type":      "row",
+			"title":     title,
+			"collapsed": false,
+			"gridPos":   map[string]int{"h": 1, "w": 24, "x": 0, "y": y},
+			"panels":    []interface{}{},
+		})
+		y++
+	}
+	addPanel := func(column int, title, description, expr, legend, unit string) {
+		panels = append(panels, map[string]interface{}{
+			"id":          len(panels) + 1,
+			"type":        "timeseries",
+			"title":       title,
+			"description": description,
+			"datasource":  datasource,
+			"gridPos":     map[string]int{"h": 8, "w": 8, "x": column * 8, "y": y},
+			"fieldConfig": map[string]interface{}{
+				"defaults":  map[string]interface{}{"unit": unit},
+				"overrides": []interface{}{},
+			},
+			"targets": []map[string]interface{}{{
+				"datasource":   datasource,
+				"expr":         expr,
+				"legendFormat": legend,
+				"refId":        "A",
+			}},
+		})
+	}
+
+	addRow("Pgpool-II")
+	addPanel(0, "Up", "Whether the last scrape of Pgpool-II was successful", fmt.Sprintf(`%s_up{instance=~"$instance"}`, namespace), "{{instance}}", "none")
+	y += 8
+
+	column := 0
+	collector := ""
+	for _, m := range metrics {
+		// Timestamps are not worth a graph.
+		if m.usage == TIMESTAMP {
+			continue
+		}
+		if m.collector != collector {
+			if column > 0 {
+				y += 8
+			}
+			addRow(m.collector)
+			collector = m.collector
+			column = 0
+		}
+
+		selector := fmt.Sprintf(`%s{instance=~"$instance"}`, m.name)
+		expr, unit := selector, "none"
+		switch m.usage {
+		case COUNTER:
+			expr, unit = fmt.Sprintf("rate(%s[$__rate_interval])", selector), "ops"
+		case DURATION:
+			unit = "s"
+		}
+
+		legend := "{{instance}}"
+		for _, label := range m.labels {
+			legend += fmt.Sprintf(" {{%s}}", label)
+		}
+
+		addPanel(column, strings.TrimPrefix(m.name, namespace+"_"), m.help, expr, legend, unit)
+		column++
+		if column == 3 {
+			column = 0
+			y += 8
+		}
+	}
+
+	dashboard := map[string]interface{}{
+		"title":         "Pgpool-II",
+		"uid":           namespace,
+		"tags":          []string{"pgpool"},
+		"editable":      true,
+		"schemaVersion": 37,
+		"time":          map[string]string{"from": "now-1h", "to": "now"},
+		"refresh":       "30s",
+		"panels":        panels,
+		"templating": map[string]interface{}{
+			"list": []map[string]interface{}{
+				{
+					"name":  "datasource",
+					"label": "Data source",
+					"type":  "datasource",
+					"query": "prometheus",
+				},
+				{
+					"name":       "instance",
+					"label":      "Instance",
+					"type":       "query",
+					"datasource": datasource,
+					"query":      fmt.Sprintf("label_values(%s_up, instance)", namespace),
+					"refresh":    2,
+					"includeAll": true,
+					"multi":      true,
+					"allValue":   ".*",
+				},
+			},
+		},
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dashboard)
+}
+
+// Prometheus alerting rule
+type alertRule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// Alerting rule on the metric of a column, skipped when its collector is
+// disabled
+type columnAlert struct {
+	collector string
+	column    string
+	rule      func(metric string) alertRule
+}
+
+var columnAlerts = []columnAlert{
+	{"pool_nodes", "status", func(metric string) alertRule {
+		return alertRule{
+			Alert:  "PgpoolBackendDown",
+			Expr:   metric + " == 0",
+			For:    "1m",
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     "Pgpool-II backend down",
+				"description": "Backend {{ $labels.hostname }}:{{ $labels.port }} of {{ $labels.instance }} is down.",
+			},
+		}
+	}},
+	{"pool_health_check_stats", "fail_count", func(metric string) alertRule {
+		return alertRule{
+			Alert:  "PgpoolHealthCheckFailing",
+			Expr:   fmt.Sprintf("increase(%s[5m]) > 0", metric),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Pgpool-II health checks failing",
+				"description": "Health checks of backend {{ $labels.hostname }}:{{ $labels.port }} of {{ $labels.instance }} failed in the last 5 minutes.",
+			},
+		}
+	}},
+	{"pool_backend_stats", "panic_cnt", func(metric string) alertRule {
+		return alertRule{
+			Alert:  "PgpoolBackendPanic",
+			Expr:   fmt.Sprintf("increase(%s[5m]) > 0", metric),
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     "PANIC messages from a Pgpool-II backend",
+				"description": "Backend {{ $labels.hostname }}:{{ $labels.port }} of {{ $labels.instance }} returned PANIC messages in the last 5 minutes.",
+			},
+		}
+	}},
+	{"pool_backend_stats", "fatal_cnt", func(metric string) alertRule {
+		return alertRule{
+			Alert:  "PgpoolBackendFatal",
+			Expr:   fmt.Sprintf("increase(%s[5m]) > 0", metric),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "FATAL messages from a Pgpool-II backend",
+				"description": "Backend {{ $labels.hostname }}:{{ $labels.port }} of {{ $labels.instance }} returned FATAL messages in the last 5 minutes.",
+			},
+		}
+	}},
+}
+
+// GenerateAlerts writes Prometheus alerting rules on the metrics of
+// Pgpool-II, named as they are exported with the current flags.
+func GenerateAlerts(w io.Writer, namespace string) error {
+	metrics, err := mappedMetrics(namespace)
+	if err != nil {
+		return err
+	}
+
+	rules := []alertRule{{
+		Alert:  "PgpoolDown",
+		Expr:   namespace + "_up == 0",
+		For:    "5m",
+		Labels: map[string]string{"severity": "critical"},
+		Annotations: map[string]string{
+			"summary":     "Pgpool-II unreachable",
+			"description": "The exporter of {{ $labels.instance }} cannot connect to Pgpool-II.",
+		},
+	}}
+
+	// Pgpool-II refuses connections once all the child processes are in use.
+	if enabled, ok := collectorState["pool_processes"]; !ok || *enabled {
+		rules = append(rules, alertRule{
+			Alert:  "PgpoolConnectionsSaturated",
+			Expr:   namespace + "_frontend_saturation_ratio > 0.9",
+			For:    "5m",
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Pgpool-II about to refuse connections",
+				"description": "{{ $value | humanizePercentage }} of the child processes of {{ $labels.instance }} allowed by num_init_children are in use.",
+			},
+		})
+	}
+
+	for _, alert := range columnAlerts {
+		// The rules must follow the columns of the code.
+		if _, ok := metricMaps[alert.collector][alert.column]; !ok {
+			return fmt.Errorf("no column %s in namespace %s", alert.column, alert.collector)
+		}
+		for _, m := range metrics {
+			if m.collector == alert.collector && m.column == alert.column {
+				rules = append(rules, alert.rule(m.name))
+			}
+		}
+	}
+
+	content, err := yaml.Marshal(map[string]interface{}{
+		"groups": []map[string]interface{}{{"name": namespace, "rules": rules}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
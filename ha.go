@@ -0,0 +1,464 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Elector acquires and renews the lock shared by the exporters of an HA
+// pair scraping the same Pgpool-II.
+type Elector interface {
+	// Campaign acquires the lock, or renews it if it is already held, for
+	// ttl, and reports whether it is held.
+	Campaign(ctx context.Context, ttl time.Duration) (bool, error)
+	// Resign releases the lock if it is held.
+	Resign(ctx context.Context) error
+}
+
+// NewElector returns the Elector of the lock given by --ha.lock:
+// file:///path of a file on storage shared by the exporters,
+// consul://host:port/key or kubernetes://namespace/name of a Lease.
+// identity tells the exporters apart.
+func NewElector(lock, identity string) (Elector, error) {
+	u, err := url.Parse(lock)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HA lock %q: %s", lock, err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid HA lock %q: no path", lock)
+		}
+		return &fileElector{path: u.Path, identity: identity}, nil
+	case "consul":
+		key := strings.TrimPrefix(u.Path, "/")
+		if u.Host == "" || key == "" {
+			return nil, fmt.Errorf("invalid HA lock %q: must be consul://host:port/key", lock)
+		}
+		return &consulElector{
+			base:     "http://" + u.Host,
+			key:      key,
+			identity: identity,
+			token:    os.Getenv("CONSUL_HTTP_TOKEN"),
+			client:   &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	case "kubernetes":
+		name := strings.TrimPrefix(u.Path, "/")
+		if u.Host == "" || name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid HA lock %q: must be kubernetes://namespace/name", lock)
+		}
+		client, err := inClusterClient()
+		if err != nil {
+			return nil, err
+		}
+		return &leaseElector{client: client, namespace: u.Host, name: name, identity: identity}, nil
+	}
+	return nil, fmt.Errorf("invalid HA lock %q: scheme must be file, consul or kubernetes", lock)
+}
+
+// Leader runs the election of an exporter of an HA pair. Only the leader
+// runs the collectors given by --ha.leader-collectors.
+type Leader struct {
+	elector Elector
+	ttl     time.Duration
+	logger  log.Logger
+	leader  atomic.Bool
+	desc    *prometheus.Desc
+}
+
+// NewLeader returns a Leader holding the lock of elector for ttl at a time.
+func NewLeader(elector Elector, ttl time.Duration, logger log.Logger) *Leader {
+	return &Leader{
+		elector: elector,
+		ttl:     ttl,
+		logger:  logger,
+		desc:    prometheus.NewDesc(prometheus.BuildFQName(Namespace, exporter, "leader"), "Whether the exporter holds the lock of its HA pair (1 for yes, 0 for no).", nil, nil),
+	}
+}
+
+// IsLeader reports whether the exporter holds the lock.
+func (l *Leader) IsLeader() bool {
+	return l.leader.Load()
+}
+
+// Run campaigns for the lock three times per ttl until ctx is done, then
+// releases it.
+func (l *Leader) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		campaignCtx, cancel := context.WithTimeout(ctx, l.ttl/3)
+		leader, err := l.elector.Campaign(campaignCtx, l.ttl)
+		cancel()
+		if err != nil {
+			// The lock may expire before it can be renewed again, so
+			// the other exporter may take it over.
+			level.Error(l.logger).Log("msg", "Error campaigning for the HA lock", "err", err)
+			leader = false
+		}
+		if leader != l.leader.Swap(leader) {
+			level.Info(l.logger).Log("msg", "HA leadership changed", "leader", leader)
+		}
+
+		select {
+		case <-ctx.Done():
+			if l.leader.Swap(false) {
+				resignCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := l.elector.Resign(resignCtx); err != nil {
+					level.Error(l.logger).Log("msg", "Error releasing the HA lock", "err", err)
+				}
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (l *Leader) Describe(ch chan<- *prometheus.Desc) {
+	ch <- l.desc
+}
+
+// Collect implements prometheus.Collector.
+func (l *Leader) Collect(ch chan<- prometheus.Metric) {
+	value := 0.0
+	if l.IsLeader() {
+		value = 1
+	}
+	ch <- prometheus.MustNewConstMetric(l.desc, prometheus.GaugeValue, value)
+}
+
+// Lock held in a file on storage shared by the exporters, e.g. NFS.
+type fileElector struct {
+	path     string
+	identity string
+}
+
+// Content of the lock file
+type fileLease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// Read the lock file, returning its content, nil if there is none.
+func (f *fileElector) read() ([]byte, fileLease, error) {
+	var lease fileLease
+	content, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, lease, nil
+	}
+	if err != nil {
+		return nil, lease, err
+	}
+	if err := json.Unmarshal(content, &lease); err != nil {
+		return nil, lease, fmt.Errorf("invalid HA lock file %s: %s", f.path, err)
+	}
+	return content, lease, nil
+}
+
+// Path of a file of the exporter next to the lock file.
+func (f *fileElector) sidePath(suffix string) string {
+	return filepath.Join(filepath.Dir(f.path), "."+filepath.Base(f.path)+"."+f.identity+"."+suffix)
+}
+
+// Campaign implements Elector. The holder of a valid lease renews it by
+// renaming the new lease over the lock file, which the other exporter leaves
+// alone and never sees missing. A missing or expired lease is taken over
+// with a compare and swap: the lock file is moved aside, which only one
+// exporter can do, and replaced only if it is still the file which was
+// read. The new lease is then linked in its place, which fails if the other
+// exporter created the file in the meantime. The shared storage must
+// support hard links, as NFS does.
+func (f *fileElector) Campaign(ctx context.Context, ttl time.Duration) (bool, error) {
+	current, lease, err := f.read()
+	if err != nil {
+		return false, err
+	}
+	if lease.Holder != f.identity && time.Now().Before(lease.Expires) {
+		return false, nil
+	}
+
+	content, err := json.Marshal(fileLease{Holder: f.identity, Expires: time.Now().Add(ttl)})
+	if err != nil {
+		return false, err
+	}
+	// Written in full before it is linked, so that the other exporter
+	// never reads a partial file.
+	tmp := f.sidePath("new")
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+
+	if lease.Holder == f.identity && time.Now().Before(lease.Expires) {
+		if err := os.Rename(tmp, f.path); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if current != nil {
+		if claimed, err := f.claim(current); err != nil || !claimed {
+			return false, err
+		}
+	}
+	if err := os.Link(tmp, f.path); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Move the lock file aside if its content is still current, and report
+// whether it was. A file replaced by the other exporter since it was read
+// is put back.
+func (f *fileElector) claim(current []byte) (bool, error) {
+	old := f.sidePath("old")
+	if err := os.Rename(f.path, old); err != nil {
+		// Moved aside by the other exporter.
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	content, err := os.ReadFile(old)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(content, current) {
+		return true, os.Remove(old)
+	}
+	if err := os.Link(old, f.path); err != nil && !errors.Is(err, os.ErrExist) {
+		return false, err
+	}
+	return false, os.Remove(old)
+}
+
+// Resign implements Elector.
+func (f *fileElector) Resign(ctx context.Context) error {
+	current, lease, err := f.read()
+	if err != nil || lease.Holder != f.identity {
+		return err
+	}
+	_, err = f.claim(current)
+	return err
+}
+
+// Lock held as a key of Consul, acquired with a session which expires if
+// it is not renewed.
+type consulElector struct {
+	base     string
+	key      string
+	identity string
+	token    string
+	client   *http.Client
+	session  string
+}
+
+// Send a PUT request to the Consul HTTP API and decode the response into
+// out. Returns the status code of the response.
+func (c *consulElector) put(ctx context.Context, path string, body []byte, out interface{}) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.base+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("consul %s: %s: %s", path, resp.Status, bytes.TrimSpace(message))
+	}
+	if out != nil {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode, nil
+}
+
+// Campaign implements Elector.
+func (c *consulElector) Campaign(ctx context.Context, ttl time.Duration) (bool, error) {
+	if c.session != "" {
+		code, err := c.put(ctx, "/v1/session/renew/"+c.session, nil, nil)
+		if code == http.StatusNotFound {
+			// The session expired: the key was released.
+			c.session = ""
+		} else if err != nil {
+			return false, err
+		}
+	}
+	if c.session == "" {
+		// Consul does not accept a TTL below 10s.
+		body, _ := json.Marshal(map[string]string{
+			"Name":      "pgpool2_exporter " + c.identity,
+			"TTL":       fmt.Sprintf("%ds", int(max(ttl, 10*time.Second).Seconds())),
+			"Behavior":  "release",
+			"LockDelay": "0s",
+		})
+		var session struct{ ID string }
+		if _, err := c.put(ctx, "/v1/session/create", body, &session); err != nil {
+			return false, err
+		}
+		c.session = session.ID
+	}
+
+	var acquired bool
+	if _, err := c.put(ctx, "/v1/kv/"+c.key+"?acquire="+c.session, []byte(c.identity), &acquired); err != nil {
+		return false, err
+	}
+	return acquired, nil
+}
+
+// Resign implements Elector.
+func (c *consulElector) Resign(ctx context.Context) error {
+	if c.session == "" {
+		return nil
+	}
+	_, err := c.put(ctx, "/v1/session/destroy/"+c.session, nil, nil)
+	c.session = ""
+	return err
+}
+
+// Lock held as a Lease of the coordination.k8s.io API, as by the
+// controllers of Kubernetes. The service account of the exporter must be
+// allowed to get, create and update it.
+type leaseElector struct {
+	client    *kubeClient
+	namespace string
+	name      string
+	identity  string
+}
+
+// Lease of the coordination.k8s.io/v1 API
+type kubeLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// Format of the MicroTime fields of the Kubernetes API
+const kubeMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func (l *leaseElector) path() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + url.PathEscape(l.namespace) + "/leases"
+}
+
+// Campaign implements Elector.
+func (l *leaseElector) Campaign(ctx context.Context, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	var lease kubeLease
+	code, err := l.client.do(ctx, http.MethodGet, l.path()+"/"+url.PathEscape(l.name), nil, &lease)
+	if code == http.StatusNotFound {
+		lease.APIVersion = "coordination.k8s.io/v1"
+		lease.Kind = "Lease"
+		lease.Metadata.Name = l.name
+		lease.Metadata.Namespace = l.namespace
+		lease.Spec.HolderIdentity = l.identity
+		lease.Spec.LeaseDurationSeconds = int(ttl.Seconds())
+		lease.Spec.AcquireTime = now.UTC().Format(kubeMicroTime)
+		lease.Spec.RenewTime = lease.Spec.AcquireTime
+		code, err := l.client.do(ctx, http.MethodPost, l.path(), lease, nil)
+		if code == http.StatusConflict {
+			// Created by the other exporter in the meantime
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if lease.Spec.HolderIdentity != l.identity && lease.Spec.HolderIdentity != "" {
+		renewed, err := time.Parse(time.RFC3339Nano, lease.Spec.RenewTime)
+		expires := renewed.Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second)
+		if err == nil && now.Before(expires) {
+			return false, nil
+		}
+	}
+
+	if lease.Spec.HolderIdentity != l.identity {
+		lease.Spec.HolderIdentity = l.identity
+		lease.Spec.AcquireTime = now.UTC().Format(kubeMicroTime)
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.LeaseDurationSeconds = int(ttl.Seconds())
+	lease.Spec.RenewTime = now.UTC().Format(kubeMicroTime)
+	// The resource version of the lease makes the update fail if the
+	// other exporter updated it in the meantime.
+	code, err = l.client.do(ctx, http.MethodPut, l.path()+"/"+url.PathEscape(l.name), lease, nil)
+	if code == http.StatusConflict {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Resign implements Elector.
+func (l *leaseElector) Resign(ctx context.Context) error {
+	var lease kubeLease
+	if _, err := l.client.do(ctx, http.MethodGet, l.path()+"/"+url.PathEscape(l.name), nil, &lease); err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity != l.identity {
+		return nil
+	}
+	lease.Spec.HolderIdentity = ""
+	_, err := l.client.do(ctx, http.MethodPut, l.path()+"/"+url.PathEscape(l.name), lease, nil)
+	return err
+}
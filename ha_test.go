@@ -0,0 +1,174 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileElector(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "lock")
+	a := &fileElector{path: path, identity: "a"}
+	b := &fileElector{path: path, identity: "b"}
+
+	for _, step := range []struct {
+		elector *fileElector
+		want    bool
+	}{
+		{a, true},
+		{b, false},
+		// Renewed by its holder
+		{a, true},
+		{b, false},
+	} {
+		held, err := step.elector.Campaign(ctx, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if held != step.want {
+			t.Fatalf("%s: Campaign = %v, want %v", step.elector.identity, held, step.want)
+		}
+	}
+
+	if err := a.Resign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if held, err := b.Campaign(ctx, time.Minute); err != nil || !held {
+		t.Fatalf("b: Campaign after a resigned = %v, %v, want true", held, err)
+	}
+	// Not released by another exporter
+	if err := a.Resign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if held, err := a.Campaign(ctx, time.Minute); err != nil || held {
+		t.Fatalf("a: Campaign = %v, %v, want false", held, err)
+	}
+}
+
+func TestFileElectorConcurrentTakeover(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "lock")
+	electors := []*fileElector{{path: path, identity: "a"}, {path: path, identity: "b"}}
+
+	// Both exporters try to take over an expired lease in every round.
+	expired, err := json.Marshal(fileLease{Holder: "c", Expires: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 200; round++ {
+		if err := os.WriteFile(path, expired, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		held := make([]bool, len(electors))
+		start := make(chan struct{})
+		for i, elector := range electors {
+			wg.Add(1)
+			go func(i int, elector *fileElector) {
+				defer wg.Done()
+				<-start
+				var err error
+				held[i], err = elector.Campaign(ctx, time.Minute)
+				if err != nil {
+					t.Error(err)
+				}
+			}(i, elector)
+		}
+		close(start)
+		wg.Wait()
+
+		if held[0] && held[1] {
+			t.Fatalf("round %d: both exporters hold the lock", round)
+		}
+	}
+}
+
+func TestFileElectorStaleRead(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "lock")
+	a := &fileElector{path: path, identity: "a"}
+	b := &fileElector{path: path, identity: "b"}
+
+	expired, err := json.Marshal(fileLease{Holder: "c", Expires: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, expired, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// b read the expired lease, then a took it over before b replaced it.
+	if held, err := a.Campaign(ctx, time.Minute); err != nil || !held {
+		t.Fatalf("a: Campaign = %v, %v, want true", held, err)
+	}
+	if claimed, err := b.claim(expired); err != nil || claimed {
+		t.Fatalf("b: claim of the expired lease = %v, %v, want false", claimed, err)
+	}
+	_, lease, err := a.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Holder != "a" {
+		t.Errorf("lock held by %q after b failed to claim it, want a", lease.Holder)
+	}
+}
+
+func TestFileElectorRenewal(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "lock")
+	a := &fileElector{path: path, identity: "a"}
+	b := &fileElector{path: path, identity: "b"}
+
+	if held, err := a.Campaign(ctx, time.Minute); err != nil || !held {
+		t.Fatalf("a: Campaign = %v, %v, want true", held, err)
+	}
+
+	// b never takes over the valid lease a keeps renewing.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			if held, err := a.Campaign(ctx, time.Minute); err != nil || !held {
+				t.Errorf("a: renewal %d = %v, %v, want true", i, held, err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if held, err := b.Campaign(ctx, time.Minute); err != nil || held {
+			t.Fatalf("b: Campaign during the renewals of a = %v, %v, want false", held, err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/common/version"
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+// NewLandingPage returns the handler of the landing page, which links to
+// the endpoints of the exporter and summarizes its configuration: the
+// Pgpool-II instances scraped, with masked passwords, and the enabled
+// collectors.
+func NewLandingPage(dsns []string, collectors []string) (http.Handler, error) {
+	var summary strings.Builder
+	summary.WriteString("<div>\n<h3>Configuration</h3>\n<ul>\n")
+	for _, dsn := range dsns {
+		fmt.Fprintf(&summary, "<li>Pgpool-II: <code>%s</code></li>\n", html.EscapeString(MaskPassword(dsn)))
+	}
+	fmt.Fprintf(&summary, "<li>Collectors: %s</li>\n", html.EscapeString(strings.Join(collectors, ", ")))
+	summary.WriteString("</ul>\n</div>\n")
+
+	links := []web.LandingLinks{
+		{Address: *MetricsPath, Text: "Metrics"},
+		{Address: "/-/healthy", Text: "Health", Description: "Whether the exporter is running"},
+		{Address: "/-/ready", Text: "Readiness", Description: "Whether Pgpool-II is reachable"},
+		{Address: "/api/v1/status", Text: "Status", Description: "Nodes, processes and query cache of Pgpool-II as JSON"},
+		{Address: "/api/v1/capabilities", Text: "Capabilities", Description: "SHOW commands the exporter user can run on Pgpool-II as JSON"},
+	}
+	if *ExporterMetricsPath != "" {
+		links = append(links, web.LandingLinks{Address: *ExporterMetricsPath, Text: "Exporter metrics", Description: "Go runtime, process and scrape metrics of the exporter"})
+	}
+	if *K8sSelector != "" {
+		links = append(links, web.LandingLinks{Address: "/discovery/targets", Text: "Discovered targets", Description: "Pgpool-II pods found in Kubernetes, for Prometheus HTTP service discovery"})
+	}
+	if *EnablePprof {
+		links = append(links,
+			web.LandingLinks{Address: "/debug/pprof/", Text: "Profiling"},
+			web.LandingLinks{Address: "/debug/metrics", Text: "Runtime metrics", Description: "All Go runtime metrics of the exporter"},
+		)
+	}
+
+	return web.NewLandingPage(web.LandingConfig{
+		Name:        "Pgpool-II Exporter",
+		Description: "Prometheus exporter for Pgpool-II",
+		Version:     version.Info(),
+		Links:       links,
+		Form: web.LandingForm{
+			Action: "/probe",
+			Inputs: []web.LandingFormInput{
+				{Label: "Target", Type: "text", Name: "target", Placeholder: "host:port"},
+			},
+		},
+		ExtraHTML: summary.String(),
+	})
+}
@@ -0,0 +1,171 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Limiter guards the handlers which scrape Pgpool-II, so that a
+// misconfigured scraper cannot stack concurrent scrapes and use up the
+// Pgpool-II child processes. Requests above the limits are answered with
+// 503 Service Unavailable and a Retry-After header.
+type Limiter struct {
+	logger      log.Logger
+	inFlight    chan struct{}
+	clientRate  float64
+	clientBurst float64
+
+	mutex     sync.Mutex
+	clients   map[string]*tokenBucket
+	lastPrune time.Time
+
+	rejected *prometheus.CounterVec
+}
+
+// Requests allowed to a client, refilled at the client rate up to the burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter serving at most maxInFlight requests at a
+// time, and clientRate requests per second to every client (by remote IP
+// address) with bursts of clientBurst requests. Limits of 0 are disabled.
+// Rejected requests are logged to logger.
+func NewLimiter(maxInFlight int, clientRate float64, clientBurst int, logger log.Logger) *Limiter {
+	l := &Limiter{
+		logger:      logger,
+		clientRate:  clientRate,
+		clientBurst: float64(max(clientBurst, 1)),
+		clients:     map[string]*tokenBucket{},
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Subsystem: exporter,
+			Name:      "http_requests_rejected_total",
+			Help:      "Number of scrape requests rejected by --web.max-requests-in-flight or --web.client-rate-limit.",
+		}, []string{"reason"}),
+	}
+	if maxInFlight > 0 {
+		l.inFlight = make(chan struct{}, maxInFlight)
+	}
+	l.rejected.WithLabelValues("in_flight")
+	l.rejected.WithLabelValues("rate_limit")
+	return l
+}
+
+// Wrap returns a handler which serves the requests allowed by the limits
+// with h.
+func (l *Limiter) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.clientRate > 0 {
+			if wait := l.reserve(clientAddr(r), time.Now()); wait > 0 {
+				l.reject(w, r, "rate_limit", wait)
+				return
+			}
+		}
+		if l.inFlight != nil {
+			select {
+			case l.inFlight <- struct{}{}:
+				defer func() { <-l.inFlight }()
+			default:
+				l.reject(w, r, "in_flight", time.Second)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (l *Limiter) reject(w http.ResponseWriter, r *http.Request, reason string, wait time.Duration) {
+	l.rejected.WithLabelValues(reason).Inc()
+	level.Debug(l.logger).Log("msg", "Rejecting request", "client", r.RemoteAddr, "reason", reason)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many scrape requests", http.StatusServiceUnavailable)
+}
+
+// Take a token from the bucket of client, or return the time until the next
+// token if it is empty.
+func (l *Limiter) reserve(client string, now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// Full buckets are forgotten, so that clients which went away do not
+	// accumulate.
+	if now.Sub(l.lastPrune) > time.Minute {
+		for c, b := range l.clients {
+			if b.refill(now, l.clientRate, l.clientBurst) >= l.clientBurst {
+				delete(l.clients, c)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	b, ok := l.clients[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.clientBurst, last: now}
+		l.clients[client] = b
+	}
+	if b.refill(now, l.clientRate, l.clientBurst) < 1 {
+		return time.Duration((1 - b.tokens) / l.clientRate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) float64 {
+	if now.After(b.last) {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+	}
+	return b.tokens
+}
+
+// The IP address of the client of r. X-Forwarded-For is not trusted, as
+// any client can set it.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Describe implements prometheus.Collector.
+func (l *Limiter) Describe(ch chan<- *prometheus.Desc) {
+	l.rejected.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (l *Limiter) Collect(ch chan<- prometheus.Metric) {
+	l.rejected.Collect(ch)
+}
@@ -0,0 +1,183 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Events counted in the Pgpool-II log, by the messages logged by Pgpool-II
+var logFileEvents = []struct {
+	event   string
+	pattern *regexp.Regexp
+}{
+	{"failover", regexp.MustCompile(`starting degeneration\. shutdown host`)},
+	{"failback", regexp.MustCompile(`starting fail ?back\. reconnect host`)},
+	{"promotion", regexp.MustCompile(`starting promotion\. promote host`)},
+	{"child_crash", regexp.MustCompile(`process with pid: \d+ exits with status \d+ by signal \d+|terminated by segmentation fault`)},
+	{"auth_failure", regexp.MustCompile(`(?i)authentication failed`)},
+	{"kind_mismatch", regexp.MustCompile(`kind mismatch among backends`)},
+	{"health_check_failure", regexp.MustCompile(`health check failed on node \d+`)},
+}
+
+// Severity of a line of the Pgpool-II log, e.g. "pid 1234: ERROR:  ..."
+var logFileSeverity = regexp.MustCompile(`\b(DEBUG[1-5]?|INFO|NOTICE|WARNING|ERROR|LOG|FATAL|PANIC):\s`)
+
+// Severities exported even before they are first logged
+var logFileSeverities = []string{"warning", "error", "fatal", "panic"}
+
+// NewLogFileCollector returns a collector of the events logged by Pgpool-II
+// in the file at path. The lines appended since the last scrape are read on
+// every scrape, starting from the end of the file as it is when the
+// collector is created. The file is read again from its beginning when it is
+// truncated or replaced, e.g. by logrotate. Read errors are logged to
+// logger.
+func NewLogFileCollector(path string, logger log.Logger) prometheus.Collector {
+	c := &logFileCollector{
+		path:       path,
+		logger:     logger,
+		events:     make(map[string]float64),
+		severities: make(map[string]float64),
+		eventsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "logfile", "events_total"),
+			"Number of events logged by Pgpool-II, by event.",
+			[]string{"event"}, nil,
+		),
+		messagesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "logfile", "messages_total"),
+			"Number of messages logged by Pgpool-II, by severity.",
+			[]string{"severity"}, nil,
+		),
+		up: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "logfile", "up"),
+			"Whether the Pgpool-II log file could be read (1 for yes, 0 for no).",
+			nil, nil,
+		),
+	}
+	for _, e := range logFileEvents {
+		c.events[e.event] = 0
+	}
+	for _, s := range logFileSeverities {
+		c.severities[s] = 0
+	}
+	if fi, err := os.Stat(path); err == nil {
+		c.file = fi
+		c.offset = fi.Size()
+	}
+	return c
+}
+
+type logFileCollector struct {
+	path         string
+	logger       log.Logger
+	eventsDesc   *prometheus.Desc
+	messagesDesc *prometheus.Desc
+	up           *prometheus.Desc
+
+	mutex      sync.Mutex
+	file       os.FileInfo
+	offset     int64
+	events     map[string]float64
+	severities map[string]float64
+}
+
+func (c *logFileCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.eventsDesc
+	ch <- c.messagesDesc
+	ch <- c.up
+}
+
+func (c *logFileCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	up := 1.0
+	if err := c.read(); err != nil {
+		level.Error(c.logger).Log("msg", "Error reading the Pgpool-II log file", "path", c.path, "err", err)
+		up = 0
+	}
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, up)
+	for event, n := range c.events {
+		ch <- prometheus.MustNewConstMetric(c.eventsDesc, prometheus.CounterValue, n, event)
+	}
+	for severity, n := range c.severities {
+		ch <- prometheus.MustNewConstMetric(c.messagesDesc, prometheus.CounterValue, n, severity)
+	}
+}
+
+// Count the events of the complete lines appended to the log file since the
+// last read. A line still being written is left for the next read.
+func (c *logFileCollector) read() error {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if c.file == nil || !os.SameFile(c.file, fi) || fi.Size() < c.offset {
+		c.offset = 0
+	}
+	c.file = fi
+	if _, err := f.Seek(c.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c.offset += int64(len(line))
+		c.count(line)
+	}
+}
+
+// Count the event and the severity of a line of the log file.
+func (c *logFileCollector) count(line string) {
+	if m := logFileSeverity.FindStringSubmatch(line); m != nil {
+		c.severities[strings.ToLower(m[1])]++
+	}
+	for _, e := range logFileEvents {
+		if e.pattern.MatchString(line) {
+			c.events[e.event]++
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"github.com/go-kit/log"
+)
+
+type scrapeIDKey struct{}
+
+// Scrape IDs taken from the requests, e.g. set by a proxy
+var scrapeIDRegex = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// A random ID for a scrape, to tell apart the log lines of concurrent
+// scrapes.
+func newScrapeID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// Return ctx carrying the scrape ID id.
+func withScrapeID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, scrapeIDKey{}, id)
+}
+
+// The scrape ID carried by ctx, or "" if none.
+func scrapeID(ctx context.Context) string {
+	id, _ := ctx.Value(scrapeIDKey{}).(string)
+	return id
+}
+
+// The logger of the scrape running with ctx, adding its scrape_id to every
+// log line.
+func (e *Exporter) log(ctx context.Context) log.Logger {
+	if id := scrapeID(ctx); id != "" {
+		return log.With(e.logger, "scrape_id", id)
+	}
+	return e.logger
+}
+
+// ScrapeIDHandler returns a handler giving every request a scrape ID, used
+// by the scrapes it runs in their log lines and returned in the response
+// header given. The ID of the request header of the same name is used if it
+// is valid, so that a proxy can set it.
+func ScrapeIDHandler(header string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if !scrapeIDRegex.MatchString(id) {
+			id = newScrapeID()
+		}
+		w.Header().Set(header, id)
+		h.ServeHTTP(w, r.WithContext(withScrapeID(r.Context(), id)))
+	})
+}
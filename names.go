@@ -0,0 +1,88 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Name of the metric of a counter column, following the Prometheus naming
+// conventions: a "_cnt" or "_count" suffix becomes "_total", e.g. select_cnt
+// becomes select_total.
+func counterName(column string) string {
+	if strings.HasSuffix(column, "_total") {
+		return column
+	}
+	for _, suffix := range []string{"_cnt", "_count"} {
+		column = strings.TrimSuffix(column, suffix)
+	}
+	return column + "_total"
+}
+
+// Name of the metric exported for a column of a namespace, depending on
+// the usage of the column and whether the legacy names are exported.
+// Durations reported in another unit than seconds get a "_seconds" suffix,
+// e.g. max_duration becomes max_duration_seconds.
+func metricName(namespace string, metricNamespace string, columnName string, usage columnUsage, legacy bool) string {
+	switch usage {
+	case COUNTER:
+		if !legacy {
+			columnName = counterName(columnName)
+		}
+	case TIMESTAMP:
+		columnName += "_timestamp_seconds"
+	case DURATION:
+		if _, ok := durationColumnUnits[metricNamespace][columnName]; ok && !legacy {
+			columnName += "_seconds"
+		}
+	}
+	return fmt.Sprintf("%s_%s_%s", namespace, metricNamespace, columnName)
+}
+
+// MetricRenames returns the metrics renamed to follow the Prometheus naming
+// conventions, from their legacy name (still exported with
+// --metrics.legacy-names) to their current name.
+func MetricRenames(namespace string) map[string]string {
+	renames := make(map[string]string)
+
+	for metricNamespace, mappings := range metricMaps {
+		for columnName, columnMapping := range mappings {
+			legacy := fmt.Sprintf("%s_%s_%s", namespace, metricNamespace, columnName)
+			current := legacy
+			switch columnMapping.usage {
+			case COUNTER:
+				current = fmt.Sprintf("%s_%s_%s", namespace, metricNamespace, counterName(columnName))
+			case DURATION:
+				if _, ok := durationColumnUnits[metricNamespace][columnName]; ok {
+					current = legacy + "_seconds"
+				}
+			}
+			if legacy != current {
+				renames[legacy] = current
+			}
+		}
+	}
+
+	return renames
+}
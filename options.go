@@ -0,0 +1,406 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Option configures an Exporter created with NewExporter.
+type Option func(*Exporter)
+
+// WithLogger sets the logger of the exporter. By default nothing is logged.
+func WithLogger(logger log.Logger) Option {
+	return func(e *Exporter) {
+		e.logger = logger
+	}
+}
+
+// WithDB makes the exporter use an already established connection instead
+// of connecting to the DSN. The connection is closed by Close, and replaced
+// by a connection to the DSN if it stops responding.
+func WithDB(db *sql.DB) Option {
+	return WithQuerier(NewSQLQuerier(db))
+}
+
+// WithQuerier makes the exporter run its queries with q instead of
+// connecting to the DSN, e.g. to use another database driver or a mock. q
+// is closed by Close, and replaced by a connection to the DSN if it stops
+// responding.
+func WithQuerier(q Querier) Option {
+	return func(e *Exporter) {
+		e.DB = q
+	}
+}
+
+// WithDialer makes the exporter connect to Pgpool-II with dial instead of
+// a direct TCP or Unix domain socket connection.
+func WithDialer(dial DialFunc) Option {
+	return func(e *Exporter) {
+		e.dial = dial
+	}
+}
+
+// WithCollectors enables or disables collectors by namespace (e.g.
+// "pool_nodes"). Collectors not listed are enabled.
+func WithCollectors(collectors map[string]bool) Option {
+	return func(e *Exporter) {
+		if e.collectors == nil {
+			e.collectors = make(map[string]bool, len(collectors))
+		}
+		for namespace, enabled := range collectors {
+			e.collectors[namespace] = enabled
+		}
+	}
+}
+
+// WithLeaderCollectors runs the collectors of the given namespaces only
+// while isLeader returns true, e.g. while the exporter holds the lock of
+// its HA pair (see Leader).
+func WithLeaderCollectors(isLeader func() bool, namespaces []string) Option {
+	return func(e *Exporter) {
+		e.isLeader = isLeader
+		e.leaderOnly = make(map[string]bool, len(namespaces))
+		for _, namespace := range namespaces {
+			e.leaderOnly[namespace] = true
+		}
+	}
+}
+
+// WithConstLabels adds labels to every metric of the exporter.
+func WithConstLabels(labels prometheus.Labels) Option {
+	return func(e *Exporter) {
+		e.constLabels = labels
+	}
+}
+
+// WithNamespace sets the prefix of the metric names. The default is
+// "pgpool2".
+func WithNamespace(namespace string) Option {
+	return func(e *Exporter) {
+		e.namespace = namespace
+	}
+}
+
+// WithoutExporterMetrics leaves the metrics of the exporter about its own
+// scrapes out of Collect, to register them apart with ExporterMetrics.
+func WithoutExporterMetrics() Option {
+	return func(e *Exporter) {
+		e.noSelfMetrics = true
+	}
+}
+
+// WithScrapeTimeout bounds the queries of a single scrape. The default is
+// no timeout.
+func WithScrapeTimeout(timeout time.Duration) Option {
+	return func(e *Exporter) {
+		e.scrapeTimeout = timeout
+	}
+}
+
+// WithScrapeConcurrency sets the number of namespaces queried concurrently,
+// each on its own connection. The default is 1.
+func WithScrapeConcurrency(concurrency int) Option {
+	return func(e *Exporter) {
+		e.scrapeConcurrency = max(concurrency, 1)
+	}
+}
+
+// WithCollectInterval scrapes Pgpool-II in the background at interval,
+// serving the latest metrics on every Collect. The default is to scrape on
+// every Collect.
+func WithCollectInterval(interval time.Duration) Option {
+	return func(e *Exporter) {
+		e.collectInterval = interval
+	}
+}
+
+// WithCacheTTL serves the metrics of a scrape again for ttl instead of
+// querying Pgpool-II. The default is no cache.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(e *Exporter) {
+		e.cacheTTL = ttl
+	}
+}
+
+// WithServeStale serves the metrics of the last successful scrape again,
+// marked with pgpool2_stale_data, for d while Pgpool-II is unreachable.
+func WithServeStale(d time.Duration) Option {
+	return func(e *Exporter) {
+		e.serveStaleFor = d
+	}
+}
+
+// WithStrictMetrics fails the scrape when a value reported by Pgpool-II
+// cannot be parsed, instead of only logging it.
+func WithStrictMetrics(strict bool) Option {
+	return func(e *Exporter) {
+		e.strictMetrics = strict
+	}
+}
+
+// WithAccumulatedCounters keeps the counters monotonic across Pgpool-II
+// restarts, saving their state to stateFile if set. The exporters given the
+// same Option share the state, so that the counters of probed targets stay
+// monotonic between probes.
+func WithAccumulatedCounters(stateFile string) Option {
+	accumulator := newCounterAccumulator(stateFile)
+	return func(e *Exporter) {
+		e.accumulator = accumulator
+	}
+}
+
+// WithStatusValues sets the value of the given backend statuses and
+// booleans, overriding the defaults and adding to them.
+func WithStatusValues(values map[string]float64) Option {
+	return func(e *Exporter) {
+		for value, number := range values {
+			e.statusValues[strings.ToLower(value)] = number
+		}
+	}
+}
+
+// WithColumnFilters leaves out the metrics of the columns excluded by
+// filters, by namespace.
+func WithColumnFilters(filters map[string]ColumnFilter) Option {
+	return func(e *Exporter) {
+		e.columnFilters = filters
+	}
+}
+
+// WithAggregatePools exports the backend connection slots in use by
+// backend, user and database instead of by child process.
+func WithAggregatePools(aggregate bool) Option {
+	return func(e *Exporter) {
+		e.aggregatePools = aggregate
+	}
+}
+
+// WithFrontendClientHosts exports the number of frontend connections from
+// each client host.
+func WithFrontendClientHosts(enabled bool) Option {
+	return func(e *Exporter) {
+		e.frontendClientHosts = enabled
+	}
+}
+
+// WithLegacyNames exports the counters under their names before they were
+// given the _total suffix.
+func WithLegacyNames(legacy bool) Option {
+	return func(e *Exporter) {
+		e.legacyNames = legacy
+	}
+}
+
+// WithNodeIDLabel adds the node_id label to the pool_nodes and
+// pool_backend_stats metrics.
+func WithNodeIDLabel(enabled bool) Option {
+	return func(e *Exporter) {
+		e.nodeIDLabel = enabled
+	}
+}
+
+// WithReplicationDelayHistogram exports a histogram of the replication
+// delay observed on every scrape, with buckets as upper bounds in seconds.
+// No histogram is exported if buckets is empty.
+func WithReplicationDelayHistogram(buckets []float64) Option {
+	return func(e *Exporter) {
+		e.delayBuckets = buckets
+	}
+}
+
+// WithCustomQueries loads the custom queries of the YAML file at path.
+func WithCustomQueries(path string) Option {
+	return func(e *Exporter) {
+		e.queryPath = path
+	}
+}
+
+// WithDriver selects the database driver: "pgx" (the default) or
+// "postgres" (lib/pq).
+func WithDriver(driver string) Option {
+	return func(e *Exporter) {
+		e.driver = driver
+	}
+}
+
+// WithConnectionLimits sets the maximum number of open and idle
+// connections to Pgpool-II, and the time after which a connection is
+// re-established. Zero limits default to the scrape concurrency, and a
+// zero lifetime keeps the connections until they fail.
+func WithConnectionLimits(maxOpen int, maxIdle int, maxLifetime time.Duration) Option {
+	return func(e *Exporter) {
+		e.maxOpenConns = maxOpen
+		e.maxIdleConns = maxIdle
+		e.connMaxLifetime = maxLifetime
+	}
+}
+
+// WithReconnectBackoff sets the delay before the second attempt to connect
+// to Pgpool-II, doubled after each failed attempt up to max. The defaults
+// are 1s and 1m.
+func WithReconnectBackoff(base time.Duration, max time.Duration) Option {
+	return func(e *Exporter) {
+		e.backoffBase = base
+		e.backoffMax = max
+	}
+}
+
+// WithStartupConnectRetries makes NewExporter try to connect to Pgpool-II
+// up to retries times, or until it succeeds if retries is negative. By
+// default, the connection is established on the first scrape.
+func WithStartupConnectRetries(retries int) Option {
+	return func(e *Exporter) {
+		e.startupRetries = retries
+	}
+}
+
+// WithSlowQueryThreshold logs the queries which take longer than
+// threshold. The default is 2s, and 0 disables it.
+func WithSlowQueryThreshold(threshold time.Duration) Option {
+	return func(e *Exporter) {
+		e.slowQueryThreshold = threshold
+	}
+}
+
+// WithProcessCollector exports the resource usage of the Pgpool-II
+// processes, read from the proc filesystem mounted at procfs.
+func WithProcessCollector(procfs string) Option {
+	return func(e *Exporter) {
+		e.procfs = procfs
+	}
+}
+
+// WithBackendCrosscheck connects directly to every backend up to export
+// what PostgreSQL reports about it.
+func WithBackendCrosscheck(enabled bool) Option {
+	return func(e *Exporter) {
+		e.backendCrosscheck = enabled
+	}
+}
+
+// WithCredentialFiles reads the user name and password of the connections
+// to Pgpool-II from files, read again on every connection.
+func WithCredentialFiles(userFile string, passwordFile string) Option {
+	return func(e *Exporter) {
+		e.userFile = userFile
+		e.passwordFile = passwordFile
+	}
+}
+
+// WithRedactedLabels hashes the values of the labels in the status
+// reported by StatusHandler with the HMAC key, as --metrics.redact-labels
+// does in the metrics.
+func WithRedactedLabels(labels []string, key []byte) Option {
+	return func(e *Exporter) {
+		e.hashKey = key
+		e.redactedLabels = make(map[string]bool, len(labels))
+		for _, label := range labels {
+			e.redactedLabels[label] = true
+		}
+	}
+}
+
+// FlagOptions returns the options set by the command line flags (and the
+// config file applied to them), for the exporters of the command.
+func FlagOptions() ([]Option, error) {
+	collectors := make(map[string]bool, len(collectorState))
+	for namespace, enabled := range collectorState {
+		collectors[namespace] = *enabled
+	}
+
+	var redacted []string
+	for _, rule := range RedactRules() {
+		redacted = append(redacted, rule.Label)
+	}
+	if len(redacted) > 0 && *HashKey == "" {
+		return nil, fmt.Errorf("--metrics.redact-labels: %w", errNoHashKey)
+	}
+
+	opts := []Option{
+		WithCollectors(collectors),
+		WithScrapeTimeout(*ScrapeTimeout),
+		WithScrapeConcurrency(*ScrapeConcurrency),
+		WithCollectInterval(*CollectInterval),
+		WithCacheTTL(*CacheTTL),
+		WithServeStale(*ServeStaleFor),
+		WithStrictMetrics(*StrictMetrics),
+		WithAggregatePools(*AggregatePools),
+		WithFrontendClientHosts(*FrontendClientHosts),
+		WithLegacyNames(*LegacyNames),
+		WithNodeIDLabel(*NodeIDLabel),
+		WithCustomQueries(*QueryPath),
+		WithDriver(*DBDriver),
+		WithConnectionLimits(*MaxOpenConns, *MaxIdleConns, *ConnMaxLifetime),
+		WithReconnectBackoff(*ReconnectBackoffBase, *ReconnectBackoffMax),
+		WithStartupConnectRetries(*StartupConnectRetries),
+		WithSlowQueryThreshold(*SlowQueryThreshold),
+		WithBackendCrosscheck(*BackendCrosscheck),
+		WithCredentialFiles(*UserFile, *PasswordFile),
+		WithRedactedLabels(redacted, []byte(*HashKey)),
+	}
+	if *AccumulateCounters {
+		opts = append(opts, WithAccumulatedCounters(*CounterStateFile))
+	}
+	if *ReplDelayHistogram {
+		buckets, err := ReplicationDelayBuckets()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithReplicationDelayHistogram(buckets))
+	}
+	if *CollectProcess {
+		opts = append(opts, WithProcessCollector(*ProcfsPath))
+	}
+	return opts, nil
+}
+
+// Whether the collector of a namespace is enabled.
+func (e *Exporter) collectorEnabled(namespace string) bool {
+	if enabled, ok := e.collectors[namespace]; ok {
+		return enabled
+	}
+	return true
+}
+
+// Collectors returns the namespaces of the enabled collectors, sorted.
+func (e *Exporter) Collectors() []string {
+	collectors := make([]string, 0, len(e.metricMap))
+	for namespace := range e.metricMap {
+		collectors = append(collectors, namespace)
+	}
+	sort.Strings(collectors)
+	return collectors
+}
+
+// Build the descriptor of a metric computed by the exporter.
+func (e *Exporter) newDesc(subsystem string, name string, help string, variableLabels []string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(e.namespace, subsystem, name), help, variableLabels, e.constLabels)
+}
@@ -0,0 +1,106 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestOptionsIgnoreFlags(t *testing.T) {
+	// Flags set by the program embedding the exporter are not read.
+	defer func(legacy, aggregate bool) {
+		*LegacyNames, *AggregatePools = legacy, aggregate
+	}(*LegacyNames, *AggregatePools)
+	*LegacyNames, *AggregatePools = true, true
+
+	families := gatherFixtures(t, "4.2")
+	for _, name := range []string{"pgpool2_pool_nodes_select_total", "pgpool2_backend_by_process_used"} {
+		if _, ok := families[name]; !ok {
+			t.Errorf("%s not exported without options", name)
+		}
+	}
+
+	families = gatherFixtures(t, "4.2", WithLegacyNames(true), WithAggregatePools(true))
+	for _, name := range []string{"pgpool2_pool_nodes_select_cnt", "pgpool2_backend_by_node_used"} {
+		if _, ok := families[name]; !ok {
+			t.Errorf("%s not exported with the options", name)
+		}
+	}
+	for _, name := range []string{"pgpool2_pool_nodes_select_total", "pgpool2_backend_by_process_used"} {
+		if _, ok := families[name]; ok {
+			t.Errorf("%s exported with the options", name)
+		}
+	}
+}
+
+func TestWithCollectors(t *testing.T) {
+	e := newExporter("", WithCollectors(map[string]bool{"pool_processes": false}), WithCollectors(map[string]bool{"pool_cache": false}))
+	for _, namespace := range e.Collectors() {
+		if namespace == "pool_processes" || namespace == "pool_cache" {
+			t.Errorf("collector %s enabled", namespace)
+		}
+	}
+	if !e.collectorEnabled("pool_nodes") {
+		t.Error("collector pool_nodes not listed but disabled")
+	}
+}
+
+func TestWithStatusValues(t *testing.T) {
+	e := newExporter("", WithStatusValues(map[string]float64{"Standby": 1, "down": 1}))
+	for status, want := range map[string]float64{"standby": 1, "down": 1, "up": 1, "unused": 0} {
+		if got, ok := e.parseStatusField(status); !ok || got != want {
+			t.Errorf("status %s: got %v (known: %v), want %v", status, got, ok, want)
+		}
+	}
+
+	// The values of one exporter are not seen by the others.
+	other := newExporter("")
+	if _, ok := other.parseStatusField("standby"); ok {
+		t.Error("status standby known by an exporter without the option")
+	}
+	if got, _ := other.parseStatusField("down"); got != 0 {
+		t.Errorf("status down: got %v, want 0", got)
+	}
+}
+
+func TestFleetNamespace(t *testing.T) {
+	var mfs []*dto.MetricFamily
+	for _, mf := range gatherFixtures(t, "4.2", WithNamespace("pool")) {
+		mfs = append(mfs, mf)
+	}
+
+	families := make(map[string]*dto.MetricFamily)
+	for _, mf := range fleetFamilies(mfs, "pool", "cluster") {
+		families[mf.GetName()] = mf
+	}
+	for name, want := range map[string]float64{"pool_fleet_instances_up": 1, "pool_fleet_clusters_without_primary": 0} {
+		if got, ok := seriesValue(families[name], nil); !ok || got != want {
+			t.Errorf("%s: got %v (exported: %v), want %v", name, got, ok, want)
+		}
+	}
+	if got, _ := seriesValue(families["pool_fleet_backends_up"], nil); got == 0 {
+		t.Error("pool_fleet_backends_up: got 0 backends up")
+	}
+}
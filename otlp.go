@@ -0,0 +1,199 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+)
+
+// OTLPMetricsURL returns the URL of the OTLP/HTTP metrics endpoint of
+// endpoint: endpoint itself if it has a path, or endpoint with the default
+// /v1/metrics path.
+func OTLPMetricsURL(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported OTLP endpoint scheme %q: only OTLP/HTTP is supported", u.Scheme)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/metrics"
+	}
+	return u.String(), nil
+}
+
+// The types below follow the JSON encoding of the OTLP
+// ExportMetricsServiceRequest message. 64-bit integers are encoded as
+// strings.
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	// Number data points
+	AsDouble *float64 `json:"asDouble,omitempty"`
+	// Histogram and summary data points
+	Count          string         `json:"count,omitempty"`
+	Sum            *float64       `json:"sum,omitempty"`
+	BucketCounts   []string       `json:"bucketCounts,omitempty"`
+	ExplicitBounds []float64      `json:"explicitBounds,omitempty"`
+	QuantileValues []otlpQuantile `json:"quantileValues,omitempty"`
+}
+
+type otlpQuantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+type otlpData struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality,omitempty"`
+	IsMonotonic            bool            `json:"isMonotonic,omitempty"`
+}
+
+type otlpMetric struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Gauge       *otlpData `json:"gauge,omitempty"`
+	Sum         *otlpData `json:"sum,omitempty"`
+	Histogram   *otlpData `json:"histogram,omitempty"`
+	Summary     *otlpData `json:"summary,omitempty"`
+}
+
+// AGGREGATION_TEMPORALITY_CUMULATIVE
+const otlpCumulative = 2
+
+func otlpAttr(key, value string) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	a.Value.StringValue = value
+	return a
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// Encode the metrics as an OTLP/HTTP JSON request. Counters become
+// cumulative monotonic sums starting at start, and the cumulative buckets
+// of the histograms are turned into bucket counts.
+func otlpRequest(mfs []*dto.MetricFamily, start time.Time, now time.Time) ([]byte, error) {
+	var metrics []otlpMetric
+
+	for _, mf := range mfs {
+		metric := otlpMetric{Name: mf.GetName(), Description: mf.GetHelp()}
+		data := &otlpData{}
+
+		for _, m := range mf.Metric {
+			point := otlpDataPoint{TimeUnixNano: otlpTime(now)}
+			if m.TimestampMs != nil {
+				point.TimeUnixNano = otlpTime(time.UnixMilli(m.GetTimestampMs()))
+			}
+			for _, l := range m.Label {
+				point.Attributes = append(point.Attributes, otlpAttr(l.GetName(), l.GetValue()))
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				value := m.Counter.GetValue()
+				point.AsDouble = &value
+				point.StartTimeUnixNano = otlpTime(start)
+			case dto.MetricType_GAUGE:
+				value := m.Gauge.GetValue()
+				point.AsDouble = &value
+			case dto.MetricType_UNTYPED:
+				value := m.Untyped.GetValue()
+				point.AsDouble = &value
+			case dto.MetricType_HISTOGRAM:
+				sum := m.Histogram.GetSampleSum()
+				point.StartTimeUnixNano = otlpTime(start)
+				point.Count = strconv.FormatUint(m.Histogram.GetSampleCount(), 10)
+				point.Sum = &sum
+				var previous uint64
+				for _, b := range m.Histogram.Bucket {
+					point.ExplicitBounds = append(point.ExplicitBounds, b.GetUpperBound())
+					point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(b.GetCumulativeCount()-previous, 10))
+					previous = b.GetCumulativeCount()
+				}
+				// +Inf bucket
+				point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(m.Histogram.GetSampleCount()-previous, 10))
+			case dto.MetricType_SUMMARY:
+				sum := m.Summary.GetSampleSum()
+				point.StartTimeUnixNano = otlpTime(start)
+				point.Count = strconv.FormatUint(m.Summary.GetSampleCount(), 10)
+				point.Sum = &sum
+				for _, q := range m.Summary.Quantile {
+					point.QuantileValues = append(point.QuantileValues, otlpQuantile{q.GetQuantile(), q.GetValue()})
+				}
+			}
+			data.DataPoints = append(data.DataPoints, point)
+		}
+
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			data.AggregationTemporality = otlpCumulative
+			data.IsMonotonic = true
+			metric.Sum = data
+		case dto.MetricType_HISTOGRAM:
+			data.AggregationTemporality = otlpCumulative
+			metric.Histogram = data
+		case dto.MetricType_SUMMARY:
+			metric.Summary = data
+		default:
+			metric.Gauge = data
+		}
+		metrics = append(metrics, metric)
+	}
+
+	hostname, _ := os.Hostname()
+	return json.Marshal(map[string]interface{}{
+		"resourceMetrics": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{
+					otlpAttr("service.name", "pgpool2_exporter"),
+					otlpAttr("service.version", version.Version),
+					otlpAttr("host.name", hostname),
+				},
+			},
+			"scopeMetrics": []interface{}{map[string]interface{}{
+				"scope":   map[string]string{"name": "pgpool2_exporter", "version": version.Version},
+				"metrics": metrics,
+			}},
+		}},
+	})
+}
@@ -0,0 +1,393 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Upper bound of the size of a PCP response, to fail early on garbage
+const pcpMaxMessageSize = 16 * 1024 * 1024
+
+// pcpConfig tells how to reach the PCP port of Pgpool-II.
+type pcpConfig struct {
+	network      string
+	address      string
+	user         string
+	passwordFile string
+}
+
+// WithPCP enables the PCP collector, which reads the backend node, process
+// and watchdog information Pgpool-II only reports through PCP. host is a
+// hostname or the directory of the PCP unix socket. The password is read
+// from passwordFile on every scrape.
+func WithPCP(host string, port int, user string, passwordFile string) Option {
+	return func(e *Exporter) {
+		cfg := &pcpConfig{
+			network:      "tcp",
+			address:      net.JoinHostPort(host, strconv.Itoa(port)),
+			user:         user,
+			passwordFile: passwordFile,
+		}
+		if strings.HasPrefix(host, "/") {
+			cfg.network = "unix"
+			cfg.address = filepath.Join(host, fmt.Sprintf(".s.PGSQL.%d", port))
+		}
+		e.pcp = cfg
+	}
+}
+
+// pcpConn is an authenticated connection to the PCP port of Pgpool-II.
+type pcpConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Connect to PCP with dial, if set, and authenticate. The connection is
+// closed when ctx is done.
+func dialPCP(ctx context.Context, cfg *pcpConfig, dial DialFunc) (*pcpConn, error) {
+	var password string
+	if cfg.passwordFile != "" {
+		content, err := os.ReadFile(cfg.passwordFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintln("Error reading PCP password file:", err))
+		}
+		password = strings.TrimRight(string(content), "\r\n")
+	}
+
+	if dial == nil {
+		var dialer net.Dialer
+		dial = dialer.DialContext
+	}
+	conn, err := dial(ctx, cfg.network, cfg.address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c := &pcpConn{conn: conn, reader: bufio.NewReader(conn)}
+	if err := c.authenticate(cfg.user, password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Authenticate with the md5 challenge of PCP: the server sends a salt and
+// expects md5(md5(md5(password) + user) + salt).
+func (c *pcpConn) authenticate(user string, password string) error {
+	if err := c.send('M'); err != nil {
+		return err
+	}
+	salt, err := c.receive('m')
+	if err != nil {
+		return err
+	}
+	if len(salt) < 4 {
+		return errors.New("invalid PCP salt")
+	}
+
+	hash := md5Hex(md5Hex(md5Hex(password)+user) + string(salt[:4]))
+	if err := c.send('R', user, hash); err != nil {
+		return err
+	}
+	response, err := c.receive('r')
+	if err != nil {
+		return err
+	}
+	if fields := pcpFields(response); len(fields) == 0 || fields[0] != "AuthenticationOK" {
+		return errors.New("PCP authentication failed")
+	}
+
+	return nil
+}
+
+// Send a request made of a tag and null-terminated string fields.
+func (c *pcpConn) send(tag byte, fields ...string) error {
+	var size int
+	for _, field := range fields {
+		size += len(field) + 1
+	}
+
+	msg := make([]byte, 5, 5+size)
+	msg[0] = tag
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+size))
+	for _, field := range fields {
+		msg = append(msg, field...)
+		msg = append(msg, 0)
+	}
+
+	_, err := c.conn.Write(msg)
+	return err
+}
+
+// Read the next response, which must have the given tag, skipping notices.
+func (c *pcpConn) receive(tag byte) ([]byte, error) {
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(header[1:])
+		if size < 4 || size > pcpMaxMessageSize {
+			return nil, fmt.Errorf("invalid PCP message length %d", size)
+		}
+		body := make([]byte, size-4)
+		if _, err := io.ReadFull(c.reader, body); err != nil {
+			return nil, err
+		}
+
+		switch header[0] {
+		case tag:
+			return body, nil
+		case 'N':
+			continue
+		case 'E':
+			return nil, pcpError(body)
+		default:
+			return nil, fmt.Errorf("unexpected PCP response %q", header[0])
+		}
+	}
+}
+
+// Send a command and return the fields of its result, which must start with
+// "CommandComplete".
+func (c *pcpConn) command(tag byte, fields ...string) ([]string, error) {
+	if err := c.send(tag, fields...); err != nil {
+		return nil, err
+	}
+	// Responses use the lower case tag of the request.
+	response, err := c.receive(tag + 'a' - 'A')
+	if err != nil {
+		return nil, err
+	}
+
+	result := pcpFields(response)
+	if len(result) == 0 || result[0] != "CommandComplete" {
+		return nil, fmt.Errorf("PCP command %q failed", tag)
+	}
+
+	return result[1:], nil
+}
+
+// Close the connection, telling Pgpool-II first.
+func (c *pcpConn) close() error {
+	c.send('X')
+	return c.conn.Close()
+}
+
+// Split a response into its null-terminated fields.
+func pcpFields(body []byte) []string {
+	s := strings.TrimRight(string(body), "\x00")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\x00")
+}
+
+// Turn an error response into an error. The response is made of fields
+// with a one byte type, as in the PostgreSQL protocol; 'M' is the message.
+func pcpError(body []byte) error {
+	for _, field := range pcpFields(body) {
+		if len(field) > 1 && field[0] == 'M' {
+			return errors.New("PCP error: " + field[1:])
+		}
+	}
+	return errors.New("PCP error")
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// Watchdog information returned by the W command as JSON. Pgpool-II
+// before 4.3 names the leader "Master".
+type pcpWatchdogInfo struct {
+	RemoteNodeCount int               `json:"RemoteNodeCount"`
+	QuorumStatus    int               `json:"QuorumStatus"`
+	AliveNodeCount  int               `json:"AliveNodeCount"`
+	Escalated       pcpBool           `json:"Escalated"`
+	LeaderNodeName  string            `json:"LeaderNodeName"`
+	MasterNodeName  string            `json:"MasterNodeName"`
+	WatchdogNodes   []pcpWatchdogNode `json:"WatchdogNodes"`
+}
+
+// Watchdog node, the local node coming first
+type pcpWatchdogNode struct {
+	ID         int    `json:"ID"`
+	NodeName   string `json:"NodeName"`
+	HostName   string `json:"HostName"`
+	DelegateIP string `json:"DelegateIP"`
+	StateName  string `json:"StateName"`
+}
+
+// pcpBool is a flag reported either as a JSON boolean or as a number,
+// depending on the Pgpool-II version.
+type pcpBool bool
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (b *pcpBool) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case "true", "1":
+		*b = true
+	case "false", "0", "null":
+		*b = false
+	default:
+		return fmt.Errorf("invalid flag %s", data)
+	}
+	return nil
+}
+
+// Query the PCP port of Pgpool-II and emit metrics. Returns an error if PCP
+// could not be queried.
+func (e *Exporter) scrapePCP(ctx context.Context, ch chan<- prometheus.Metric) error {
+	conn, err := dialPCP(ctx, e.pcp, e.dial)
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	// Backend nodes
+	result, err := conn.command('L')
+	if err != nil {
+		return err
+	}
+	if len(result) == 0 {
+		return errors.New("empty PCP node count")
+	}
+	nodeCount, err := strconv.Atoi(result[0])
+	if err != nil {
+		return errors.New(fmt.Sprintln("Error parsing PCP node count:", err))
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.newDesc("pcp", "node_count", "Number of backend nodes", nil),
+		prometheus.GaugeValue,
+		float64(nodeCount),
+	)
+
+	for id := 0; id < nodeCount; id++ {
+		// The hostname, port and status come first in every Pgpool-II version.
+		result, err := conn.command('I', strconv.Itoa(id))
+		if err != nil {
+			return err
+		}
+		if len(result) < 3 {
+			return fmt.Errorf("invalid PCP node info of node %d", id)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.newDesc("pcp", "node_status", "Backend node status reported by PCP (1 for up or waiting, 0 for down or unused)", []string{"node_id", "hostname", "port"}),
+			prometheus.GaugeValue,
+			e.statusValue(result[2]),
+			strconv.Itoa(id), result[0], result[1],
+		)
+	}
+
+	// Child processes
+	result, err = conn.command('N')
+	if err != nil {
+		return err
+	}
+	if len(result) == 0 {
+		return errors.New("empty PCP process count")
+	}
+	processCount, err := strconv.Atoi(result[0])
+	if err != nil {
+		return errors.New(fmt.Sprintln("Error parsing PCP process count:", err))
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.newDesc("pcp", "process_count", "Number of Pgpool-II child processes", nil),
+		prometheus.GaugeValue,
+		float64(processCount),
+	)
+
+	// Watchdog nodes, only if the watchdog is enabled
+	result, err = conn.command('W', "-1")
+	if err != nil {
+		level.Debug(e.log(ctx)).Log("msg", "No PCP watchdog information", "err", err)
+		return nil
+	}
+	if len(result) == 0 {
+		return errors.New("empty PCP watchdog information")
+	}
+	var watchdog pcpWatchdogInfo
+	if err := json.Unmarshal([]byte(result[0]), &watchdog); err != nil {
+		return errors.New(fmt.Sprintln("Error parsing PCP watchdog information:", err))
+	}
+	e.collectWatchdog(ch, &watchdog)
+
+	for _, node := range watchdog.WatchdogNodes {
+		ch <- prometheus.MustNewConstMetric(
+			e.newDesc("pcp", "watchdog_node_info", "Watchdog node and its state as labels", []string{"node_id", "node_name", "hostname", "state"}),
+			prometheus.GaugeValue,
+			1,
+			strconv.Itoa(node.ID), node.NodeName, node.HostName, node.StateName,
+		)
+	}
+
+	return nil
+}
+
+// Scrape PCP and report whether it succeeded.
+func (e *Exporter) collectPCP(ctx context.Context, ch chan<- prometheus.Metric) {
+	begun := time.Now()
+	err := e.scrapePCP(ctx, ch)
+	if err != nil {
+		level.Error(e.log(ctx)).Log("msg", "Error querying PCP", "err", err)
+	}
+
+	up := 1.0
+	if err != nil {
+		up = 0
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.newDesc("pcp", "up", "Whether the last PCP query succeeded (1 for yes, 0 for no).", nil),
+		prometheus.GaugeValue,
+		up,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.newDesc("pcp", "scrape_duration_seconds", "Duration of the last PCP query.", nil),
+		prometheus.GaugeValue,
+		time.Since(begun).Seconds(),
+	)
+}
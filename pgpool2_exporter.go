@@ -23,6 +23,7 @@ SOFTWARE.
 package pgpool2_exporter
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -30,39 +31,121 @@ import (
 	"net/url"
 	_ "os"
 	"regexp"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/alecthomas/kingpin/v2"
 	"github.com/blang/semver"
+	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
-	_ "github.com/lib/pq"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/promlog"
-	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/exporter-toolkit/web/kingpinflag"
 )
 
 var (
-	ListenAddress = kingpin.Flag("web.listen-address", "Address on which to expose metrics and web interface.").Default(":9719").String()
+	WebFlags      = kingpinflag.AddFlags(kingpin.CommandLine, ":9719")
 	MetricsPath   = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
-	Logger        = promlog.New(&promlog.Config{})
+	QueryPath     = kingpin.Flag("extend.query-path", "Path to a YAML file of custom queries to run.").Default("").String()
+	ScrapeTimeout = kingpin.Flag("scrape.timeout", "Maximum duration of the queries of a single scrape (0 for no timeout).").IsSetByUser(&scrapeTimeoutSet).Default("0s").Duration()
+	DBDriver      = kingpin.Flag("db.driver", "Database driver used to connect to Pgpool-II: one of pgx, postgres (lib/pq).").Default("pgx").Enum("pgx", "postgres")
+	ConfigFile    = kingpin.Flag("config.file", "Path to a YAML configuration file.").Default("").String()
+
+	DataSourceNameFlags   = kingpin.Flag("pgpool.dsn", "DSN of a Pgpool-II instance to scrape. Can be repeated to scrape several instances.").Strings()
+	EnablePprof           = kingpin.Flag("web.enable-pprof", "Serve the Go profiling endpoints under /debug/pprof/ and all Go runtime metrics under /debug/metrics.").Default("false").Bool()
+	ShutdownTimeout       = kingpin.Flag("web.shutdown-timeout", "Time to wait for in-flight scrapes to finish on shutdown.").Default("5s").Duration()
+	StrictMetrics         = kingpin.Flag("metrics.strict", "Fail the scrape (pgpool2_last_scrape_error 1) when a value reported by Pgpool-II cannot be parsed, instead of only logging it.").Default("false").Bool()
+	AccumulateCounters    = kingpin.Flag("metrics.accumulate-counters", "Keep counters monotonic across Pgpool-II restarts by adding the values seen before a reset.").Default("false").Bool()
+	CounterStateFile      = kingpin.Flag("metrics.counter-state-file", "File in which the state of accumulated counters is kept across exporter restarts.").Default("").String()
+	UserFile              = kingpin.Flag("db.user-file", "File to read the Pgpool-II user name from.").Envar("DATA_SOURCE_USER_FILE").Default("").String()
+	PasswordFile          = kingpin.Flag("db.password-file", "File to read the Pgpool-II password from.").Envar("DATA_SOURCE_PASS_FILE").Default("").String()
+	SSLMode               = kingpin.Flag("db.sslmode", "SSL mode of the connection to Pgpool-II: one of disable, allow, prefer, require, verify-ca, verify-full.").Envar("DATA_SOURCE_SSLMODE").Default("").String()
+	SSLCert               = kingpin.Flag("db.sslcert", "Client certificate file for the connection to Pgpool-II.").Envar("DATA_SOURCE_SSLCERT").Default("").String()
+	SSLKey                = kingpin.Flag("db.sslkey", "Client private key file for the connection to Pgpool-II.").Envar("DATA_SOURCE_SSLKEY").Default("").String()
+	SSLRootCert           = kingpin.Flag("db.sslrootcert", "Root certificate file to verify the Pgpool-II server certificate.").Envar("DATA_SOURCE_SSLROOTCERT").Default("").String()
+	CollectInterval       = kingpin.Flag("collect.interval", "Interval at which Pgpool-II is scraped in the background, serving the latest metrics on every request (0 to scrape on every request).").IsSetByUser(&collectIntervalSet).Default("0s").Duration()
+	CacheTTL              = kingpin.Flag("metrics.cache-ttl", "Time during which the metrics of a scrape are served again instead of querying Pgpool-II (0 to disable).").Default("0s").Duration()
+	ServeStaleFor         = kingpin.Flag("metrics.serve-stale-for", "Time during which the metrics of the last successful scrape are served again, marked with pgpool2_stale_data, while Pgpool-II is unreachable (0 to disable).").Default("0s").Duration()
+	PCPHost               = kingpin.Flag("pcp.host", "Host or unix socket directory of the Pgpool-II PCP port, enabling the PCP collector (node, process and watchdog information).").Default("").String()
+	PCPPort               = kingpin.Flag("pcp.port", "Port of the Pgpool-II PCP port.").Default("9898").Int()
+	PCPUser               = kingpin.Flag("pcp.user", "User name to authenticate to PCP with.").Default("postgres").String()
+	PCPPasswordFile       = kingpin.Flag("pcp.password-file", "File to read the PCP password from.").Envar("PCP_PASS_FILE").Default("").String()
+	LegacyNames           = kingpin.Flag("metrics.legacy-names", "Export counters under their legacy names, e.g. pgpool2_pool_nodes_select_cnt instead of pgpool2_pool_nodes_select_total.").Default("false").Bool()
+	ListRenames           = kingpin.Flag("metrics.list-renames", "Print the legacy names of the renamed metrics with their current names, then exit.").Default("false").Bool()
+	ConstantLabelsFlag    = kingpin.Flag("metrics.constant-labels", "Labels added to every metric, as a comma-separated list of name=value pairs (e.g. cluster=prod,dc=eu1).").Default("").String()
+	ReplDelayHistogram    = kingpin.Flag("metrics.replication-delay-histogram", "Export a histogram of the replication delay observed on every scrape.").Default("false").Bool()
+	ReplDelayBuckets      = kingpin.Flag("metrics.replication-delay-buckets", "Comma-separated upper bounds in seconds of the buckets of the replication delay histogram.").Default("0.001,0.01,0.1,0.5,1,5,10,30,60,300").String()
+	ReconnectBackoffBase  = kingpin.Flag("reconnect.backoff-base", "Delay before the second attempt to connect to Pgpool-II, doubled after each failed attempt.").Default("1s").Duration()
+	ReconnectBackoffMax   = kingpin.Flag("reconnect.backoff-max", "Maximum delay between attempts to connect to Pgpool-II.").Default("1m").Duration()
+	StartupConnectRetries = kingpin.Flag("startup.connect-retries", "Number of attempts to connect to Pgpool-II before serving metrics (0 to connect on the first scrape, -1 to wait until Pgpool-II is up).").Default("0").Int()
+	CollectProcess        = kingpin.Flag("collector.process", "Export the memory, CPU and file descriptor usage of the Pgpool-II processes, read from /proc. Requires the exporter to run on the Pgpool-II host.").Default("false").Bool()
+	ProcfsPath            = kingpin.Flag("collector.process.procfs", "Mount point of the proc filesystem of the Pgpool-II host.").Default("/proc").String()
+	FrontendClientHosts   = kingpin.Flag("collector.pool_processes.client-host", "Export the number of frontend connections from each client host, if reported by SHOW pool_processes.").Default("false").Bool()
+	AggregatePools        = kingpin.Flag("metrics.aggregate-pools", "Export the backend connection slots in use by backend, user and database instead of by Pgpool-II child process.").Default("false").Bool()
+	SSHHost               = kingpin.Flag("ssh.host", "SSH server (host[:port]) through which to connect to Pgpool-II, for Pgpool-II instances in networks not reachable from the exporter.").Default("").String()
+	SSHUser               = kingpin.Flag("ssh.user", "User name to authenticate to the SSH server with.").Default("").String()
+	SSHKeyFile            = kingpin.Flag("ssh.key-file", "Private key file to authenticate to the SSH server with.").Default("").String()
+	SSHKnownHostsFile     = kingpin.Flag("ssh.known-hosts-file", "File of the known host keys, to check the SSH server with (default: ~/.ssh/known_hosts).").Default("").String()
+	ConnMaxLifetime       = kingpin.Flag("db.conn-max-lifetime", "Time after which the connection to Pgpool-II is re-established, resolving the host name again (0 to keep it until it fails).").Default("0s").Duration()
+	MaxOpenConns          = kingpin.Flag("db.max-open-conns", "Maximum number of connections to Pgpool-II (0 for the value of --scrape.concurrency).").Default("0").Int()
+	MaxIdleConns          = kingpin.Flag("db.max-idle-conns", "Maximum number of idle connections to Pgpool-II kept between scrapes (0 for the value of --db.max-open-conns, -1 for none).").Default("0").Int()
+	ExporterMetricsPath   = kingpin.Flag("web.exporter-metrics-path", "Path under which to expose the metrics of the exporter itself (Go runtime, process and scrape metrics) apart from the Pgpool-II metrics (default: with the Pgpool-II metrics).").Default("").String()
+	NoExporterMetrics     = kingpin.Flag("web.disable-exporter-metrics", "Do not expose the metrics of the exporter itself (Go runtime, process and scrape metrics) with the Pgpool-II metrics.").Default("false").Bool()
+	PgpoolConfFile        = kingpin.Flag("pgpool.conf", "Path to the pgpool.conf of a Pgpool-II running on the same host, to connect through its Unix domain socket and configure the collectors from its settings.").Default("").String()
+	BackendCrosscheck     = kingpin.Flag("collector.backend-crosscheck", "Connect directly to every backend up, with the credentials of the DSN, to export the role, WAL position and connections reported by PostgreSQL. Adds load on the backends.").Default("false").Bool()
+	SlowQueryThreshold    = kingpin.Flag("log.slow-query-threshold", "Log the queries of namespaces which take longer than this (0 to disable).").Default("2s").Duration()
+	ScrapeConcurrency     = kingpin.Flag("scrape.concurrency", "Number of namespaces queried concurrently, each on its own connection to Pgpool-II.").Default("1").Int()
+	PushURL               = kingpin.Flag("push.url", "URL of a Pushgateway or remote_write endpoint to push the metrics to, e.g. when Prometheus cannot reach the exporter.").Default("").String()
+	PushProtocol          = kingpin.Flag("push.protocol", "Protocol of --push.url: one of pushgateway, remote-write.").Default("pushgateway").Enum("pushgateway", "remote-write")
+	PushInterval          = kingpin.Flag("push.interval", "Interval at which the metrics are pushed to --push.url, --otlp.endpoint and --statsd.address.").Default("1m").Duration()
+	PushJob               = kingpin.Flag("push.job", "Job name under which the metrics are pushed to a Pushgateway.").Default("pgpool2_exporter").String()
+	OTLPEndpoint          = kingpin.Flag("otlp.endpoint", "OTLP/HTTP endpoint to push the metrics to as OpenTelemetry metrics, e.g. http://collector:4318 (/v1/metrics is appended if no path is given).").Default("").String()
+	StatsdAddress         = kingpin.Flag("statsd.address", "Address (host:port) of a statsd server to send the metrics to over UDP.").Default("").String()
+	StatsdTagFormat       = kingpin.Flag("statsd.tag-format", "Format of the labels sent to --statsd.address as tags: one of dogstatsd, influxdb.").Default("dogstatsd").Enum("dogstatsd", "influxdb")
+	NodeIDLabel           = kingpin.Flag("metrics.node-id-label", "Add the node_id label to the pool_nodes and pool_backend_stats metrics, to identify backends which move between hosts.").Default("false").Bool()
+	RedactLabels          = kingpin.Flag("metrics.redact-labels", "Comma-separated list of labels whose values are replaced by a hash in all metrics, e.g. username,database.").Default("").String()
+	HashKey               = kingpin.Flag("metrics.hash-key", "Secret key of the HMAC replacing the values of --metrics.redact-labels and of the hash action of metric_relabel. Prefer the environment variable to keep it out of the process list.").Default("").String()
+	HALock                = kingpin.Flag("ha.lock", "Lock shared by the exporters of an HA pair scraping the same Pgpool-II: file:///path, consul://host:port/key or kubernetes://namespace/name (a Lease). Only the holder runs --ha.leader-collectors.").Default("").String()
+	HALeaderCollectors    = kingpin.Flag("ha.leader-collectors", "Comma-separated list of the collectors run only by the exporter holding --ha.lock.").Default("pool_pools").String()
+	HALeaseDuration       = kingpin.Flag("ha.lease-duration", "Time after which the lock is taken over by the other exporter if it is not renewed.").Default("15s").Duration()
+	HAIdentity            = kingpin.Flag("ha.identity", "Name of the exporter in the lock (default: the host name).").Default("").String()
+	K8sSelector           = kingpin.Flag("discovery.kubernetes.selector", "Label selector of the Kubernetes services of Pgpool-II, whose pods are served as /probe targets under /discovery/targets for Prometheus HTTP service discovery.").Default("").String()
+	K8sNamespace          = kingpin.Flag("discovery.kubernetes.namespace", "Namespace of the Kubernetes services of Pgpool-II (default: the namespace of the exporter).").Default("").String()
+	K8sPort               = kingpin.Flag("discovery.kubernetes.port", "Name or number of the Pgpool-II port of the Kubernetes services (default: their only port).").Default("").String()
+	K8sRefreshInterval    = kingpin.Flag("discovery.kubernetes.refresh-interval", "Interval at which the Kubernetes endpoints are listed.").Default("30s").Duration()
+	TargetsFile           = kingpin.Flag("targets.file", "YAML file listing Pgpool-II instances to scrape in addition to the data sources, reloaded when it changes.").Default("").String()
+	TargetsRefresh        = kingpin.Flag("targets.refresh-interval", "Interval at which --targets.file is also read in case its changes are not notified, e.g. on a network file system, or 0 to rely on the notifications.").Default("10s").Duration()
+	FleetClusterLabel     = kingpin.Flag("metrics.fleet-cluster-label", "Label telling the clusters of the Pgpool-II instances apart, e.g. pgpool_host or a label of --targets.file, to export pgpool2_fleet_* aggregates across all instances (default: no aggregates).").Default("").String()
+	ScrapeIDHeader        = kingpin.Flag("web.scrape-id-header", "HTTP header in which /probe returns the ID of its scrape, logged as scrape_id, e.g. X-Scrape-Id. The ID of a request header of the same name is used if set (default: not returned).").Default("").String()
+	LogFile               = kingpin.Flag("collector.logfile", "Path to the log file of a Pgpool-II running on the same host, to export the number of failovers, child process crashes, authentication failures and other events it logs (default: not read).").Default("").String()
+	ProbeAllowedTargets   = kingpin.Flag("probe.allowed-targets", "Comma-separated list of the addresses (host:port, with * and ? as wildcards) of the /probe targets scraped with the credentials of the data source, besides the data sources themselves, e.g. pgpool-*.example.com:9999.").Default("").String()
+	MaxRequestsInFlight   = kingpin.Flag("web.max-requests-in-flight", "Maximum number of scrape requests served at the same time, answering 503 to the others (0 for no limit).").Default("0").Int()
+	ClientRateLimit       = kingpin.Flag("web.client-rate-limit", "Maximum number of scrape requests per second served to each client IP address, answering 503 to the others (0 for no limit).").Default("0").Float64()
+	ClientRateBurst       = kingpin.Flag("web.client-rate-burst", "Number of scrape requests a client can make at once above --web.client-rate-limit.").Default("1").Int()
+
+	// Whether a flag which can also be set in the config file was given on
+	// the command line
+	scrapeTimeoutSet   bool
+	collectIntervalSet bool
 )
 
+func init() {
+	// Let container users enable TLS and basic authentication without
+	// passing flags.
+	kingpin.CommandLine.GetFlag("web.config.file").Envar("WEB_CONFIG_FILE")
+}
+
 const (
-	Namespace   = "pgpool2"
-	exporter    = "exporter"
-	LandingPage = `
-	<html>
-		<head>
-			<title>Pgpool-II Exporter</title>
-		</head>
-		<body>
-			<h1>Pgpool-II Exporter</h1>
-			<p>
-			<a href='%s'>Metrics</a>
-			</p>
-		</body>
-	</html>`
+	Namespace = "pgpool2"
+	exporter  = "exporter"
 )
 
 // columnUsage should be one of several enum values which describe how a
@@ -90,6 +173,9 @@ func stringTocolumnUsage(s string) (u columnUsage, err error) {
 	case "DURATION":
 		u = DURATION
 
+	case "TIMESTAMP":
+		u = TIMESTAMP
+
 	default:
 		err = fmt.Errorf("wrong columnUsage given : %s", s)
 	}
@@ -104,7 +190,8 @@ const (
 	COUNTER      columnUsage = iota // Use this column as a counter
 	GAUGE        columnUsage = iota // Use this column as a gauge
 	MAPPEDMETRIC columnUsage = iota // Use this column with the supplied mapping of text values
-	DURATION     columnUsage = iota // This column should be interpreted as a text duration (and converted to milliseconds)
+	DURATION     columnUsage = iota // This column should be interpreted as a text duration (and converted to seconds)
+	TIMESTAMP    columnUsage = iota // This column should be interpreted as a text timestamp (and converted to a Unix timestamp)
 )
 
 // Implement the yaml.Unmarshaller interface
@@ -133,6 +220,7 @@ type MetricMapNamespace struct {
 // to by the collector
 type MetricMap struct {
 	discard    bool                 // Should metric be discarded during mapping?
+	mapped     bool                 // Are text values converted with a mapping?
 	vtype      prometheus.ValueType // Prometheus valuetype
 	namespace  string
 	desc       *prometheus.Desc                  // Prometheus descriptor
@@ -148,26 +236,109 @@ type ColumnMapping struct {
 // Exporter collects Pgpool-II stats from the given server and exports
 // them using the prometheus metrics package.
 type Exporter struct {
-	dsn          string
-	namespace    string
-	mutex        sync.RWMutex
-	duration     prometheus.Gauge
-	up           prometheus.Gauge
-	error        prometheus.Gauge
-	totalScrapes prometheus.Counter
-	metricMap    map[string]MetricMapNamespace
-	DB           *sql.DB
+	dsn            string
+	namespace      string
+	mutex          sync.RWMutex // Guards DB and dsn, replaced by the scrape
+	duration       prometheus.Gauge
+	up             prometheus.Gauge
+	error          prometheus.Gauge
+	totalScrapes   prometheus.Counter
+	logger         log.Logger
+	constLabels    prometheus.Labels
+	collectors     map[string]bool
+	leaderOnly     map[string]bool
+	isLeader       func() bool
+	pcp            *pcpConfig
+	version        semver.Version
+	lastVersion    semver.Version
+	capsMutex      sync.Mutex
+	capabilities   map[string]Capability
+	capsVersion    semver.Version
+	capsTime       time.Time
+	queryTimeouts  *prometheus.CounterVec
+	queryRetries   *prometheus.CounterVec
+	parseErrors    *prometheus.CounterVec
+	slowQueries    *prometheus.CounterVec
+	nsDuration     *prometheus.GaugeVec
+	nsErrors       *prometheus.CounterVec
+	statusChanges  *prometheus.CounterVec
+	unknownStatus  *prometheus.CounterVec
+	reconnects     prometheus.Counter
+	dbStats        *dbStats
+	scrapeErrors   *prometheus.CounterVec
+	backoff        *backoff
+	delayHistogram *prometheus.HistogramVec
+	nodeStatus     map[string]string
+	nodeMutex      sync.Mutex
+	metricMap      map[string]MetricMapNamespace
+	queryOverrides map[string]string
+	connected      atomic.Bool
+	dsnSource      func() (string, error)
+	cacheMutex     sync.Mutex
+	cache          []prometheus.Metric
+	cacheTime      time.Time
+	flightMutex    sync.Mutex
+	flight         *flight
+	coalesced      prometheus.Counter
+	staleMutex     sync.Mutex
+	lastGood       []prometheus.Metric
+	lastGoodTime   time.Time
+	background     bool
+	noSelfMetrics  bool
+	ctx            context.Context
+	cancel         context.CancelFunc
+	dial           DialFunc
+	authModule     *AuthModule
+	DB             Querier
+
+	// Set by the options
+	scrapeTimeout       time.Duration
+	scrapeConcurrency   int
+	collectInterval     time.Duration
+	cacheTTL            time.Duration
+	serveStaleFor       time.Duration
+	strictMetrics       bool
+	accumulator         *counterAccumulator
+	statusValues        map[string]float64
+	columnFilters       map[string]ColumnFilter
+	aggregatePools      bool
+	frontendClientHosts bool
+	legacyNames         bool
+	nodeIDLabel         bool
+	delayBuckets        []float64
+	queryPath           string
+	driver              string
+	maxOpenConns        int
+	maxIdleConns        int
+	connMaxLifetime     time.Duration
+	backoffBase         time.Duration
+	backoffMax          time.Duration
+	startupRetries      int
+	slowQueryThreshold  time.Duration
+	procfs              string
+	backendCrosscheck   bool
+	userFile            string
+	passwordFile        string
+	redactedLabels      map[string]bool
+	hashKey             []byte
 }
 
 var (
 	metricMaps = map[string]map[string]ColumnMapping{
 		"pool_nodes": {
-			"hostname":          {LABEL, "Backend hostname"},
-			"port":              {LABEL, "Backend port"},
-			"role":              {LABEL, "Role (primary or standby)"},
-			"status":            {GAUGE, "Backend node Status (1 for up or waiting, 0 for down or unused)"},
-			"select_cnt":        {COUNTER, "SELECT statement counts issued to each backend"},
-			"replication_delay": {GAUGE, "Replication delay"},
+			"hostname":               {LABEL, "Backend hostname"},
+			"port":                   {LABEL, "Backend port"},
+			"role":                   {LABEL, "Role (primary or standby)"},
+			"status":                 {GAUGE, "Backend node Status (1 for up or waiting, 0 for down or unused)"},
+			"select_cnt":             {COUNTER, "SELECT statement counts issued to each backend"},
+			"pg_status":              {GAUGE, "Backend node status reported by PostgreSQL (1 for up, 0 for down)"},
+			"lb_weight":              {GAUGE, "Load balance weight of the backend (0.0 to 1.0)"},
+			"load_balance_node":      {GAUGE, "Whether the backend is the load balance node of the exporter session (1 for yes, 0 for no)"},
+			"pg_role":                {DISCARD, "Role reported by PostgreSQL (primary or standby)"},
+			"replication_state":      {MAPPEDMETRIC, "Replication state of the backend (0 for none, 1 for startup, 2 for catchup, 3 for streaming, 4 for backup, 5 for stopping)"},
+			"replication_sync_state": {MAPPEDMETRIC, "Replication synchronization state of the backend (0 for none, 1 for async, 2 for potential, 3 for sync, 4 for quorum)"},
+			"replication_delay":      {DURATION, "Replication delay in seconds, when Pgpool-II reports it as a time (see pgpool2_pool_nodes_replication_delay_bytes otherwise)"},
+			"last_status_change":     {TIMESTAMP, "Time of the last backend status change in seconds since the Unix epoch"},
 		},
 		"pool_backend_stats": {
 			"hostname":   {LABEL, "Backend hostname"},
@@ -196,9 +367,14 @@ var (
 			"retry_count":         {GAUGE, "Number of retried health check count in total"},
 			"average_retry_count": {GAUGE, "Number of average retried health check count in a health check session"},
 			"max_retry_count":     {GAUGE, "Number of maximum retried health check count in a health check session"},
-			"max_duration":        {GAUGE, "Maximum health check duration in Millie seconds"},
-			"min_duration":        {GAUGE, "Minimum health check duration in Millie seconds"},
-			"average_duration":    {GAUGE, "Average health check duration in Millie seconds"},
+			"max_duration":        {DURATION, "Maximum health check duration in seconds (in milliseconds with --metrics.legacy-names)"},
+			"min_duration":        {DURATION, "Minimum health check duration in seconds (in milliseconds with --metrics.legacy-names)"},
+			"average_duration":    {DURATION, "Average health check duration in seconds (in milliseconds with --metrics.legacy-names)"},
+			"last_status_change":  {TIMESTAMP, "Time of the last backend status change in seconds since the Unix epoch"},
+
+			"last_successful_health_check": {TIMESTAMP, "Time of the last successful health check in seconds since the Unix epoch (0 if none)"},
+			"last_failed_health_check":     {TIMESTAMP, "Time of the last failed health check in seconds since the Unix epoch (0 if none)"},
+			"last_skip_health_check":       {TIMESTAMP, "Time of the last skipped health check in seconds since the Unix epoch (0 if none)"},
 		},
 		"pool_processes": {
 			"pool_pid": {DISCARD, "PID of Pgpool-II child processes"},
@@ -207,6 +383,11 @@ var (
 		"pool_pools": {
 			"pool_pid": {DISCARD, "PID of Pgpool-II child processes"},
 		},
+		"pool_status": {
+			"item":        {DISCARD, "Configuration parameter name"},
+			"value":       {DISCARD, "Configuration parameter value"},
+			"description": {DISCARD, "Configuration parameter description"},
+		},
 		"pool_cache": {
 			"num_cache_hits":              {GAUGE, "The number of hits against the query cache"},
 			"num_selects":                 {GAUGE, "The number of SELECT that did not hit against the query cache"},
@@ -221,64 +402,385 @@ var (
 	}
 )
 
+var (
+	// Numeric configuration parameters of "SHOW pool_status" exported as gauges
+	poolStatusGauges = map[string]string{
+		"num_init_children":         "Number of preforked Pgpool-II child processes",
+		"max_pool":                  "Maximum number of cached connections in each child process",
+		"reserved_connections":      "Number of connection slots reserved for rejecting connections with an error",
+		"listen_backlog_multiplier": "Multiplier of num_init_children for the connection queue length",
+		"child_life_time":           "Time in seconds to terminate an idle child process",
+		"child_max_connections":     "Number of client connections after which a child process is terminated",
+		"connection_life_time":      "Time in seconds to terminate a cached connection",
+		"client_idle_limit":         "Time in seconds to disconnect an idle client",
+		"health_check_period":       "Interval in seconds between health checks",
+		"health_check_timeout":      "Timeout in seconds of a health check",
+		"health_check_max_retries":  "Maximum number of retries after a failed health check",
+		"health_check_retry_delay":  "Delay in seconds between health check retries",
+		"memqcache_max_num_cache":   "Maximum number of query cache entries",
+		"memqcache_expire":          "Life time in seconds of a query cache entry",
+	}
+
+	// String configuration parameters of "SHOW pool_status" exported as labels
+	// of an info metric
+	poolStatusInfo = map[string]bool{
+		"backend_clustering_mode":   true,
+		"replication_mode":          true,
+		"master_slave_mode":         true,
+		"native_replication_mode":   true,
+		"load_balance_mode":         true,
+		"connection_cache":          true,
+		"memory_cache_enabled":      true,
+		"failover_on_backend_error": true,
+		"use_watchdog":              true,
+		"ssl":                       true,
+	}
+)
+
+// Buckets of the child process and backend connection age histograms, in
+// seconds, to help tune child_life_time and connection_life_time
+var ageBuckets = []float64{60, 300, 900, 1800, 3600, 7200, 14400, 28800, 86400}
+
+// Buckets of the backend connection reuse histogram
+var reuseBuckets = []float64{1, 5, 10, 50, 100, 500, 1000, 5000}
+
+// ReplicationDelayBuckets returns the buckets given with
+// --metrics.replication-delay-buckets, sorted.
+func ReplicationDelayBuckets() ([]float64, error) {
+	var buckets []float64
+	for _, field := range strings.Split(*ReplDelayBuckets, ",") {
+		bucket, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replication delay bucket: %q", field)
+		}
+		buckets = append(buckets, bucket)
+	}
+	sort.Float64s(buckets)
+	return buckets, nil
+}
+
+// Collectors enabled or disabled with --[no-]collector.<namespace>
+var (
+	collectorState     = make(map[string]*bool)
+	collectorSetByUser = make(map[string]*bool)
+)
+
+func init() {
+	namespaces := make([]string, 0, len(metricMaps))
+	for namespace := range metricMaps {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	for _, namespace := range namespaces {
+		collectorSetByUser[namespace] = new(bool)
+		collectorState[namespace] = kingpin.Flag(
+			"collector."+namespace,
+			fmt.Sprintf("Enable the %s collector (default: enabled).", namespace),
+		).IsSetByUser(collectorSetByUser[namespace]).Default("true").Bool()
+		// Also enabled when the flags are not parsed, e.g. in other programs
+		// embedding the exporter.
+		*collectorState[namespace] = true
+	}
+}
+
+// Backend states reported in the status column of "SHOW pool_nodes"
+var nodeStates = []string{"up", "down", "waiting", "unused", "quarantine"}
+
+// Backend connection slot in use, from a row of "SHOW pool_pools"
+type poolSlot struct {
+	pid, poolId, backendId, username, database string
+}
+
+// Backend connection slots in use aggregated over the child processes
+type userSlot struct {
+	backendId, username, database string
+}
+
 // Pgpool-II version
 var pgpoolVersionRegex = regexp.MustCompile(`^((\d+)(\.\d+)(\.\d+)?)`)
-var version42 = semver.MustParse("4.2.0")
-var PgpoolSemver semver.Version
 
-func NewExporter(dsn string, namespace string) *Exporter {
+// NewExporter returns an Exporter for the Pgpool-II instance at dsn,
+// configured with opts. Unless a connection is given with WithDB, it makes
+// up to --startup.connect-retries connection attempts; if Pgpool-II is still
+// unreachable, the connection is established on a later scrape.
+func NewExporter(dsn string, opts ...Option) *Exporter {
+	e := newExporter(dsn, opts...)
+
+	// If pgpool is down on exporter startup, wait for pgpool to be up
+	for attempt := 0; e.DB == nil && (e.startupRetries < 0 || attempt < e.startupRetries); attempt++ {
+		if attempt > 0 {
+			_, next := e.backoff.due()
+			level.Info(e.logger).Log("msg", "Waiting before trying to connect again", "delay", time.Until(next).Round(time.Millisecond))
+			time.Sleep(time.Until(next))
+		}
+
+		e.reconnects.Inc()
+		db, err := e.connect(context.Background())
+		if err != nil {
+			level.Error(e.logger).Log("err", err)
+			e.backoff.failed()
+			continue
+		}
+		e.backoff.succeeded()
+		e.setDB(db)
+		e.connected.Store(true)
+	}
 
-	db, err := getDBConn(dsn)
+	if e.collectInterval > 0 {
+		e.background = true
+		go e.collectLoop(e.collectInterval)
+	}
 
-	// If pgpool is down on exporter startup, keep waiting for pgpool to be up
-	for err != nil {
-		level.Error(Logger).Log("err", err)
-		level.Info(Logger).Log("info", "Sleeping for 5 seconds before trying to connect again")
-		time.Sleep(5 * time.Second)
+	return e
+}
 
-		db, err = getDBConn(dsn)
+// newExporter builds an Exporter without connecting to Pgpool-II. Unless a
+// connection is given with WithDB, the connection is established on the
+// first scrape.
+func newExporter(dsn string, opts ...Option) *Exporter {
+	e := &Exporter{
+		dsn:                dsn,
+		namespace:          Namespace,
+		logger:             log.NewNopLogger(),
+		scrapeConcurrency:  1,
+		driver:             "pgx",
+		backoffBase:        time.Second,
+		backoffMax:         time.Minute,
+		slowQueryThreshold: 2 * time.Second,
+		statusValues:       make(map[string]float64, len(defaultStatusValues)),
+	}
+	for value, number := range defaultStatusValues {
+		e.statusValues[value] = number
+	}
+	for _, opt := range opts {
+		opt(e)
 	}
 
-	return &Exporter{
-		dsn:       dsn,
-		namespace: namespace,
-		up: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "up",
-			Help:      "Whether the Pgpool-II server is up (1 for yes, 0 for no).",
-		}),
+	maps := metricMaps
+	valueMappings := columnValueMappings
+	e.queryOverrides = map[string]string{}
 
-		duration: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "last_scrape_duration_seconds",
-			Help:      "Duration of the last scrape of metrics from Pgpool-II.",
-		}),
+	if e.queryPath != "" {
+		userMaps, userValueMappings, userQueryOverrides, err := addQueries(e.queryPath, metricMaps, columnValueMappings)
+		if err != nil {
+			level.Error(e.logger).Log("msg", "Failed to load custom queries", "path", e.queryPath, "err", err)
+		} else {
+			maps = userMaps
+			valueMappings = userValueMappings
+			e.queryOverrides = userQueryOverrides
+		}
+	}
 
-		totalScrapes: prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: namespace,
-			Name:      "scrapes_total",
-			Help:      "Total number of times Pgpool-II has been scraped for metrics.",
-		}),
+	if e.nodeIDLabel {
+		maps = withNodeIDLabel(maps)
+	}
+	maps = withColumnFilters(maps, e.columnFilters)
 
-		error: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "last_scrape_error",
-			Help:      "Whether the last scrape of metrics from Pgpool-II resulted in an error (1 for error, 0 for success).",
-		}),
-		metricMap: makeDescMap(metricMaps, namespace),
-		DB:        db,
+	enabledMaps := make(map[string]map[string]ColumnMapping, len(maps))
+	for namespace, mappings := range maps {
+		if !e.collectorEnabled(namespace) {
+			level.Debug(e.logger).Log("msg", "Collector disabled", "collector", namespace)
+			continue
+		}
+		enabledMaps[namespace] = mappings
+	}
+	e.metricMap = makeDescMap(enabledMaps, valueMappings, e.namespace, e.constLabels, e.legacyNames)
+
+	e.up = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   e.namespace,
+		Name:        "up",
+		Help:        "Whether the Pgpool-II server is up (1 for yes, 0 for no).",
+		ConstLabels: e.constLabels,
+	})
+
+	e.duration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   e.namespace,
+		Name:        "last_scrape_duration_seconds",
+		Help:        "Duration of the last scrape of metrics from Pgpool-II.",
+		ConstLabels: e.constLabels,
+	})
+
+	e.totalScrapes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   e.namespace,
+		Name:        "scrapes_total",
+		Help:        "Total number of times Pgpool-II has been scraped for metrics.",
+		ConstLabels: e.constLabels,
+	})
+
+	e.error = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   e.namespace,
+		Name:        "last_scrape_error",
+		Help:        "Whether the last scrape of metrics from Pgpool-II resulted in an error (1 for error, 0 for success).",
+		ConstLabels: e.constLabels,
+	})
+
+	e.queryTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   e.namespace,
+		Subsystem:   exporter,
+		Name:        "query_timeouts_total",
+		Help:        "Total number of queries cancelled because the scrape timeout was reached.",
+		ConstLabels: e.constLabels,
+	}, []string{"namespace"})
+
+	e.parseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   e.namespace,
+		Subsystem:   exporter,
+		Name:        "parse_errors_total",
+		Help:        "Total number of values reported by Pgpool-II which could not be parsed, by namespace and column.",
+		ConstLabels: e.constLabels,
+	}, []string{"namespace", "column"})
+
+	e.queryRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   e.namespace,
+		Subsystem:   exporter,
+		Name:        "query_retries_total",
+		Help:        "Total number of queries run again after a transient error, e.g. a connection reset.",
+		ConstLabels: e.constLabels,
+	}, []string{"namespace"})
+
+	e.slowQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   e.namespace,
+		Subsystem:   exporter,
+		Name:        "slow_queries_total",
+		Help:        "Total number of queries which took longer than --log.slow-query-threshold.",
+		ConstLabels: e.constLabels,
+	}, []string{"namespace"})
+
+	e.nsDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   e.namespace,
+		Subsystem:   exporter,
+		Name:        "namespace_scrape_duration_seconds",
+		Help:        "Duration of the last query of a namespace.",
+		ConstLabels: e.constLabels,
+	}, []string{"namespace"})
+
+	e.nsErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   e.namespace,
+		Subsystem:   exporter,
+		Name:        "namespace_scrape_errors_total",
+		Help:        "Total number of failed queries of a namespace.",
+		ConstLabels: e.constLabels,
+	}, []string{"namespace"})
+
+	e.statusChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   e.namespace,
+		Subsystem:   "pool_nodes",
+		Name:        "status_changes_total",
+		Help:        "Total number of backend status changes observed between scrapes, e.g. failovers and failbacks.",
+		ConstLabels: e.constLabels,
+	}, []string{"hostname", "port", "from", "to"})
+	e.nodeStatus = make(map[string]string)
+
+	e.unknownStatus = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   e.namespace,
+		Name:        "unknown_status_values_total",
+		Help:        "Total number of status values reported by Pgpool-II which are not known to the exporter, converted to 0.",
+		ConstLabels: e.constLabels,
+	}, []string{"value"})
+
+	e.reconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   e.namespace,
+		Subsystem:   exporter,
+		Name:        "reconnects_total",
+		Help:        "Total number of attempts to connect to Pgpool-II.",
+		ConstLabels: e.constLabels,
+	})
+	e.backoff = newBackoff(e.backoffBase, e.backoffMax)
+	e.dbStats = newDBStats(e.namespace, e.constLabels)
+
+	e.coalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   e.namespace,
+		Subsystem:   exporter,
+		Name:        "coalesced_scrapes_total",
+		Help:        "Total number of scrapes served with the metrics of a concurrent scrape instead of querying Pgpool-II.",
+		ConstLabels: e.constLabels,
+	})
+
+	e.scrapeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   e.namespace,
+		Subsystem:   exporter,
+		Name:        "scrape_errors_total",
+		Help:        "Total number of scrape errors by type.",
+		ConstLabels: e.constLabels,
+	}, []string{"type"})
+	for _, errType := range errorTypes {
+		e.scrapeErrors.WithLabelValues(errType)
 	}
+
+	if len(e.delayBuckets) > 0 {
+		e.delayHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   e.namespace,
+			Name:        "replication_delay_seconds",
+			Help:        "Replication delay of the backends observed on every scrape.",
+			Buckets:     e.delayBuckets,
+			ConstLabels: e.constLabels,
+		}, []string{"hostname", "port"})
+	}
+
+	e.connected.Store(e.DB != nil)
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+
+	return e
+}
+
+// Query run for namespace: "SHOW <namespace>;" unless a custom query
+// replaces it.
+func (e *Exporter) namespaceQuery(namespace string) string {
+	if query, ok := e.queryOverrides[namespace]; ok {
+		return query
+	}
+	return fmt.Sprintf("SHOW %s;", namespace)
 }
 
 // Query within a namespace mapping and emit metrics. Returns fatal errors if
 // the scrape fails, and a slice of errors if they were non-fatal.
-func queryNamespaceMapping(ch chan<- prometheus.Metric, db *sql.DB, namespace string, mapping MetricMapNamespace) ([]error, error) {
-	query := fmt.Sprintf("SHOW %s;", namespace)
+func (e *Exporter) queryNamespaceMapping(ctx context.Context, ch chan<- prometheus.Metric, namespace string, mapping MetricMapNamespace) ([]error, error) {
+	query := e.namespaceQuery(namespace)
+
+	nonfatalErrors := []error{}
+
+	// Hostnames of the backends, to break down the connection slots by
+	// backend, and the configured number of child processes and connection
+	// slots, to report the saturation. Read first, as the connection
+	// serves one query at a time; they are queried once per scrape with
+	// the pool_nodes and pool_status namespaces.
+	var backendHostnames map[string]string
+	var limits map[string]float64
+	if namespace == "pool_pools" {
+		var err error
+		backendHostnames, err = e.backendHostnames(ctx)
+		if err != nil {
+			nonfatalErrors = append(nonfatalErrors, err)
+		}
+	}
+	if namespace == "pool_pools" || namespace == "pool_processes" {
+		var err error
+		limits, err = e.poolStatusValues(ctx)
+		if err != nil {
+			nonfatalErrors = append(nonfatalErrors, err)
+		}
+	}
 
 	// Don't fail on a bad scrape of one metric
-	rows, err := db.Query(query)
+	rows, err := e.query(ctx, namespace, query)
+	if namespace == "pool_cache" && (err == nil || isQueryCacheDisabled(err)) {
+		enabled := 1.0
+		if err != nil {
+			enabled = 0
+		}
+		ch <- prometheus.MustNewConstMetric(
+			e.newDesc("", "query_cache_enabled", "Whether the query cache is enabled (1 for yes, 0 for no)", nil),
+			prometheus.GaugeValue,
+			enabled,
+		)
+		// Not an error: the query cache is turned off with memory_cache_enabled.
+		if err != nil {
+			return nonfatalErrors, nil
+		}
+	}
 	if err != nil {
-		return []error{}, errors.New(fmt.Sprintln("Error running query on database: ", namespace, err))
+		return []error{}, fmt.Errorf("Error running query on database: %s %w", namespace, err)
 	}
 
 	defer rows.Close()
@@ -301,19 +803,32 @@ func queryNamespaceMapping(ch chan<- prometheus.Metric, db *sql.DB, namespace st
 		scanArgs[i] = &columnData[i]
 	}
 
-	nonfatalErrors := []error{}
-
 	// Read from the result of "SHOW pool_pools"
 	if namespace == "pool_pools" {
 
 		totalBackends := float64(0)
 		totalBackendsInUse := float64(0)
 
-		// pool_pid -> pool_id -> backend_id ->username -> database -> count
-		backendsInUse := make(map[string]map[string]map[string]map[string]map[string]float64)
+		// Rows are aggregated with flat keys, so that a large num_init_children
+		// does not allocate a nested map for each child process.
+		backendsInUse := make(map[poolSlot]float64)
+		// pool_pid -> number of distinct slots in use
+		usedBackendsByProcess := make(map[string]float64)
+		// With --metrics.aggregate-pools
+		backendsInUseByUser := make(map[userSlot]float64)
+		// database -> count
+		backendsInUseByDatabase := make(map[string]float64)
 
 		totalBackendsByProcess := make(map[string]float64)
 
+		// backend_id -> count
+		totalBackendsByNode := make(map[string]float64)
+		usedBackendsByNode := make(map[string]float64)
+
+		// Age and reuse count of the backend connections
+		var connectionAges []float64
+		var connectionReuses []float64
+
 		for rows.Next() {
 			err = rows.Scan(scanArgs...)
 			if err != nil {
@@ -324,8 +839,14 @@ func queryNamespaceMapping(ch chan<- prometheus.Metric, db *sql.DB, namespace st
 			var valuePoolPid string
 			var valuePoolId string
 			var valueBackendId string
+			var valueCreateTime string
+			var valuePoolCounter string
 			for idx, columnName := range columnNames {
 				switch columnName {
+				case "create_time", "backend_connection_time": // renamed in Pgpool-II 4.2
+					valueCreateTime, _ = dbToString(columnData[idx])
+				case "pool_counter":
+					valuePoolCounter, _ = dbToString(columnData[idx])
 				case "pool_pid":
 					valuePoolPid, _ = dbToString(columnData[idx])
 				case "pool_id":
@@ -340,90 +861,148 @@ func queryNamespaceMapping(ch chan<- prometheus.Metric, db *sql.DB, namespace st
 			}
 			if len(valuePoolPid) > 0 {
 				totalBackends++
-				totalBackendsByProcess[valuePoolPid]++
+				if !e.aggregatePools {
+					totalBackendsByProcess[valuePoolPid]++
+				}
+				totalBackendsByNode[valueBackendId]++
 			}
 			if len(valueUsername) > 0 {
 				totalBackendsInUse++
-				_, ok := backendsInUse[valuePoolPid]
-				if !ok {
-					backendsInUse[valuePoolPid] = make(map[string]map[string]map[string]map[string]float64)
+				usedBackendsByNode[valueBackendId]++
+				backendsInUseByDatabase[valueDatabase]++
+				if created, ok := parseLeadingTimestamp(valueCreateTime); ok {
+					connectionAges = append(connectionAges, time.Since(created).Seconds())
 				}
-				_, ok = backendsInUse[valuePoolPid][valuePoolId]
-				if !ok {
-					backendsInUse[valuePoolPid][valuePoolId] = make(map[string]map[string]map[string]float64)
+				if counter, err := strconv.ParseFloat(valuePoolCounter, 64); err == nil {
+					connectionReuses = append(connectionReuses, counter)
 				}
-				_, ok = backendsInUse[valuePoolPid][valuePoolId][valueBackendId]
-				if !ok {
-					backendsInUse[valuePoolPid][valuePoolId][valueBackendId] = make(map[string]map[string]float64)
+				if e.aggregatePools {
+					backendsInUseByUser[userSlot{valueBackendId, valueUsername, valueDatabase}]++
+					continue
 				}
-				_, ok = backendsInUse[valuePoolPid][valuePoolId][valueBackendId][valueUsername]
-				if !ok {
-					backendsInUse[valuePoolPid][valuePoolId][valueBackendId][valueUsername] = make(map[string]float64)
+				slot := poolSlot{valuePoolPid, valuePoolId, valueBackendId, valueUsername, valueDatabase}
+				if _, ok := backendsInUse[slot]; !ok {
+					usedBackendsByProcess[valuePoolPid]++
 				}
-				backendsInUse[valuePoolPid][valuePoolId][valueBackendId][valueUsername][valueDatabase]++
+				backendsInUse[slot]++
 			}
 		}
 
-		for poolPid, poolIds := range backendsInUse {
-			var usedProcessBackends float64
-
-			for poolId, backendIds := range poolIds {
-				for backendId, userNames := range backendIds {
-					for userName, dbNames := range userNames {
-						for dbName, count := range dbNames {
-
-							usedProcessBackends++
-							variableLabels := []string{"pool_pid", "pool_id", "backend_id", "username", "database"}
-							labels := []string{poolPid, poolId, backendId, userName, dbName}
-							ch <- prometheus.MustNewConstMetric(
-								prometheus.NewDesc(prometheus.BuildFQName("pgpool2", "", "backend_by_process_used"), "Number of backend connection slots in use", variableLabels, nil),
-								prometheus.GaugeValue,
-								count,
-								labels...,
-							)
-
-						}
-					}
-				}
-			}
-			variableLabels := []string{"pool_pid"}
-			labels := []string{poolPid}
+		// The descriptors are shared by the series of all the child processes.
+		usedDesc := e.newDesc("", "backend_by_process_used", "Number of backend connection slots in use", []string{"pool_pid", "pool_id", "backend_id", "username", "database"})
+		usedRatioDesc := e.newDesc("", "backend_by_process_used_ratio", "Number of backend connection slots in use", []string{"pool_pid"})
+		totalDesc := e.newDesc("", "backend_by_process_total", "Number of backend connection slots in use", []string{"pool_pid"})
+		for slot, count := range backendsInUse {
 			ch <- prometheus.MustNewConstMetric(
-				prometheus.NewDesc(prometheus.BuildFQName("pgpool2", "", "backend_by_process_used_ratio"), "Number of backend connection slots in use", variableLabels, nil),
+				usedDesc,
 				prometheus.GaugeValue,
-				usedProcessBackends/totalBackendsByProcess[poolPid],
-				labels...,
+				count,
+				slot.pid, slot.poolId, slot.backendId, slot.username, slot.database,
 			)
+		}
+		for poolPid, used := range usedBackendsByProcess {
 			ch <- prometheus.MustNewConstMetric(
-				prometheus.NewDesc(prometheus.BuildFQName("pgpool2", "", "backend_by_process_total"), "Number of backend connection slots in use", variableLabels, nil),
+				usedRatioDesc,
+				prometheus.GaugeValue,
+				used/totalBackendsByProcess[poolPid],
+				poolPid,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				totalDesc,
 				prometheus.GaugeValue,
 				totalBackendsByProcess[poolPid],
-				labels...,
+				poolPid,
+			)
+		}
+		byUserDesc := e.newDesc("", "backend_by_user_used", "Number of backend connection slots in use for each backend node, user and database", []string{"backend_id", "username", "database"})
+		for slot, count := range backendsInUseByUser {
+			ch <- prometheus.MustNewConstMetric(
+				byUserDesc,
+				prometheus.GaugeValue,
+				count,
+				slot.backendId, slot.username, slot.database,
 			)
 		}
 
+		byDatabaseDesc := e.newDesc("", "backend_by_database_used", "Number of backend connection slots in use for each database", []string{"database"})
+		for database, count := range backendsInUseByDatabase {
+			ch <- prometheus.MustNewConstMetric(byDatabaseDesc, prometheus.GaugeValue, count, database)
+		}
+
 		ch <- prometheus.MustNewConstMetric(
-			prometheus.NewDesc(prometheus.BuildFQName("pgpool2", "", "backend_total"), "Number of total possible backend connection slots", nil, nil),
+			e.newDesc("", "backend_total", "Number of total possible backend connection slots", nil),
 			prometheus.GaugeValue,
 			totalBackends,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			prometheus.NewDesc(prometheus.BuildFQName("pgpool2", "", "backend_used"), "Number of backend connection slots in use", nil, nil),
+			e.newDesc("", "backend_used", "Number of backend connection slots in use", nil),
 			prometheus.GaugeValue,
 			totalBackendsInUse,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			prometheus.NewDesc(prometheus.BuildFQName("pgpool2", "", "backend_used_ratio"), "Ratio of backend connections in use to total backend connection slots", nil, nil),
+			e.newDesc("", "backend_used_ratio", "Ratio of backend connections in use to total backend connection slots", nil),
 			prometheus.GaugeValue,
 			totalBackendsInUse/totalBackends,
 		)
 
+		// Each child process caches up to max_pool connections to every
+		// backend.
+		if slots := limits["num_init_children"] * limits["max_pool"] * float64(len(totalBackendsByNode)); slots > 0 {
+			ch <- prometheus.MustNewConstMetric(
+				e.newDesc("", "backend_slots_saturation_ratio", "Ratio of backend connection slots in use to the slots allowed by num_init_children and max_pool", nil),
+				prometheus.GaugeValue,
+				totalBackendsInUse/slots,
+			)
+		}
+
+		ch <- constHistogram(
+			e.newDesc("", "backend_connection_age_seconds", "Age of the backend connections in use", nil),
+			connectionAges,
+			ageBuckets,
+		)
+		ch <- constHistogram(
+			e.newDesc("", "backend_connection_reuse", "Number of times the backend connections in use were reused (pool_counter)", nil),
+			connectionReuses,
+			reuseBuckets,
+		)
+
+		for backendId, total := range totalBackendsByNode {
+			labels := []string{backendId, backendHostnames[backendId]}
+			ch <- prometheus.MustNewConstMetric(
+				e.newDesc("", "backend_by_node_used", "Number of backend connection slots in use for each backend node", []string{"backend_id", "hostname"}),
+				prometheus.GaugeValue,
+				usedBackendsByNode[backendId],
+				labels...,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				e.newDesc("", "backend_by_node_total", "Number of total possible backend connection slots for each backend node", []string{"backend_id", "hostname"}),
+				prometheus.GaugeValue,
+				total,
+				labels...,
+			)
+		}
+
 		return nonfatalErrors, nil
 	}
 
 	// Read from the result of "SHOW pool_processes"
 	if namespace == "pool_processes" {
+		// The columns read below are not mapped to metrics, so report the
+		// ones this Pgpool-II version should provide but did not here.
+		for _, columnName := range []string{"database", "username", "start_time", "status", "client_host"} {
+			if _, ok := columnIdx[columnName]; !ok && columnSupported(namespace, columnName, e.version) {
+				nonfatalErrors = append(nonfatalErrors, fmt.Errorf("%w: %s %s", errMissingColumn, namespace, columnName))
+			}
+		}
+
 		frontendByUserDb := make(map[string]map[string]int)
+		// database -> count
+		frontendByDatabase := make(map[string]float64)
+		// Reported by Pgpool-II 4.2 and later, e.g. "Idle"
+		frontendByStatus := make(map[string]float64)
+		// Reported by newer Pgpool-II versions, empty for idle processes
+		frontendByClientHost := make(map[string]float64)
+		var frontendAges []float64
 		var frontend_total float64
 		var frontend_used float64
 
@@ -442,10 +1021,24 @@ func queryNamespaceMapping(ch chan<- prometheus.Metric, db *sql.DB, namespace st
 					valueDatabase, _ = dbToString(columnData[idx])
 				case "username":
 					valueUsername, _ = dbToString(columnData[idx])
+				case "status":
+					valueStatus, _ := dbToString(columnData[idx])
+					frontendByStatus[valueStatus]++
+				case "client_host":
+					valueClientHost, _ := dbToString(columnData[idx])
+					if valueClientHost != "" {
+						frontendByClientHost[valueClientHost]++
+					}
+				case "start_time":
+					valueStartTime, _ := dbToString(columnData[idx])
+					if started, ok := parseLeadingTimestamp(valueStartTime); ok {
+						frontendAges = append(frontendAges, time.Since(started).Seconds())
+					}
 				}
 			}
 			if len(valueDatabase) > 0 && len(valueUsername) > 0 {
 				frontend_used++
+				frontendByDatabase[valueDatabase]++
 				dbCount, ok := frontendByUserDb[valueUsername]
 				if !ok {
 					dbCount = map[string]int{valueDatabase: 0}
@@ -460,7 +1053,7 @@ func queryNamespaceMapping(ch chan<- prometheus.Metric, db *sql.DB, namespace st
 			for dbName, count := range dbs {
 				labels := []string{userName, dbName}
 				ch <- prometheus.MustNewConstMetric(
-					prometheus.NewDesc(prometheus.BuildFQName("pgpool2", "", "frontend_used"), "Number of used child processes", variableLabels, nil),
+					e.newDesc("", "frontend_used", "Number of used child processes", variableLabels),
 					prometheus.GaugeValue,
 					float64(count),
 					labels...,
@@ -468,21 +1061,126 @@ func queryNamespaceMapping(ch chan<- prometheus.Metric, db *sql.DB, namespace st
 			}
 		}
 
+		// Summed over the users, so that the applications sharing Pgpool-II
+		// can be compared with a single series each.
+		for database, count := range frontendByDatabase {
+			ch <- prometheus.MustNewConstMetric(
+				e.newDesc("", "connections_by_database", "Number of client connections to each database", []string{"database"}),
+				prometheus.GaugeValue,
+				count,
+				database,
+			)
+		}
+
+		ch <- constHistogram(
+			e.newDesc("", "frontend_age_seconds", "Age of the child processes", nil),
+			frontendAges,
+			ageBuckets,
+		)
+
+		for status, count := range frontendByStatus {
+			ch <- prometheus.MustNewConstMetric(
+				e.newDesc("", "frontend_by_status", "Number of child processes in each status (e.g. Idle, Execute command)", []string{"status"}),
+				prometheus.GaugeValue,
+				count,
+				status,
+			)
+		}
+
+		if e.frontendClientHosts {
+			for clientHost, count := range frontendByClientHost {
+				ch <- prometheus.MustNewConstMetric(
+					e.newDesc("", "frontend_connections", "Number of frontend connections from each client host", []string{"client_host"}),
+					prometheus.GaugeValue,
+					count,
+					clientHost,
+				)
+			}
+		}
+
 		// Generate the metric for "pool_processes"
 		ch <- prometheus.MustNewConstMetric(
-			prometheus.NewDesc(prometheus.BuildFQName("pgpool2", "", "frontend_total"), "Number of total child processed", nil, nil),
+			e.newDesc("", "frontend_total", "Number of total child processed", nil),
 			prometheus.GaugeValue,
 			frontend_total,
 		)
 		ch <- prometheus.MustNewConstMetric(
-			prometheus.NewDesc(prometheus.BuildFQName("pgpool2", "", "frontend_used_ratio"), "Ratio of child processes to total processes", nil, nil),
+			e.newDesc("", "frontend_used_ratio", "Ratio of child processes to total processes", nil),
 			prometheus.GaugeValue,
 			frontend_used/frontend_total,
 		)
 
+		// Pgpool-II refuses connections once num_init_children minus
+		// reserved_connections child processes are in use.
+		if children := limits["num_init_children"] - limits["reserved_connections"]; children > 0 {
+			ch <- prometheus.MustNewConstMetric(
+				e.newDesc("", "frontend_saturation_ratio", "Ratio of child processes in use to the connections accepted by num_init_children and reserved_connections", nil),
+				prometheus.GaugeValue,
+				frontend_used/children,
+			)
+		}
+
 		return nonfatalErrors, nil
 	}
 
+	// Read from the result of "SHOW pool_status"
+	if namespace == "pool_status" {
+		for rows.Next() {
+			err = rows.Scan(scanArgs...)
+			if err != nil {
+				return []error{}, errors.New(fmt.Sprintln("Error retrieving rows:", namespace, err))
+			}
+			var valueItem string
+			var valueValue string
+			for idx, columnName := range columnNames {
+				switch columnName {
+				case "item":
+					valueItem, _ = dbToString(columnData[idx])
+				case "value":
+					valueValue, _ = dbToString(columnData[idx])
+				}
+			}
+
+			if help, ok := poolStatusGauges[valueItem]; ok {
+				value, err := strconv.ParseFloat(valueValue, 64)
+				if err != nil {
+					nonfatalErrors = append(nonfatalErrors, &parseError{namespace, valueItem, valueValue})
+					continue
+				}
+				ch <- prometheus.MustNewConstMetric(
+					e.newDesc("pool_status", valueItem, help, nil),
+					prometheus.GaugeValue,
+					value,
+				)
+				continue
+			}
+
+			if poolStatusInfo[valueItem] {
+				ch <- prometheus.MustNewConstMetric(
+					e.newDesc("pool_status", "info", "Pgpool-II configuration parameter value", []string{"parameter", "value"}),
+					prometheus.GaugeValue,
+					1,
+					valueItem, valueValue,
+				)
+			}
+		}
+
+		return nonfatalErrors, nil
+	}
+
+	// Report the columns this Pgpool-II version should provide but did not.
+	for columnName, metricMapping := range mapping.columnMappings {
+		if metricMapping.discard {
+			continue
+		}
+		if _, ok := columnIdx[columnName]; !ok && columnSupported(namespace, columnName, e.version) {
+			nonfatalErrors = append(nonfatalErrors, fmt.Errorf("%w: %s %s", errMissingColumn, namespace, columnName))
+		}
+	}
+
+	// Number of backends up in each role, for "SHOW pool_nodes"
+	var primaryNodes, standbyNodes float64
+
 	for rows.Next() {
 		err = rows.Scan(scanArgs...)
 		if err != nil {
@@ -492,7 +1190,108 @@ func queryNamespaceMapping(ch chan<- prometheus.Metric, db *sql.DB, namespace st
 		// Get the label values for this row.
 		labels := make([]string, len(mapping.labels))
 		for idx, label := range mapping.labels {
-			labels[idx], _ = dbToString(columnData[columnIdx[label]])
+			if i, ok := columnIdx[label]; ok {
+				labels[idx], _ = dbToString(columnData[i])
+			}
+		}
+
+		// A replication delay without a time unit is in bytes, exported
+		// apart so that replication_delay is always in seconds. A delay of
+		// 0, as reported for the primary, is exported as both.
+		byteDelay := false
+
+		// Export the role reported by PostgreSQL next to the role assumed by
+		// Pgpool-II, so that a split-brain can be detected.
+		if namespace == "pool_nodes" {
+			var hostname, port, status string
+			if i, ok := columnIdx["hostname"]; ok {
+				hostname, _ = dbToString(columnData[i])
+			}
+			if i, ok := columnIdx["port"]; ok {
+				port, _ = dbToString(columnData[i])
+			}
+			if i, ok := columnIdx["status"]; ok {
+				status, _ = dbToString(columnData[i])
+				e.observeNodeStatus(hostname, port, status)
+
+				// One series per state, so that e.g. quarantined backends,
+				// reported as down by the status metric, can be told apart.
+				variableLabels := append(append([]string{}, mapping.labels...), "state")
+				for _, state := range e.statusStates() {
+					value := 0.0
+					if strings.EqualFold(status, state) {
+						value = 1
+					}
+					ch <- prometheus.MustNewConstMetric(
+						e.newDesc(namespace, "status_code", "Whether the backend is in the state given by the state label (1 for yes, 0 for no)", variableLabels),
+						prometheus.GaugeValue,
+						value,
+						append(labels, state)...,
+					)
+				}
+
+				ch <- prometheus.MustNewConstMetric(
+					e.newDesc(namespace, "status_info", "Status of the backend as reported by Pgpool-II (e.g. up, waiting) as a label", append(append([]string{}, mapping.labels...), "status_name")),
+					prometheus.GaugeValue,
+					1,
+					append(labels, status)...,
+				)
+			}
+			if i, ok := columnIdx["role"]; ok && e.isUp(status) {
+				role, _ := dbToString(columnData[i])
+				switch strings.ToLower(role) {
+				case "primary", "main", "master":
+					primaryNodes++
+				case "standby", "replica", "slave":
+					standbyNodes++
+				}
+			}
+			if i, ok := columnIdx["replication_delay"]; ok && !mapping.columnMappings["replication_delay"].discard && isByteDelay(columnData[i]) {
+				if bytes, ok := dbToFloat64(columnData[i]); !ok {
+					nonfatalErrors = append(nonfatalErrors, &parseError{namespace, "replication_delay", columnData[i]})
+					byteDelay = true
+				} else {
+					byteDelay = bytes != 0
+					ch <- prometheus.MustNewConstMetric(
+						e.newDesc(namespace, "replication_delay_bytes", "Replication delay in bytes of WAL, when Pgpool-II reports it without a time unit (delay_threshold_by_time not set)", mapping.labels),
+						prometheus.GaugeValue,
+						bytes,
+						labels...,
+					)
+				}
+			}
+			if i, ok := columnIdx["replication_delay"]; ok && e.delayHistogram != nil && !byteDelay {
+				if delay, ok := dbToSeconds(columnData[i], 1); ok && !math.IsNaN(delay) {
+					e.delayHistogram.WithLabelValues(hostname, port).Observe(delay)
+				}
+			}
+
+			if i, ok := columnIdx["pg_role"]; ok {
+				pgRole, _ := dbToString(columnData[i])
+				variableLabels := append(append([]string{}, mapping.labels...), "pg_role")
+				ch <- prometheus.MustNewConstMetric(
+					e.newDesc(namespace, "pg_role", "Role reported by PostgreSQL (primary or standby) as a label", variableLabels),
+					prometheus.GaugeValue,
+					1,
+					append(labels, pgRole)...,
+				)
+			}
+
+			// Replication state of the backend, e.g. "streaming" and "async"
+			if i, ok := columnIdx["replication_state"]; ok {
+				state, _ := dbToString(columnData[i])
+				var syncState string
+				if j, ok := columnIdx["replication_sync_state"]; ok {
+					syncState, _ = dbToString(columnData[j])
+				}
+				variableLabels := append(append([]string{}, mapping.labels...), "state", "sync_state")
+				ch <- prometheus.MustNewConstMetric(
+					e.newDesc(namespace, "replication_state_info", "Replication state and synchronization state of the backend as labels", variableLabels),
+					prometheus.GaugeValue,
+					1,
+					append(labels, state, syncState)...,
+				)
+			}
 		}
 
 		// Loop over column names, and match to scan data.
@@ -502,23 +1301,26 @@ func queryNamespaceMapping(ch chan<- prometheus.Metric, db *sql.DB, namespace st
 				if metricMapping.discard {
 					continue
 				}
+				if columnName == "replication_delay" && byteDelay {
+					continue
+				}
 
-				// If status column, convert string to int.
-				if columnName == "status" {
+				// If status or boolean column, convert string to int.
+				if !metricMapping.mapped && (columnName == "status" || columnName == "pg_status" || columnName == "load_balance_node") {
 					valueString, ok := dbToString(columnData[idx])
 					if !ok {
-						nonfatalErrors = append(nonfatalErrors, errors.New(fmt.Sprintln("Unexpected error parsing column: ", namespace, columnName, columnData[idx])))
+						nonfatalErrors = append(nonfatalErrors, &parseError{namespace, columnName, columnData[idx]})
 						continue
 					}
-					value := parseStatusField(valueString)
+					value := e.statusValue(valueString)
 					// Generate the metric
 					ch <- prometheus.MustNewConstMetric(metricMapping.desc, metricMapping.vtype, value, labels...)
 					continue
 				}
 
-				value, ok := dbToFloat64(columnData[idx])
+				value, ok := metricMapping.conversion(columnData[idx])
 				if !ok {
-					nonfatalErrors = append(nonfatalErrors, errors.New(fmt.Sprintln("Unexpected error parsing column: ", namespace, columnName, columnData[idx])))
+					nonfatalErrors = append(nonfatalErrors, &parseError{namespace, columnName, columnData[idx]})
 					continue
 				}
 				// Generate the metric
@@ -526,32 +1328,199 @@ func queryNamespaceMapping(ch chan<- prometheus.Metric, db *sql.DB, namespace st
 			}
 		}
 	}
+
+	if namespace == "pool_nodes" {
+		ch <- prometheus.MustNewConstMetric(
+			e.newDesc("", "primary_nodes", "Number of backends up in the primary (or main) role", nil),
+			prometheus.GaugeValue,
+			primaryNodes,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			e.newDesc("", "standby_nodes", "Number of backends up in the standby (or replica) role", nil),
+			prometheus.GaugeValue,
+			standbyNodes,
+		)
+	}
+
 	return nonfatalErrors, nil
 }
 
-// Establish a new DB connection using dsn.
-func getDBConn(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("postgres", dsn)
+// Return the hostname of each backend node by node id, from "SHOW pool_nodes".
+func (e *Exporter) backendHostnames(ctx context.Context) (map[string]string, error) {
+	nodes, err := e.poolNodes(ctx)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintln("Error retrieving backend hostnames:", err))
+	}
+
+	hostnames := make(map[string]string)
+	for _, node := range nodes {
+		hostnames[node.id] = node.hostname
+	}
+
+	return hostnames, nil
+}
+
+// Return the numeric items of "SHOW pool_status" by name, e.g.
+// num_init_children.
+func (e *Exporter) poolStatusValues(ctx context.Context) (map[string]float64, error) {
+	rows, err := e.query(ctx, "pool_status", e.namespaceQuery("pool_status"))
+	if err != nil {
+		return nil, fmt.Errorf("Error running query on database: %s %w", "pool_status", err)
+	}
+	defer rows.Close()
+
+	values := make(map[string]float64)
+	for rows.Next() {
+		var item, value string
+		if err := scanColumns(rows, map[string]*string{"item": &item, "value": &value}); err != nil {
+			return nil, err
+		}
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			values[item] = v
+		}
+	}
+
+	return values, rows.Err()
+}
+
+// Scan the current row and store the values of the given columns as
+// strings. Other columns are ignored.
+func scanColumns(rows Rows, columns map[string]*string) error {
+	columnNames, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	columnData := make([]interface{}, len(columnNames))
+	scanArgs := make([]interface{}, len(columnNames))
+	for i := range columnData {
+		scanArgs[i] = &columnData[i]
+	}
+	if err := rows.Scan(scanArgs...); err != nil {
+		return err
+	}
+
+	for i, name := range columnNames {
+		if value, ok := columns[name]; ok {
+			*value, _ = dbToString(columnData[i])
+		}
+	}
+
+	return nil
+}
+
+// Whether err is the error "SHOW pool_cache" returns when the query cache
+// is disabled.
+func isQueryCacheDisabled(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "cache") && (strings.Contains(msg, "not enabled") || strings.Contains(msg, "disabled"))
+}
+
+// Establish a new DB connection to the DSN of the exporter with the driver
+// selected by WithDriver.
+//
+// The pgx driver negotiates every authentication request Pgpool-II sends
+// (clear-text, md5 and scram-sha-256), including the additional requests
+// sent when Pgpool-II passes authentication through to the backend. lib/pq
+// is kept as a fallback.
+func (e *Exporter) connect(ctx context.Context) (Querier, error) {
+	db, err := e.openDB(e.dsn)
+	if err != nil {
+		return nil, err
+	}
+	// By default, one connection for each namespace queried concurrently
+	maxOpen := e.maxOpenConns
+	if maxOpen <= 0 {
+		maxOpen = e.scrapeConcurrency
+	}
+	maxIdle := e.maxIdleConns
+	if maxIdle == 0 {
+		maxIdle = maxOpen
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	// A new handle is opened on every reconnection, and both drivers resolve
+	// the host name on every connection, so that a failover to a new
+	// address behind a DNS name is followed. A connection to an address
+	// which no longer answers is only noticed when a query fails, unless
+	// connections are renewed periodically.
+	db.SetConnMaxLifetime(e.connMaxLifetime)
+
+	querier := NewSQLQuerier(db)
+	err = ping(ctx, querier)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
-	db.SetMaxOpenConns(1)
-	db.SetMaxIdleConns(1)
 
-	err = ping(db)
+	return querier, nil
+}
+
+// Whether err was caused by Pgpool-II rejecting the credentials.
+func isAuthError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "28P01" || pgErr.Code == "28000"
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "28P01" || pqErr.Code == "28000"
+	}
+
+	return false
+}
+
+// Open a database handle for dsn without connecting to Pgpool-II. The
+// connections are established with the dialer of the exporter if set, with
+// the credentials of its auth module if set, or else of its credential
+// files.
+func (e *Exporter) openDB(dsn string) (*sql.DB, error) {
+	var err error
+	if e.authModule != nil {
+		dsn, err = e.authModule.apply(dsn)
+	} else {
+		dsn, err = applyCredentialFiles(dsn, e.userFile, e.passwordFile)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return db, nil
+	dial := e.dial
+	if e.driver == "postgres" {
+		if dial == nil {
+			return sql.Open("postgres", dsn)
+		}
+		if _, err := pq.NewConnector(dsn); err != nil {
+			return nil, errors.New(fmt.Sprintln("Error parsing DSN:", err))
+		}
+		return sql.OpenDB(&pqConnector{dsn, pqDialer{dial}}), nil
+	}
+
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintln("Error parsing DSN:", err))
+	}
+	// Pgpool-II handles its SHOW commands in the simple query protocol only.
+	config.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	if dial != nil {
+		config.DialFunc = pgconn.DialFunc(dial)
+		// Leave the host name to the dialer, e.g. to resolve it at the
+		// other end of a tunnel.
+		config.LookupFunc = func(ctx context.Context, host string) ([]string, error) {
+			return []string{host}, nil
+		}
+	}
+
+	return stdlib.OpenDB(*config), nil
 }
 
 // Connect to Pgpool-II and run "SHOW POOL_VERSION;" to check connection availability.
-func ping(db *sql.DB) error {
+func ping(ctx context.Context, db Querier) error {
 
-	rows, err := db.Query("SHOW POOL_VERSION;")
+	rows, err := db.Query(ctx, "SHOW POOL_VERSION;")
 	if err != nil {
-		return fmt.Errorf("error connecting to Pgpool-II: %s", err)
+		return fmt.Errorf("error connecting to Pgpool-II: %w", err)
 	}
 	defer rows.Close()
 
@@ -585,7 +1554,6 @@ func dbToFloat64(t interface{}) (float64, bool) {
 		}
 		result, err := strconv.ParseFloat(v, 64)
 		if err != nil {
-			level.Error(Logger).Log("msg", "Could not parse string", "err", err)
 			return math.NaN(), false
 		}
 		return result, true
@@ -601,6 +1569,192 @@ func dbToFloat64(t interface{}) (float64, bool) {
 	}
 }
 
+// Units accepted in text durations, in seconds
+var durationUnits = map[string]float64{
+	"":             1,
+	"s":            1,
+	"sec":          1,
+	"second":       1,
+	"seconds":      1,
+	"ms":           1e-3,
+	"millisecond":  1e-3,
+	"milliseconds": 1e-3,
+	"us":           1e-6,
+	"microsecond":  1e-6,
+	"microseconds": 1e-6,
+	"min":          60,
+	"minute":       60,
+	"minutes":      60,
+}
+
+// Values of the text values of the MAPPEDMETRIC columns. Other values
+// are reported as parse errors.
+var columnValueMappings = map[string]map[string]map[string]float64{
+	"pool_nodes": {
+		"replication_state":      {"": 0, "startup": 1, "catchup": 2, "streaming": 3, "backup": 4, "stopping": 5},
+		"replication_sync_state": {"": 0, "async": 1, "potential": 2, "sync": 3, "quorum": 4},
+	},
+}
+
+// Convert database.sql types holding a text value of a MAPPEDMETRIC column
+// to its value in mapping. The match is case-insensitive.
+func dbToMappedValue(t interface{}, mapping map[string]float64) (float64, bool) {
+	strV, ok := dbToString(t)
+	if !ok {
+		return math.NaN(), false
+	}
+	value, ok := mapping[strings.ToLower(strings.TrimSpace(strV))]
+	if !ok {
+		return math.NaN(), false
+	}
+	return value, true
+}
+
+// Unit in seconds of the DURATION columns which Pgpool-II reports as plain
+// numbers, e.g. the health check durations in milliseconds. Their metrics
+// are named with a "_seconds" suffix.
+var durationColumnUnits = map[string]map[string]float64{
+	"pool_health_check_stats": {
+		"max_duration":     1e-3,
+		"min_duration":     1e-3,
+		"average_duration": 1e-3,
+	},
+}
+
+// Convert database.sql types holding a duration to seconds. Text durations
+// such as "0.000631 second" or "5 ms" are converted according to their unit;
+// values without a unit are multiplied by unit, the number of seconds they
+// are in.
+func dbToSeconds(t interface{}, unit float64) (float64, bool) {
+	var strV string
+	switch v := t.(type) {
+	case []byte:
+		strV = string(v)
+	case string:
+		strV = v
+	default:
+		value, ok := dbToFloat64(t)
+		return value * unit, ok
+	}
+
+	return parseDuration(strV, unit)
+}
+
+// Parse a text duration and return it in seconds, taking the numbers
+// without a unit as a number of unit seconds.
+func parseDuration(s string, unit float64) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "-nan" || s == "nan" {
+		return math.NaN(), true
+	}
+	number, suffix := splitDurationUnit(s)
+
+	multiplier, ok := durationUnits[suffix]
+	if suffix == "" {
+		multiplier = unit
+	}
+	if !ok {
+		return math.NaN(), false
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return math.NaN(), false
+	}
+
+	return value * multiplier, true
+}
+
+// Split a text duration into its number and its unit, in lower case, e.g.
+// "0.012 second" into "0.012" and "second".
+func splitDurationUnit(s string) (string, string) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.' && r != '-' && r != '+' && r != 'e' && r != 'E'
+	})
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.ToLower(strings.TrimSpace(s[i:]))
+}
+
+// Whether a replication delay is a number of bytes of WAL, which Pgpool-II
+// reports without a time unit unless delay_threshold_by_time is set.
+func isByteDelay(t interface{}) bool {
+	s, ok := dbToString(t)
+	if !ok {
+		return false
+	}
+	s = strings.TrimSpace(s)
+	if s == "" || s == "nan" || s == "-nan" {
+		return false
+	}
+	_, suffix := splitDurationUnit(s)
+	return suffix == ""
+}
+
+// Layout of the timestamps reported by Pgpool-II
+const pgpoolTimestampLayout = "2006-01-02 15:04:05"
+
+// Convert database.sql types holding a timestamp to seconds since the Unix
+// epoch. Pgpool-II reports timestamps in its local time zone, which is
+// assumed to be the time zone of the exporter. Empty timestamps (e.g. a
+// health check which never failed) are mapped to 0.
+func dbToTimestamp(t interface{}) (float64, bool) {
+	var strV string
+	switch v := t.(type) {
+	case []byte:
+		strV = string(v)
+	case string:
+		strV = v
+	case nil:
+		return 0, true
+	default:
+		return dbToFloat64(t)
+	}
+
+	strV = strings.TrimSpace(strV)
+	if strV == "" {
+		return 0, true
+	}
+	ts, err := time.ParseInLocation(pgpoolTimestampLayout, strV, time.Local)
+	if err != nil {
+		return math.NaN(), false
+	}
+
+	return float64(ts.Unix()), true
+}
+
+// Parse the timestamp at the start of a Pgpool-II time column, ignoring
+// what follows, e.g. "2022-05-12 10:14:48 (2:53 before process restarting)".
+func parseLeadingTimestamp(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) < len(pgpoolTimestampLayout) {
+		return time.Time{}, false
+	}
+	ts, err := time.ParseInLocation(pgpoolTimestampLayout, value[:len(pgpoolTimestampLayout)], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts, true
+}
+
+// Build a histogram of values with the given bucket upper bounds.
+func constHistogram(desc *prometheus.Desc, values []float64, buckets []float64) prometheus.Metric {
+	counts := make(map[float64]uint64, len(buckets))
+	var sum float64
+	for _, bucket := range buckets {
+		counts[bucket] = 0
+	}
+	for _, value := range values {
+		sum += value
+		for _, bucket := range buckets {
+			if value <= bucket {
+				counts[bucket]++
+			}
+		}
+	}
+	return prometheus.MustNewConstHistogram(desc, uint64(len(values)), sum, counts)
+}
+
 // Convert database.sql to string for Prometheus labels. Null types are mapped to empty strings.
 func dbToString(t interface{}) (string, bool) {
 	switch v := t.(type) {
@@ -627,37 +1781,87 @@ func dbToString(t interface{}) (string, bool) {
 	}
 }
 
-// Convert bool to int.
-func parseStatusField(value string) float64 {
-	switch value {
-	case "true", "up", "waiting":
-		return 1.0
-	case "false", "unused", "down":
-		return 0.0
+// Values of the status and boolean columns. Old Pgpool-II versions report
+// the status as a number: 0 (unused), 1 (up, no connection), 2 (up) or 3
+// (down). Overridden and extended with WithStatusValues.
+var defaultStatusValues = map[string]float64{
+	"true": 1, "up": 1, "waiting": 1, "1": 1, "2": 1,
+	"false": 0, "unused": 0, "down": 0, "quarantine": 0, "0": 0, "3": 0,
+}
+
+// Convert a status or boolean to a number, and report whether the value is
+// known. Unknown values are converted to 0.
+func (e *Exporter) parseStatusField(value string) (float64, bool) {
+	v, ok := e.statusValues[strings.ToLower(value)]
+	return v, ok
+}
+
+// Whether a backend status converts to 1.
+func (e *Exporter) isUp(status string) bool {
+	v, _ := e.parseStatusField(status)
+	return v == 1
+}
+
+// Convert a status or boolean to a number, counting unknown values in
+// pgpool2_unknown_status_values_total.
+func (e *Exporter) statusValue(value string) float64 {
+	v, ok := e.parseStatusField(value)
+	if !ok {
+		e.unknownStatus.WithLabelValues(value).Inc()
+	}
+	return v
+}
+
+// The states exported by pgpool2_pool_nodes_status_code: the states of
+// Pgpool-II and those added with WithStatusValues.
+func (e *Exporter) statusStates() []string {
+	states := append([]string{}, nodeStates...)
+	var added []string
+	for value := range e.statusValues {
+		if _, err := strconv.ParseFloat(value, 64); err == nil || value == "true" || value == "false" {
+			continue
+		}
+		if !slices.Contains(states, value) {
+			added = append(added, value)
+		}
 	}
-	return 0.0
+	sort.Strings(added)
+	return append(states, added...)
 }
 
 // Mask user password in DSN
 func MaskPassword(dsn string) string {
+	if !isURLDSN(dsn) {
+		params, err := parseKeywordDSN(dsn)
+		if err != nil {
+			return "could not parse DATA_SOURCE_NAME"
+		}
+		if getKeywordParam(params, "password") != "" {
+			params = setKeywordParam(params, "password", "MASKED_PASSWORD")
+		}
+		return formatKeywordDSN(params)
+	}
+
 	pDSN, err := url.Parse(dsn)
 	if err != nil {
 		return "could not parse DATA_SOURCE_NAME"
 	}
 	// Mask user password in DSN
-	if pDSN.User != nil {
+	if _, ok := pDSN.User.Password(); ok {
 		pDSN.User = url.UserPassword(pDSN.User.Username(), "MASKED_PASSWORD")
 	}
+	// libpq also accepts the password as a query parameter.
+	if query := pDSN.Query(); query.Has("password") {
+		query.Set("password", "MASKED_PASSWORD")
+		pDSN.RawQuery = query.Encode()
+	}
 
 	return pDSN.String()
 }
 
 // Retrieve Pgpool-II version.
-func QueryVersion(db *sql.DB) (semver.Version, error) {
-
-	level.Debug(Logger).Log("msg", "Querying Pgpool-II version")
-
-	versionRows, err := db.Query("SHOW POOL_VERSION;")
+func QueryVersion(ctx context.Context, db Querier) (semver.Version, error) {
+	versionRows, err := db.Query(ctx, "SHOW POOL_VERSION;")
 	if err != nil {
 		return semver.Version{}, errors.New(fmt.Sprintln("Error querying SHOW POOL_VERSION:", err))
 	}
@@ -669,7 +1873,7 @@ func QueryVersion(db *sql.DB) (semver.Version, error) {
 		return semver.Version{}, errors.New(fmt.Sprintln("Error retrieving column name for version:", err))
 	}
 	if len(columnNames) != 1 || columnNames[0] != "pool_version" {
-		return semver.Version{}, errors.New(fmt.Sprintln("Error returning Pgpool-II version:", err))
+		return semver.Version{}, fmt.Errorf("%w: unexpected columns %v", errUnsupportedVersion, columnNames)
 	}
 
 	var pgpoolVersion string
@@ -682,42 +1886,127 @@ func QueryVersion(db *sql.DB) (semver.Version, error) {
 
 	v := pgpoolVersionRegex.FindStringSubmatch(pgpoolVersion)
 	if len(v) > 1 {
-		level.Debug(Logger).Log("pgpool_version", v[1])
 		return semver.ParseTolerant(v[1])
 	}
 
-	return semver.Version{}, errors.New(fmt.Sprintln("Error retrieving Pgpool-II version:", err))
+	return semver.Version{}, fmt.Errorf("%w: %q", errUnsupportedVersion, pgpoolVersion)
 }
 
-// Iterate through all the namespace mappings in the exporter and run their queries.
-func queryNamespaceMappings(ch chan<- prometheus.Metric, db *sql.DB, metricMap map[string]MetricMapNamespace) map[string]error {
+// Iterate through all the namespace mappings in the exporter and run their
+// queries. Returns the errors and the query duration of each namespace.
+func (e *Exporter) queryNamespaceMappings(ctx context.Context, ch chan<- prometheus.Metric) (map[string]error, map[string]time.Duration) {
 	// Return a map of namespace -> errors
 	namespaceErrors := make(map[string]error)
+	namespaceDurations := make(map[string]time.Duration)
+	var mutex sync.Mutex
+
+	// Each worker holds a connection of the pool while it runs a query.
+	workers := make(chan struct{}, e.scrapeConcurrency)
+	var wg sync.WaitGroup
+
+	for namespace, mapping := range e.metricMap {
+		// Skip namespaces which this Pgpool-II version does not provide.
+		if !namespaceSupported(namespace, e.version) {
+			level.Debug(e.log(ctx)).Log("msg", "Namespace not supported by Pgpool-II version", "namespace", namespace, "version", e.version)
+			continue
+		}
+		// Skip namespaces found unsupported or not permitted after connecting.
+		if !e.capable(namespace) {
+			level.Debug(e.log(ctx)).Log("msg", "Namespace not available to the exporter user", "namespace", namespace)
+			continue
+		}
+		// The other exporter of the HA pair runs it.
+		if e.leaderOnly[namespace] && !e.isLeader() {
+			level.Debug(e.log(ctx)).Log("msg", "Namespace left to the HA leader", "namespace", namespace)
+			continue
+		}
 
-	for namespace, mapping := range metricMap {
-		// pool_backend_stats and pool_health_check_stats can not be used before 4.1.
-		if namespace == "pool_backend_stats" || namespace == "pool_health_check_stats" {
-			if PgpoolSemver.LT(version42) {
-				continue
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(namespace string, mapping MetricMapNamespace) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+
+			level.Debug(e.log(ctx)).Log("msg", "Querying namespace", "namespace", namespace)
+			begun := time.Now()
+			nonFatalErrors, err := e.queryNamespaceMapping(ctx, ch, namespace, mapping)
+			duration := time.Since(begun)
+			// The query was cancelled by the scrape timeout.
+			if err != nil && ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("%w: %s", ctx.Err(), err)
 			}
-		}
 
-		level.Debug(Logger).Log("msg", "Querying namespace", "namespace", namespace)
-		nonFatalErrors, err := queryNamespaceMapping(ch, db, namespace, mapping)
-		// Serious error - a namespace disappeard
-		if err != nil {
-			namespaceErrors[namespace] = err
-			level.Info(Logger).Log("msg", "namespace disappeard", "err", err)
-		}
-		// Non-serious errors - likely version or parsing problems.
-		if len(nonFatalErrors) > 0 {
-			for _, err := range nonFatalErrors {
-				level.Info(Logger).Log("msg", "error parsing", "err", err.Error())
+			mutex.Lock()
+			defer mutex.Unlock()
+			namespaceDurations[namespace] = duration
+			// Serious error - a namespace disappeard
+			if err != nil {
+				namespaceErrors[namespace] = err
+				level.Info(e.log(ctx)).Log("msg", "namespace disappeard", "err", err)
 			}
-		}
+			// Non-serious errors - likely version or parsing problems.
+			// With --metrics.strict, parsing problems fail the scrape.
+			if len(nonFatalErrors) > 0 {
+				for _, err := range nonFatalErrors {
+					level.Info(e.log(ctx)).Log("msg", "error parsing", "err", err.Error())
+
+					var perr *parseError
+					if errors.As(err, &perr) {
+						e.parseErrors.WithLabelValues(perr.namespace, perr.column).Inc()
+						// Counted with the namespace errors.
+						if e.strictMetrics && namespaceErrors[namespace] == nil {
+							namespaceErrors[namespace] = err
+							continue
+						}
+					}
+					e.scrapeErrors.WithLabelValues(errorType(err)).Inc()
+				}
+			}
+		}(namespace, mapping)
 	}
+	wg.Wait()
+
+	return namespaceErrors, namespaceDurations
+}
+
+// Return the connection to Pgpool-II and its DSN, which a scrape may
+// replace at any time. Nil if not connected.
+func (e *Exporter) connection() (Querier, string) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.DB, e.dsn
+}
+
+// Replace the connection to Pgpool-II.
+func (e *Exporter) setDB(db Querier) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.DB = db
+}
 
-	return namespaceErrors
+// SetDSNSource sets a function which rebuilds the DSN from its sources
+// (environment, config file) when authentication fails, so that rotated
+// credentials are picked up without a restart.
+func (e *Exporter) SetDSNSource(source func() (string, error)) {
+	e.dsnSource = source
+}
+
+// Ready reports whether the last connection attempt or ping to Pgpool-II
+// succeeded.
+func (e *Exporter) Ready() bool {
+	return e.connected.Load()
+}
+
+// Close cancels the queries in progress and closes the connection to
+// Pgpool-II, if any.
+func (e *Exporter) Close() error {
+	e.cancel()
+	if e.DB == nil {
+		return nil
+	}
+	return e.DB.Close()
 }
 
 // Describe implements prometheus.Collector.
@@ -726,12 +2015,18 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	// from Postgres. So we use the poor man's describe method: Run a collect
 	// and send the descriptors of all the collected metrics. The problem
 	// here is that we need to connect to the Postgres DB. If it is currently
-	// unavailable, the descriptors will be incomplete. Since this is a
-	// stand-alone exporter and not used as a library within other code
-	// implementing additional metrics, the worst that can happen is that we
-	// don't detect inconsistent metrics created by this exporter
-	// itself. Also, a change in the monitored Postgres instance may change the
+	// unavailable, the descriptors will be incomplete. The worst that can
+	// happen is that we don't detect inconsistent metrics created by this
+	// exporter itself, or by other collectors registered next to it when it
+	// is embedded in another program. Also, a change in the monitored Postgres instance may change the
 	// exported metrics during the runtime of the exporter.
+	//
+	// If Pgpool-II is not connected yet, no descriptors are sent, so that
+	// registering the exporter does not wait for a connection attempt and
+	// the exporter is registered as an unchecked collector.
+	if e.DB == nil {
+		return
+	}
 
 	metricCh := make(chan prometheus.Metric)
 	doneCh := make(chan struct{})
@@ -750,18 +2045,115 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 
 // Collect implements prometheus.Collector.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	e.scrape(ch)
-	ch <- e.duration
+	e.collect(e.ctx, ch)
+}
+
+// Scrape Pgpool-II and send the metrics to ch, or replay the metrics of a
+// recent scrape if --metrics.cache-ttl or --collect.interval is set, or of
+// a scrape already running. Queries are cancelled when ctx is done.
+func (e *Exporter) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	if e.background {
+		for _, m := range e.snapshot(ctx) {
+			ch <- m
+		}
+		return
+	}
+
+	if e.cacheTTL > 0 {
+		for _, m := range e.cachedMetrics(ctx) {
+			ch <- m
+		}
+		return
+	}
+
+	for _, m := range e.sharedMetrics(ctx) {
+		ch <- m
+	}
+}
+
+// Scrape Pgpool-II and send the metrics to ch.
+func (e *Exporter) collectUncached(ctx context.Context, ch chan<- prometheus.Metric) {
+	if e.serveStaleFor > 0 {
+		e.scrapeOrStale(ctx, ch)
+	} else {
+		e.scrape(ctx, ch)
+	}
 	ch <- e.up
+	e.statusChanges.Collect(ch)
+	e.unknownStatus.Collect(ch)
+	if e.delayHistogram != nil {
+		e.delayHistogram.Collect(ch)
+	}
+	if !e.noSelfMetrics {
+		e.collectSelf(ch)
+	}
+}
+
+// Send the metrics of the exporter about its own scrapes.
+func (e *Exporter) collectSelf(ch chan<- prometheus.Metric) {
+	ch <- e.duration
 	ch <- e.totalScrapes
 	ch <- e.error
+	e.queryTimeouts.Collect(ch)
+	e.queryRetries.Collect(ch)
+	e.parseErrors.Collect(ch)
+	e.slowQueries.Collect(ch)
+	e.nsDuration.Collect(ch)
+	e.nsErrors.Collect(ch)
+	ch <- e.reconnects
+	e.dbStats.collect(ch)
+	ch <- e.coalesced
+	e.scrapeErrors.Collect(ch)
+}
+
+// ExporterMetrics returns a collector of the metrics of the exporter about
+// its own scrapes, e.g. pgpool2_exporter_scrape_errors_total, to register
+// apart from the exporter created with WithoutExporterMetrics.
+func (e *Exporter) ExporterMetrics() prometheus.Collector {
+	return selfCollector{e}
+}
+
+type selfCollector struct {
+	e *Exporter
+}
+
+func (c selfCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
 }
 
-func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
+func (c selfCollector) Collect(ch chan<- prometheus.Metric) {
+	c.e.collectSelf(ch)
+}
+
+// Count the status change of a backend since the previous scrape, if any.
+func (e *Exporter) observeNodeStatus(hostname string, port string, status string) {
+	e.nodeMutex.Lock()
+	defer e.nodeMutex.Unlock()
+
+	key := hostname + ":" + port
+	if previous, ok := e.nodeStatus[key]; ok && previous != status {
+		e.statusChanges.WithLabelValues(hostname, port, previous, status).Inc()
+	}
+	e.nodeStatus[key] = status
+}
+
+func (e *Exporter) scrape(ctx context.Context, ch chan<- prometheus.Metric) {
 	e.totalScrapes.Inc()
+
+	if e.scrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.scrapeTimeout)
+		defer cancel()
+	}
+
+	if e.pcp != nil {
+		e.collectPCP(ctx, ch)
+	}
+
 	var err error
 	defer func(begun time.Time) {
 		e.duration.Set(time.Since(begun).Seconds())
+		e.dbStats.observe(e.DB)
 		if err == nil {
 			e.error.Set(0)
 		} else {
@@ -770,41 +2162,206 @@ func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
 	}(time.Now())
 
 	// Check connection availability and close the connection if it fails.
-	if err = ping(e.DB); err != nil {
-		level.Error(Logger).Log("msg", "Error pinging Pgpool-II", "err", err)
-		if cerr := e.DB.Close(); cerr != nil {
-			level.Error(Logger).Log("msg", "Error while closing non-pinging connection", "err", err)
+	if e.DB == nil {
+		err = errors.New("no connection to Pgpool-II")
+	} else if err = ping(ctx, e.DB); err != nil {
+		level.Error(e.log(ctx)).Log("msg", "Error pinging Pgpool-II", "err", err)
+		db := e.DB
+		e.setDB(nil)
+		if cerr := db.Close(); cerr != nil {
+			level.Error(e.log(ctx)).Log("msg", "Error while closing non-pinging connection", "err", cerr)
+		}
+	}
+
+	if err != nil {
+		// Don't reconnect on every scrape while Pgpool-II is down.
+		if due, next := e.backoff.due(); !due {
+			level.Debug(e.log(ctx)).Log("msg", "Waiting before reconnecting to Pgpool-II", "next", next)
+			e.up.Set(0)
+			e.connected.Store(false)
+			return
 		}
-		level.Info(Logger).Log("msg", "Reconnecting to Pgpool-II")
-		e.DB, err = sql.Open("postgres", e.dsn)
-		e.DB.SetMaxOpenConns(1)
-		e.DB.SetMaxIdleConns(1)
 
-		if err = ping(e.DB); err != nil {
-			level.Error(Logger).Log("msg", "Error pinging Pgpool-II", "err", err)
-			if cerr := e.DB.Close(); cerr != nil {
-				level.Error(Logger).Log("msg", "Error while closing non-pinging connection", "err", err)
+		level.Info(e.log(ctx)).Log("msg", "Reconnecting to Pgpool-II")
+		e.reconnects.Inc()
+		// Pgpool-II may have been upgraded while the connection was down.
+		e.version = semver.Version{}
+		var db Querier
+		db, err = e.connect(ctx)
+		e.setDB(db)
+
+		// The credentials may have been rotated: rebuild the DSN from its
+		// sources and try again.
+		if err != nil && isAuthError(err) && e.dsnSource != nil {
+			level.Warn(e.log(ctx)).Log("msg", "Authentication failed, reloading credentials", "err", err)
+			if dsn, derr := e.dsnSource(); derr != nil {
+				level.Error(e.log(ctx)).Log("msg", "Error reloading credentials", "err", derr)
+			} else {
+				e.mutex.Lock()
+				e.dsn = dsn
+				e.mutex.Unlock()
+				db, err = e.connect(ctx)
+				e.setDB(db)
 			}
+		}
+
+		if err != nil {
+			level.Error(e.log(ctx)).Log("msg", "Error pinging Pgpool-II", "err", err)
+			e.scrapeErrors.WithLabelValues(errorType(err)).Inc()
+			e.backoff.failed()
 			e.up.Set(0)
+			e.connected.Store(false)
 			return
 		}
+		e.backoff.succeeded()
 	}
 
 	e.up.Set(1)
+	e.connected.Store(true)
 	e.error.Set(0)
 
-	e.mutex.RLock()
-	defer e.mutex.RUnlock()
+	// Retrieve Pgpool-II version on every scrape: the driver replaces the
+	// connections which fail without a reconnection here, possibly with
+	// connections to another Pgpool-II server behind the same host name.
+	// Keep the last version if it could not be retrieved.
+	probe := false
+	v, verr := QueryVersion(ctx, e.DB)
+	if verr != nil {
+		level.Error(e.log(ctx)).Log("err", verr)
+		e.scrapeErrors.WithLabelValues(errorType(verr)).Inc()
+	} else if !v.Equals(e.version) {
+		if !v.Equals(e.lastVersion) && !e.lastVersion.Equals(semver.Version{}) {
+			level.Info(e.log(ctx)).Log("msg", "Pgpool-II version changed", "from", e.lastVersion, "to", v)
+		}
+		level.Debug(e.log(ctx)).Log("pgpool_version", v)
+		e.lastVersion = v
+		e.version = v
+		probe = true
+	}
+	if !e.version.Equals(semver.Version{}) {
+		ch <- prometheus.MustNewConstMetric(
+			e.newDesc("", "version_info", "Version of Pgpool-II as labels", []string{"version", "short_version"}),
+			prometheus.GaugeValue,
+			1,
+			e.version.String(), fmt.Sprintf("%d.%d", e.version.Major, e.version.Minor),
+		)
+
+		// Tell why the collectors skipped on this version produce no data.
+		desc := e.newDesc("collector", "supported", "Whether the collector can run on the version of Pgpool-II (1 for yes, 0 for no), with the reason as a label", []string{"collector", "reason"})
+		for namespace := range e.metricMap {
+			var value float64
+			supported, reason := collectorSupport(namespace, e.version)
+			if supported {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, namespace, reason)
+		}
+	}
 
-	errMap := queryNamespaceMappings(ch, e.DB, e.metricMap)
+	// Find the SHOW commands the exporter user can run once, rather than
+	// failing on every scrape.
+	if probe {
+		if perr := e.probeCapabilities(ctx); perr != nil {
+			level.Error(e.log(ctx)).Log("err", perr)
+		}
+	}
+	e.collectCapabilities(ch)
+
+	if e.accumulator != nil {
+		e.accumulator.load(e.log(ctx))
+		var done func()
+		ch, done = e.accumulator.forward(DSNLabel(e.dsn), ch)
+		defer done()
+	}
+
+	// pool_pools, pool_processes and the backend crosscheck read the
+	// results of pool_nodes and pool_status, queried once for all.
+	ctx = withScrapeResults(ctx)
+
+	if e.procfs != "" {
+		e.collectProcess(ctx, ch)
+	}
+	if e.backendCrosscheck {
+		e.collectBackendCrosscheck(ctx, ch)
+	}
+
+	errMap, durations := e.queryNamespaceMappings(ctx, ch)
 	if len(errMap) > 0 {
-		level.Error(Logger).Log("err", errMap)
-		e.error.Set(1)
+		level.Error(e.log(ctx)).Log("err", errMap)
+		err = errors.New("error querying namespaces")
+	}
+
+	for namespace, d := range durations {
+		e.nsDuration.WithLabelValues(namespace).Set(d.Seconds())
+		if e.slowQueryThreshold > 0 && d > e.slowQueryThreshold {
+			level.Warn(e.log(ctx)).Log("msg", "Slow query", "namespace", namespace, "duration", d, "threshold", e.slowQueryThreshold)
+			e.slowQueries.WithLabelValues(namespace).Inc()
+		}
+	}
+
+	for namespace, nerr := range errMap {
+		e.nsErrors.WithLabelValues(namespace).Inc()
+		e.scrapeErrors.WithLabelValues(errorType(nerr)).Inc()
+		if errors.Is(nerr, context.DeadlineExceeded) {
+			e.queryTimeouts.WithLabelValues(namespace).Inc()
+		}
 	}
 }
 
+// Return a copy of maps in which the columns left out by filters, by
+// namespace, are discarded.
+func withColumnFilters(maps map[string]map[string]ColumnMapping, filters map[string]ColumnFilter) map[string]map[string]ColumnMapping {
+	if len(filters) == 0 {
+		return maps
+	}
+
+	filtered := make(map[string]map[string]ColumnMapping, len(maps))
+	for namespace, mappings := range maps {
+		filter, ok := filters[namespace]
+		if !ok {
+			filtered[namespace] = mappings
+			continue
+		}
+		kept := make(map[string]ColumnMapping, len(mappings))
+		for columnName, mapping := range mappings {
+			if mapping.usage != LABEL && !filter.exports(columnName) {
+				mapping = ColumnMapping{DISCARD, mapping.description}
+			}
+			kept[columnName] = mapping
+		}
+		filtered[namespace] = kept
+	}
+	return filtered
+}
+
+// Namespaces whose rows are backends, labeled with their node_id with
+// --metrics.node-id-label
+var nodeIDNamespaces = []string{"pool_nodes", "pool_backend_stats"}
+
+// Return a copy of maps in which the node_id column of the backends is a
+// label. The maps themselves are not modified.
+func withNodeIDLabel(maps map[string]map[string]ColumnMapping) map[string]map[string]ColumnMapping {
+	labeled := make(map[string]map[string]ColumnMapping, len(maps))
+	for namespace, mappings := range maps {
+		labeled[namespace] = mappings
+	}
+	for _, namespace := range nodeIDNamespaces {
+		mappings, ok := maps[namespace]
+		if !ok {
+			continue
+		}
+		withLabel := make(map[string]ColumnMapping, len(mappings)+1)
+		for columnName, mapping := range mappings {
+			withLabel[columnName] = mapping
+		}
+		withLabel["node_id"] = ColumnMapping{LABEL, "Backend node id"}
+		labeled[namespace] = withLabel
+	}
+	return labeled
+}
+
 // Turn the MetricMap column mapping into a prometheus descriptor mapping.
-func makeDescMap(metricMaps map[string]map[string]ColumnMapping, namespace string) map[string]MetricMapNamespace {
+func makeDescMap(metricMaps map[string]map[string]ColumnMapping, valueMappings map[string]map[string]map[string]float64, namespace string, constLabels prometheus.Labels, legacyNames bool) map[string]MetricMapNamespace {
 	var metricMap = make(map[string]MetricMapNamespace)
 
 	for metricNamespace, mappings := range metricMaps {
@@ -831,7 +2388,7 @@ func makeDescMap(metricMaps map[string]map[string]ColumnMapping, namespace strin
 			case COUNTER:
 				thisMap[columnName] = MetricMap{
 					vtype: prometheus.CounterValue,
-					desc:  prometheus.NewDesc(fmt.Sprintf("%s_%s_%s", namespace, metricNamespace, columnName), columnMapping.description, variableLabels, nil),
+					desc:  prometheus.NewDesc(metricName(namespace, metricNamespace, columnName, columnMapping.usage, legacyNames), columnMapping.description, variableLabels, constLabels),
 					conversion: func(in interface{}) (float64, bool) {
 						return dbToFloat64(in)
 					},
@@ -839,11 +2396,43 @@ func makeDescMap(metricMaps map[string]map[string]ColumnMapping, namespace strin
 			case GAUGE:
 				thisMap[columnName] = MetricMap{
 					vtype: prometheus.GaugeValue,
-					desc:  prometheus.NewDesc(fmt.Sprintf("%s_%s_%s", namespace, metricNamespace, columnName), columnMapping.description, variableLabels, nil),
+					desc:  prometheus.NewDesc(metricName(namespace, metricNamespace, columnName, columnMapping.usage, legacyNames), columnMapping.description, variableLabels, constLabels),
 					conversion: func(in interface{}) (float64, bool) {
 						return dbToFloat64(in)
 					},
 				}
+			case TIMESTAMP:
+				thisMap[columnName] = MetricMap{
+					vtype: prometheus.GaugeValue,
+					desc:  prometheus.NewDesc(metricName(namespace, metricNamespace, columnName, columnMapping.usage, legacyNames), columnMapping.description, variableLabels, constLabels),
+					conversion: func(in interface{}) (float64, bool) {
+						return dbToTimestamp(in)
+					},
+				}
+			case MAPPEDMETRIC:
+				mapping := valueMappings[metricNamespace][columnName]
+				thisMap[columnName] = MetricMap{
+					mapped: true,
+					vtype:  prometheus.GaugeValue,
+					desc:   prometheus.NewDesc(metricName(namespace, metricNamespace, columnName, columnMapping.usage, legacyNames), columnMapping.description, variableLabels, constLabels),
+					conversion: func(in interface{}) (float64, bool) {
+						return dbToMappedValue(in, mapping)
+					},
+				}
+			case DURATION:
+				// Durations in another unit than seconds are exported as
+				// they are under their legacy name.
+				unit, ok := durationColumnUnits[metricNamespace][columnName]
+				if !ok || legacyNames {
+					unit = 1
+				}
+				thisMap[columnName] = MetricMap{
+					vtype: prometheus.GaugeValue,
+					desc:  prometheus.NewDesc(metricName(namespace, metricNamespace, columnName, columnMapping.usage, legacyNames), columnMapping.description, variableLabels, constLabels),
+					conversion: func(in interface{}) (float64, bool) {
+						return dbToSeconds(in, unit)
+					},
+				}
 			}
 		}
 
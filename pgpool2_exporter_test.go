@@ -0,0 +1,868 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/pgpool/pgpool2_exporter/testutil"
+)
+
+// Collector sending the metrics of a single namespace mapping
+type namespaceCollector struct {
+	e         *Exporter
+	namespace string
+	// Returned by queryNamespaceMapping
+	nonfatal []error
+	err      error
+}
+
+func (c *namespaceCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *namespaceCollector) Collect(ch chan<- prometheus.Metric) {
+	c.nonfatal, c.err = c.e.queryNamespaceMapping(context.Background(), ch, c.namespace, c.e.metricMap[c.namespace])
+}
+
+// queryFixtures runs the query of namespace against fixtures, with an
+// exporter configured with opts, and returns the exported families by name
+// and the errors of queryNamespaceMapping.
+func queryFixtures(t *testing.T, fixtures testutil.Fixtures, namespace string, opts ...Option) (map[string]*dto.MetricFamily, []error, error) {
+	t.Helper()
+
+	db := testutil.NewDB(fixtures)
+	defer db.Close()
+
+	e := newExporter("postgresql://pgpool@localhost:9999/postgres", append(opts, WithDB(db))...)
+	version, err := QueryVersion(context.Background(), e.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.version = version
+
+	c := &namespaceCollector{e: e, namespace: namespace}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	families := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+	return families, c.nonfatal, c.err
+}
+
+func loadFixtures(t *testing.T, version string) testutil.Fixtures {
+	t.Helper()
+
+	fixtures, err := testutil.LoadFixtures(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fixtures
+}
+
+// Whether got equals want up to the rounding of the unit conversions
+func approxEqual(got, want float64) bool {
+	return math.Abs(got-want) < 1e-9
+}
+
+func TestQueryNamespaceMappingPoolNodes(t *testing.T) {
+	families, nonfatal, err := queryFixtures(t, loadFixtures(t, "4.4"), "pool_nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nonfatal) > 0 {
+		t.Fatalf("unexpected errors: %v", nonfatal)
+	}
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}{
+		{"pgpool2_pool_nodes_status", map[string]string{"hostname": "pg1"}, 1},
+		{"pgpool2_pool_nodes_status", map[string]string{"hostname": "pg3"}, 0},
+		{"pgpool2_pool_nodes_status_code", map[string]string{"hostname": "pg3", "state": "down"}, 1},
+		{"pgpool2_pool_nodes_status_code", map[string]string{"hostname": "pg3", "state": "up"}, 0},
+		{"pgpool2_pool_nodes_pg_status", map[string]string{"hostname": "pg2"}, 1},
+		{"pgpool2_pool_nodes_lb_weight", map[string]string{"hostname": "pg2"}, 0.5},
+		{"pgpool2_pool_nodes_load_balance_node", map[string]string{"hostname": "pg2"}, 1},
+		{"pgpool2_pool_nodes_select_total", map[string]string{"hostname": "pg1"}, 1043},
+		{"pgpool2_pool_nodes_replication_delay", map[string]string{"hostname": "pg2"}, 0.012},
+		{"pgpool2_pool_nodes_replication_sync_state", map[string]string{"hostname": "pg2"}, 1},
+		// Only the backends which are up are counted.
+		{"pgpool2_primary_nodes", nil, 1},
+		{"pgpool2_standby_nodes", nil, 1},
+	}
+
+	for _, test := range tests {
+		got, ok := seriesValue(families[test.name], test.labels)
+		if !ok {
+			t.Errorf("%s%v not exported", test.name, test.labels)
+			continue
+		}
+		if !approxEqual(got, test.want) {
+			t.Errorf("%s%v = %v, want %v", test.name, test.labels, got, test.want)
+		}
+	}
+}
+
+func TestQueryNamespaceMappingReplicationDelayBytes(t *testing.T) {
+	// Without delay_threshold_by_time, the delay is in bytes of WAL.
+	fixtures := loadFixtures(t, "3.7")
+	fixtures.Add("SHOW pool_nodes;", &testutil.Result{
+		Columns: []string{"node_id", "hostname", "port", "status", "lb_weight", "role", "select_cnt", "load_balance_node", "replication_delay"},
+		Rows: [][]string{
+			{"0", "pg1", "5432", "up", "0.500000", "primary", "1043", "false", "0"},
+			{"1", "pg2", "5432", "up", "0.500000", "standby", "987", "true", "16384"},
+		},
+	})
+	families, nonfatal, err := queryFixtures(t, fixtures, "pool_nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nonfatal) > 0 {
+		t.Fatalf("unexpected errors: %v", nonfatal)
+	}
+
+	if got, ok := seriesValue(families["pgpool2_pool_nodes_replication_delay_bytes"], map[string]string{"hostname": "pg2"}); !ok || got != 16384 {
+		t.Errorf("pgpool2_pool_nodes_replication_delay_bytes{hostname=pg2} = %v (exported: %v), want 16384", got, ok)
+	}
+	if _, ok := seriesValue(families["pgpool2_pool_nodes_replication_delay"], map[string]string{"hostname": "pg2"}); ok {
+		t.Error("delay in bytes exported as pgpool2_pool_nodes_replication_delay")
+	}
+	// No delay is no delay in any unit.
+	for _, name := range []string{"pgpool2_pool_nodes_replication_delay", "pgpool2_pool_nodes_replication_delay_bytes"} {
+		if got, ok := seriesValue(families[name], map[string]string{"hostname": "pg1"}); !ok || got != 0 {
+			t.Errorf("%s{hostname=pg1} = %v (exported: %v), want 0", name, got, ok)
+		}
+	}
+}
+
+func TestQueryNamespaceMappingPoolPools(t *testing.T) {
+	families, nonfatal, err := queryFixtures(t, loadFixtures(t, "4.2"), "pool_pools")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nonfatal) > 0 {
+		t.Fatalf("unexpected errors: %v", nonfatal)
+	}
+
+	// Two child processes with a slot per backend, one of them connected
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}{
+		{"pgpool2_backend_total", nil, 4},
+		{"pgpool2_backend_used", nil, 2},
+		{"pgpool2_backend_used_ratio", nil, 0.5},
+		{"pgpool2_backend_by_node_total", map[string]string{"backend_id": "0", "hostname": "pg1"}, 2},
+		{"pgpool2_backend_by_node_used", map[string]string{"backend_id": "1", "hostname": "pg2"}, 1},
+		{"pgpool2_backend_by_process_total", map[string]string{"pool_pid": "2045"}, 2},
+		{"pgpool2_backend_by_process_used_ratio", map[string]string{"pool_pid": "2045"}, 1},
+		{"pgpool2_backend_by_database_used", map[string]string{"database": "postgres"}, 2},
+	}
+
+	for _, test := range tests {
+		got, ok := seriesValue(families[test.name], test.labels)
+		if !ok {
+			t.Errorf("%s%v not exported", test.name, test.labels)
+			continue
+		}
+		if !approxEqual(got, test.want) {
+			t.Errorf("%s%v = %v, want %v", test.name, test.labels, got, test.want)
+		}
+	}
+
+	// The idle process has no database to break down.
+	if _, ok := seriesValue(families["pgpool2_backend_by_process_used"], map[string]string{"pool_pid": "2047"}); ok {
+		t.Error("pgpool2_backend_by_process_used exported for a process without connections")
+	}
+}
+
+func TestQueryNamespaceMappingDurations(t *testing.T) {
+	families, nonfatal, err := queryFixtures(t, loadFixtures(t, "4.2"), "pool_health_check_stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nonfatal) > 0 {
+		t.Fatalf("unexpected errors: %v", nonfatal)
+	}
+
+	// Pgpool-II reports the durations in milliseconds.
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}{
+		{"pgpool2_pool_health_check_stats_max_duration_seconds", map[string]string{"hostname": "pg2"}, 20.011},
+		{"pgpool2_pool_health_check_stats_min_duration_seconds", map[string]string{"hostname": "pg1"}, 0.002},
+		{"pgpool2_pool_health_check_stats_average_duration_seconds", map[string]string{"hostname": "pg2"}, 0.017043},
+		{"pgpool2_pool_health_check_stats_last_failed_health_check_timestamp_seconds", map[string]string{"hostname": "pg2"}, 1709293710},
+		// Never failed
+		{"pgpool2_pool_health_check_stats_last_failed_health_check_timestamp_seconds", map[string]string{"hostname": "pg1"}, 0},
+	}
+
+	for _, test := range tests {
+		got, ok := seriesValue(families[test.name], test.labels)
+		if !ok {
+			t.Errorf("%s%v not exported", test.name, test.labels)
+			continue
+		}
+		if !approxEqual(got, test.want) {
+			t.Errorf("%s%v = %v, want %v", test.name, test.labels, got, test.want)
+		}
+	}
+}
+
+func TestQueryNamespaceMappingErrors(t *testing.T) {
+	nodes := &testutil.Result{
+		Columns: []string{"node_id", "hostname", "port", "status", "lb_weight", "role", "select_cnt", "load_balance_node", "replication_delay"},
+		Rows: [][]string{
+			{"0", "pg1", "5432", "up", "0.500000", "primary", "1043", "false", "0"},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		result *testutil.Result
+		// Whether the namespace fails
+		err bool
+		// Number of nonfatal errors, each satisfying check
+		nonfatal int
+		check    func(error) bool
+	}{
+		{
+			name:   "query error",
+			result: &testutil.Result{Err: errors.New("ERROR:  permission denied")},
+			err:    true,
+		},
+		{
+			name: "missing column",
+			result: &testutil.Result{
+				Columns: nodes.Columns[:len(nodes.Columns)-1],
+				Rows:    [][]string{nodes.Rows[0][:len(nodes.Rows[0])-1]},
+			},
+			check:    func(err error) bool { return errors.Is(err, errMissingColumn) },
+			nonfatal: 1,
+		},
+		{
+			name: "unparsable value",
+			result: &testutil.Result{
+				Columns: nodes.Columns,
+				Rows:    [][]string{{"0", "pg1", "5432", "up", "0.500000", "primary", "many", "false", "0"}},
+			},
+			check: func(err error) bool {
+				var perr *parseError
+				return errors.As(err, &perr) && perr.column == "select_cnt"
+			},
+			nonfatal: 1,
+		},
+		{
+			name:   "valid",
+			result: nodes,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fixtures := loadFixtures(t, "3.7")
+			fixtures.Add("SHOW pool_nodes", test.result)
+
+			_, nonfatal, err := queryFixtures(t, fixtures, "pool_nodes")
+			if (err != nil) != test.err {
+				t.Fatalf("err = %v, want error %v", err, test.err)
+			}
+			if len(nonfatal) != test.nonfatal {
+				t.Fatalf("nonfatal errors = %v, want %d", nonfatal, test.nonfatal)
+			}
+			for _, err := range nonfatal {
+				if !test.check(err) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryNamespaceMappingPoolProcesses(t *testing.T) {
+	type series struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}
+	// Reported in both formats
+	common := []series{
+		{"pgpool2_frontend_used", map[string]string{"username": "app", "database": "postgres"}, 1},
+		{"pgpool2_connections_by_database", map[string]string{"database": "postgres"}, 1},
+	}
+
+	tests := []struct {
+		version string
+		want    []series
+		// Not exported from the result of this version
+		absent []string
+	}{
+		// Before 4.2, one row per child process without the client
+		{
+			version: "3.7",
+			want: []series{
+				{"pgpool2_frontend_total", nil, 2},
+				{"pgpool2_frontend_used_ratio", nil, 0.5},
+				{"pgpool2_frontend_saturation_ratio", nil, 1.0 / 32},
+			},
+			absent: []string{"pgpool2_frontend_by_status", "pgpool2_frontend_connections"},
+		},
+		{
+			version: "4.1",
+			want: []series{
+				{"pgpool2_frontend_total", nil, 2},
+				{"pgpool2_frontend_used_ratio", nil, 0.5},
+				{"pgpool2_frontend_saturation_ratio", nil, 1.0 / 32},
+			},
+			absent: []string{"pgpool2_frontend_by_status", "pgpool2_frontend_connections"},
+		},
+		// Since 4.2, with the status, client and statement of each process
+		{
+			version: "4.2",
+			want: []series{
+				{"pgpool2_frontend_total", nil, 3},
+				{"pgpool2_frontend_saturation_ratio", nil, 2.0 / 32},
+				{"pgpool2_frontend_used", map[string]string{"username": "app", "database": "orders"}, 1},
+				{"pgpool2_frontend_by_status", map[string]string{"status": "Idle"}, 1},
+				{"pgpool2_frontend_by_status", map[string]string{"status": "Execute command"}, 1},
+				{"pgpool2_frontend_by_status", map[string]string{"status": "Wait for connection"}, 1},
+				{"pgpool2_frontend_connections", map[string]string{"client_host": "10.0.0.21"}, 1},
+				{"pgpool2_frontend_connections", map[string]string{"client_host": "10.0.0.22"}, 1},
+			},
+		},
+		{
+			version: "4.6",
+			want: []series{
+				{"pgpool2_frontend_total", nil, 3},
+				{"pgpool2_frontend_by_status", map[string]string{"status": "Idle"}, 1},
+				{"pgpool2_frontend_connections", map[string]string{"client_host": "10.0.0.22"}, 1},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.version, func(t *testing.T) {
+			families, nonfatal, err := queryFixtures(t, loadFixtures(t, test.version), "pool_processes", WithFrontendClientHosts(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(nonfatal) > 0 {
+				t.Fatalf("unexpected errors: %v", nonfatal)
+			}
+
+			for _, s := range append(append([]series{}, common...), test.want...) {
+				got, ok := seriesValue(families[s.name], s.labels)
+				if !ok {
+					t.Errorf("%s%v not exported", s.name, s.labels)
+					continue
+				}
+				if !approxEqual(got, s.want) {
+					t.Errorf("%s%v = %v, want %v", s.name, s.labels, got, s.want)
+				}
+			}
+			for _, name := range test.absent {
+				if _, ok := families[name]; ok {
+					t.Errorf("%s exported", name)
+				}
+			}
+
+			// Idle processes have no client host.
+			if _, ok := seriesValue(families["pgpool2_frontend_connections"], map[string]string{"client_host": ""}); ok {
+				t.Error("pgpool2_frontend_connections exported for an empty client host")
+			}
+		})
+	}
+}
+
+func TestQueryNamespaceMappingPoolProcessesMissingColumns(t *testing.T) {
+	// A 4.2 result without the columns added by 4.2
+	fixtures := loadFixtures(t, "4.2")
+	fixtures.Add("SHOW pool_processes", &testutil.Result{
+		Columns: []string{"pool_pid", "start_time", "database", "username", "create_time", "pool_counter"},
+		Rows: [][]string{
+			{"2045", "2024-03-01 09:12:40", "postgres", "app", "2024-03-01 09:13:02", "3"},
+		},
+	})
+
+	_, nonfatal, err := queryFixtures(t, fixtures, "pool_processes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, column := range []string{"status", "client_host"} {
+		found := false
+		for _, err := range nonfatal {
+			if errors.Is(err, errMissingColumn) && strings.HasSuffix(err.Error(), " "+column) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("missing %s column not reported: %v", column, nonfatal)
+		}
+	}
+}
+
+// Pgpool-II server answering the SHOW commands with the recorded outputs of
+// a version over the PostgreSQL protocol
+type fakePgpool struct {
+	listener net.Listener
+	fixtures testutil.Fixtures
+
+	mutex sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func startFakePgpool(t *testing.T, version string) *fakePgpool {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakePgpool{
+		listener: listener,
+		fixtures: loadFixtures(t, version),
+		conns:    map[net.Conn]struct{}{},
+	}
+	t.Cleanup(s.stop)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mutex.Lock()
+			s.conns[conn] = struct{}{}
+			s.mutex.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakePgpool) addr() string {
+	return s.listener.Addr().String()
+}
+
+// Stop accepting connections and close the established ones, as when the
+// pod running Pgpool-II goes away.
+func (s *fakePgpool) stop() {
+	s.listener.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *fakePgpool) serve(conn net.Conn) {
+	defer conn.Close()
+	backend := pgproto3.NewBackend(conn, conn)
+
+	msg, err := backend.ReceiveStartupMessage()
+	if _, ok := msg.(*pgproto3.SSLRequest); ok {
+		if _, err := conn.Write([]byte("N")); err != nil {
+			return
+		}
+		msg, err = backend.ReceiveStartupMessage()
+	}
+	if _, ok := msg.(*pgproto3.StartupMessage); !ok || err != nil {
+		return
+	}
+	backend.Send(&pgproto3.AuthenticationOk{})
+	backend.Send(&pgproto3.ParameterStatus{Name: "client_encoding", Value: "UTF8"})
+	backend.Send(&pgproto3.ParameterStatus{Name: "standard_conforming_strings", Value: "on"})
+	backend.Send(&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1})
+	backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	if err := backend.Flush(); err != nil {
+		return
+	}
+
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+		query, ok := msg.(*pgproto3.Query)
+		if !ok {
+			return
+		}
+
+		result, ok := s.fixtures.Lookup(query.String)
+		switch {
+		case !ok:
+			backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42601", Message: "unrecognized SHOW command"})
+		case result.Err != nil:
+			backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "XX000", Message: result.Err.Error()})
+		default:
+			fields := make([]pgproto3.FieldDescription, len(result.Columns))
+			for i, column := range result.Columns {
+				fields[i] = pgproto3.FieldDescription{Name: []byte(column), DataTypeOID: 25, DataTypeSize: -1, TypeModifier: -1}
+			}
+			backend.Send(&pgproto3.RowDescription{Fields: fields})
+			for _, row := range result.Rows {
+				values := make([][]byte, len(row))
+				for i, value := range row {
+					values[i] = []byte(value)
+				}
+				backend.Send(&pgproto3.DataRow{Values: values})
+			}
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("SHOW")})
+		}
+		backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		if err := backend.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// Name server stub resolving the host names of the DSN on every dial
+type stubResolver struct {
+	mutex sync.Mutex
+	hosts map[string]string
+	// Addresses dialed, in order
+	dialed []string
+}
+
+func (r *stubResolver) set(host string, addr string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.hosts[host] = addr
+}
+
+func (r *stubResolver) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	addr, ok := r.hosts[host]
+	r.dialed = append(r.dialed, addr)
+	r.mutex.Unlock()
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func (r *stubResolver) lastDialed() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.dialed) == 0 {
+		return ""
+	}
+	return r.dialed[len(r.dialed)-1]
+}
+
+// DSN of the Pgpool-II service which moves between the fake servers
+const serviceDSN = "postgresql://pgpool@pgpool.default.svc:9999/postgres?sslmode=disable"
+
+func TestConnectResolvesOnEveryConnect(t *testing.T) {
+	for _, driver := range []string{"pgx", "postgres"} {
+		t.Run(driver, func(t *testing.T) {
+			old := startFakePgpool(t, "4.2")
+			resolver := &stubResolver{hosts: map[string]string{"pgpool.default.svc": old.addr()}}
+			e := newExporter(serviceDSN, WithDialer(resolver.dial), WithDriver(driver))
+
+			db, err := e.connect(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if v, err := QueryVersion(context.Background(), db); err != nil || v.String() != "4.2.15" {
+				t.Fatalf("version = %v, %v, want 4.2.15 from the first address", v, err)
+			}
+
+			// Failover to a new pod: the name now resolves to another address
+			// and the old one is gone.
+			moved := startFakePgpool(t, "4.4")
+			resolver.set("pgpool.default.svc", moved.addr())
+			old.stop()
+
+			// The handle either fails or replaces its broken connection,
+			// resolving the name again.
+			if v, err := QueryVersion(context.Background(), db); err == nil && v.String() != "4.4.7" {
+				t.Errorf("version = %v, want 4.4.7 from the new address", v)
+			}
+			db.Close()
+
+			db, err = e.connect(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if got := resolver.lastDialed(); got != moved.addr() {
+				t.Errorf("dialed %s, want the new address %s", got, moved.addr())
+			}
+			if v, err := QueryVersion(context.Background(), db); err != nil || v.String() != "4.4.7" {
+				t.Errorf("version = %v, %v, want 4.4.7 from the new address", v, err)
+			}
+		})
+	}
+}
+
+// Scrape exporter and return the short version exported by
+// pgpool2_version_info, if any, and the value of pgpool2_up.
+func scrapeVersion(t *testing.T, registry *prometheus.Registry) (string, float64) {
+	t.Helper()
+
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var version string
+	var up float64
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case "pgpool2_version_info":
+			for _, label := range mf.GetMetric()[0].GetLabel() {
+				if label.GetName() == "short_version" {
+					version = label.GetValue()
+				}
+			}
+		case "pgpool2_up":
+			up = mf.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	return version, up
+}
+
+func TestScrapeReconnectsToNewAddress(t *testing.T) {
+	old := startFakePgpool(t, "4.2")
+	resolver := &stubResolver{hosts: map[string]string{"pgpool.default.svc": old.addr()}}
+
+	e := newExporter(serviceDSN, WithDialer(resolver.dial))
+	defer e.Close()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(e)
+
+	if version, up := scrapeVersion(t, registry); version != "4.2" || up != 1 {
+		t.Fatalf("version %q, up %v before the failover, want 4.2 and 1", version, up)
+	}
+
+	moved := startFakePgpool(t, "4.4")
+	resolver.set("pgpool.default.svc", moved.addr())
+	old.stop()
+
+	// The ping of the old connection fails, and the exporter reconnects to
+	// the new address in the same scrape.
+	if version, up := scrapeVersion(t, registry); version != "4.4" || up != 1 {
+		t.Errorf("version %q, up %v after the failover, want 4.4 and 1", version, up)
+	}
+	if got := resolver.lastDialed(); got != moved.addr() {
+		t.Errorf("dialed %s, want the new address %s", got, moved.addr())
+	}
+}
+
+func TestScrapeRenewsConnectionsToOldAddress(t *testing.T) {
+	const lifetime = 50 * time.Millisecond
+
+	// The old pod keeps answering, e.g. while it drains its connections.
+	old := startFakePgpool(t, "4.2")
+	resolver := &stubResolver{hosts: map[string]string{"pgpool.default.svc": old.addr()}}
+
+	e := newExporter(serviceDSN, WithDialer(resolver.dial), WithConnectionLimits(0, 0, lifetime))
+	defer e.Close()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(e)
+
+	if _, up := scrapeVersion(t, registry); up != 1 {
+		t.Fatalf("up = %v, want 1", up)
+	}
+
+	moved := startFakePgpool(t, "4.4")
+	resolver.set("pgpool.default.svc", moved.addr())
+	time.Sleep(2 * lifetime)
+
+	scrapeVersion(t, registry)
+	if got := resolver.lastDialed(); got != moved.addr() {
+		t.Errorf("dialed %s after the connection lifetime, want the new address %s", got, moved.addr())
+	}
+}
+
+func TestStatusDuringReconnect(t *testing.T) {
+	server := startFakePgpool(t, "4.2")
+	resolver := &stubResolver{hosts: map[string]string{"pgpool.default.svc": server.addr()}}
+
+	e := newExporter(serviceDSN, WithDialer(resolver.dial), WithReconnectBackoff(time.Millisecond, time.Millisecond))
+	defer e.Close()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(e)
+
+	// The status is queried while every scrape replaces the connection.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if status := e.status(context.Background()); status.Instance != "pgpool.default.svc:9999" {
+				t.Errorf("status of %q, want pgpool.default.svc:9999", status.Instance)
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		moved := startFakePgpool(t, "4.2")
+		resolver.set("pgpool.default.svc", moved.addr())
+		server.stop()
+		server = moved
+		scrapeVersion(t, registry)
+	}
+	close(done)
+	wg.Wait()
+}
+
+// SHOW pool_pools result of processes child processes with pools
+// connection pools of backends backends each, in the 4.2 format.
+func largePoolPools(processes, pools, backends int) *testutil.Result {
+	result := &testutil.Result{
+		Columns: []string{"pool_pid", "start_time", "client_connection_count", "pool_id", "backend_id", "database", "username", "backend_connection_time", "client_connection_time", "client_disconnection_time", "client_idle_duration", "majorversion", "minorversion", "pool_counter", "pool_backendpid", "pool_connected"},
+	}
+	for pid := 0; pid < processes; pid++ {
+		for pool := 0; pool < pools; pool++ {
+			for backend := 0; backend < backends; backend++ {
+				row := []string{strconv.Itoa(2000 + pid), "2024-03-01 09:12:40 (4:35 before process restarting)", "12", strconv.Itoa(pool), strconv.Itoa(backend), "", "", "", "", "", "0", "0", "0", "0", "0", "0"}
+				// Half of the pools in use
+				if pool%2 == 0 {
+					copy(row[5:], []string{"db" + strconv.Itoa(pool), "app", "2024-03-01 09:13:02", "2024-03-01 09:20:11", "", "0", "3", "0", "3", strconv.Itoa(30000 + pid), "1"})
+				}
+				result.Rows = append(result.Rows, row)
+			}
+		}
+	}
+	return result
+}
+
+func BenchmarkPoolPools(b *testing.B) {
+	fixtures, err := testutil.LoadFixtures("4.2")
+	if err != nil {
+		b.Fatal(err)
+	}
+	// 2000 child processes with 4 pools of 2 backends: 16000 rows
+	fixtures.Add("SHOW pool_pools", largePoolPools(2000, 4, 2))
+	db := testutil.NewDB(fixtures)
+	defer db.Close()
+
+	e := newExporter("postgresql://pgpool@localhost:9999/postgres", WithDB(db))
+	if e.version, err = QueryVersion(context.Background(), e.DB); err != nil {
+		b.Fatal(err)
+	}
+	mapping := e.metricMap["pool_pools"]
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ch := make(chan prometheus.Metric)
+		done := make(chan struct{})
+		go func() {
+			for range ch {
+			}
+			close(done)
+		}()
+
+		nonfatal, err := e.queryNamespaceMapping(context.Background(), ch, "pool_pools", mapping)
+		close(ch)
+		<-done
+		if err != nil || len(nonfatal) > 0 {
+			b.Fatal(err, nonfatal)
+		}
+	}
+}
+
+func TestNamespaceAndConstLabels(t *testing.T) {
+	families := gatherFixtures(t, "4.4", WithNamespace("pgpool"), WithConstLabels(prometheus.Labels{"cluster": "main"}))
+
+	if _, ok := seriesValue(families["pgpool_pool_status_info"], map[string]string{"parameter": "load_balance_mode", "cluster": "main"}); !ok {
+		t.Error("pgpool_pool_status_info{cluster=\"main\"} not exported")
+	}
+	for name, mf := range families {
+		if !strings.HasPrefix(name, "pgpool_") {
+			t.Errorf("%s exported without the namespace", name)
+		}
+		for _, m := range mf.GetMetric() {
+			found := false
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "cluster" && label.GetValue() == "main" {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%s%v exported without the constant labels", name, m.GetLabel())
+			}
+		}
+	}
+}
+
+func TestCounterAccumulatorKey(t *testing.T) {
+	a := newCounterAccumulator("")
+	a.load(nil)
+
+	counter := func(help string, value float64, labels prometheus.Labels) float64 {
+		desc := prometheus.NewDesc("pgpool2_pool_nodes_select_total", help, nil, labels)
+		var metric dto.Metric
+		if err := a.adjust("pgpool:9999", prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value)).Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+
+	counter("SELECT statements", 10, prometheus.Labels{"node_id": "0", "env": "prod"})
+	// Reworded help text, reset by a Pgpool-II restart.
+	if got := counter("SELECT statements dispatched to the backend", 3, prometheus.Labels{"env": "prod", "node_id": "0"}); got != 13 {
+		t.Errorf("got %v after the help text changed, want 13", got)
+	}
+	if got := counter("SELECT statements", 3, prometheus.Labels{"node_id": "1", "env": "prod"}); got != 3 {
+		t.Errorf("got %v for another backend, want 3", got)
+	}
+}
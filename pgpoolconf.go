@@ -0,0 +1,286 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PgpoolConf holds the parameters of a pgpool.conf file, by name.
+type PgpoolConf map[string]string
+
+// LoadPgpoolConf reads the pgpool.conf file at path.
+func LoadPgpoolConf(path string) (PgpoolConf, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintln("Error reading pgpool.conf:", err))
+	}
+	defer f.Close()
+
+	conf := make(PgpoolConf)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		name, value, ok, err := parsePgpoolConfLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s line %d: %s", path, line, err)
+		}
+		if ok {
+			conf[name] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.New(fmt.Sprintln("Error reading pgpool.conf:", err))
+	}
+
+	return conf, nil
+}
+
+// Parse a "name = value" line of pgpool.conf. The "=" is optional, values
+// may be single-quoted, with quotes inside doubled or escaped with a
+// backslash, and "#" starts a comment outside quotes.
+func parsePgpoolConfLine(line string) (string, string, bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false, nil
+	}
+
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return "", "", false, fmt.Errorf("missing value of %s", line)
+	}
+	name := strings.ToLower(line[:end])
+	rest := strings.TrimSpace(line[end:])
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, "="))
+
+	if !strings.HasPrefix(rest, "'") {
+		value, _, _ := strings.Cut(rest, "#")
+		return name, strings.TrimSpace(value), true, nil
+	}
+
+	var value strings.Builder
+	for i := 1; i < len(rest); i++ {
+		switch {
+		case rest[i] == '\\' && i+1 < len(rest):
+			i++
+			value.WriteByte(rest[i])
+		case rest[i] == '\'' && i+1 < len(rest) && rest[i+1] == '\'':
+			i++
+			value.WriteByte('\'')
+		case rest[i] == '\'':
+			return name, value.String(), true, nil
+		default:
+			value.WriteByte(rest[i])
+		}
+	}
+	return "", "", false, fmt.Errorf("unterminated quoted value of %s", name)
+}
+
+// Bool returns the boolean parameter name, or def if it is not set.
+func (c PgpoolConf) Bool(name string, def bool) bool {
+	switch strings.ToLower(c[name]) {
+	case "on", "true", "yes", "1":
+		return true
+	case "off", "false", "no", "0":
+		return false
+	}
+	return def
+}
+
+// Port returns the port Pgpool-II listens on.
+func (c PgpoolConf) Port() string {
+	if port := c["port"]; port != "" {
+		return port
+	}
+	return "9999"
+}
+
+// SocketDir returns the directory of the Unix domain socket of Pgpool-II:
+// the first of unix_socket_directories, or socket_dir before Pgpool-II 4.3.
+func (c PgpoolConf) SocketDir() string {
+	if dirs, ok := c["unix_socket_directories"]; ok {
+		dir, _, _ := strings.Cut(dirs, ",")
+		return strings.TrimSpace(dir)
+	}
+	if dir, ok := c["socket_dir"]; ok {
+		return dir
+	}
+	return "/tmp"
+}
+
+// A backend defined in pgpool.conf
+type pgpoolConfBackend struct {
+	id       string
+	hostname string
+	port     string
+	weight   string
+	flag     string
+}
+
+// The backends defined with backend_hostname<N>, sorted by node id
+func (c PgpoolConf) backends() []pgpoolConfBackend {
+	var backends []pgpoolConfBackend
+	for name, hostname := range c {
+		id, ok := strings.CutPrefix(name, "backend_hostname")
+		if !ok {
+			continue
+		}
+		if _, err := strconv.Atoi(id); err != nil {
+			continue
+		}
+		backends = append(backends, pgpoolConfBackend{
+			id:       id,
+			hostname: hostname,
+			port:     c["backend_port"+id],
+			weight:   c["backend_weight"+id],
+			flag:     c["backend_flag"+id],
+		})
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		a, _ := strconv.Atoi(backends[i].id)
+		b, _ := strconv.Atoi(backends[j].id)
+		return a < b
+	})
+	return backends
+}
+
+// Apply configures the connection to Pgpool-II and the collectors from
+// pgpool.conf, where nothing else is configured: the DSN connects through
+// the Unix domain socket of Pgpool-II unless cfg, which may be nil, or
+// DATA_SOURCE_NAME give one, the pool_cache collector follows
+// memory_cache_enabled and pool_health_check_stats health_check_period,
+// unless set on the command line, in the environment or in cfg. It returns
+// the resulting config.
+func (c PgpoolConf) Apply(cfg *Config) *Config {
+	cfg = c.applyDataSource(cfg)
+
+	collectors := map[string]bool{
+		"pool_cache":              c.Bool("memory_cache_enabled", false),
+		"pool_health_check_stats": c["health_check_period"] != "" && c["health_check_period"] != "0",
+	}
+	for name, enabled := range collectors {
+		if _, ok := cfg.Collectors[name]; ok || *collectorSetByUser[name] || envarSet("collector."+name) {
+			continue
+		}
+		*collectorState[name] = enabled
+	}
+
+	return cfg
+}
+
+// Connect through the Unix domain socket of Pgpool-II, unless cfg, which may
+// be nil, or DATA_SOURCE_NAME give a DSN.
+func (c PgpoolConf) applyDataSource(cfg *Config) *Config {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	ds := &cfg.DataSource
+	if _, ok := os.LookupEnv("DATA_SOURCE_NAME"); !ok && ds.DSN == "" && ds.URI == "" && len(ds.DSNs) == 0 {
+		ds.URI = c.SocketDir() + ":" + c.Port() + "/postgres"
+	}
+
+	return cfg
+}
+
+// Parameters of pgpool.conf exported as labels of pgpool2_config_info
+var pgpoolConfInfo = []string{
+	"port",
+	"backend_clustering_mode",
+	"num_init_children",
+	"max_pool",
+	"ssl",
+	"load_balance_mode",
+	"memory_cache_enabled",
+	"health_check_period",
+	"use_watchdog",
+	"failover_on_backend_error",
+}
+
+// NewPgpoolConfCollector returns a collector of the settings of the
+// pgpool.conf file at path, read again on every scrape. Read errors are
+// logged to logger.
+func NewPgpoolConfCollector(path string, logger log.Logger) prometheus.Collector {
+	return &pgpoolConfCollector{
+		path:   path,
+		logger: logger,
+		info: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "config", "info"),
+			"Settings of pgpool.conf.",
+			append([]string{"socket_dir"}, pgpoolConfInfo...), nil,
+		),
+		backend: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "config", "backend_info"),
+			"Backends defined in pgpool.conf.",
+			[]string{"node_id", "hostname", "port", "weight", "flag"}, nil,
+		),
+		up: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "config", "up"),
+			"Whether pgpool.conf could be read (1 for yes, 0 for no).",
+			nil, nil,
+		),
+	}
+}
+
+type pgpoolConfCollector struct {
+	path    string
+	logger  log.Logger
+	info    *prometheus.Desc
+	backend *prometheus.Desc
+	up      *prometheus.Desc
+}
+
+func (c *pgpoolConfCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.info
+	ch <- c.backend
+	ch <- c.up
+}
+
+func (c *pgpoolConfCollector) Collect(ch chan<- prometheus.Metric) {
+	conf, err := LoadPgpoolConf(c.path)
+	if err != nil {
+		level.Error(c.logger).Log("msg", "Error reading pgpool.conf", "err", err)
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 1)
+
+	values := []string{conf.SocketDir()}
+	for _, name := range pgpoolConfInfo {
+		values = append(values, conf[name])
+	}
+	ch <- prometheus.MustNewConstMetric(c.info, prometheus.GaugeValue, 1, values...)
+
+	for _, b := range conf.backends() {
+		ch <- prometheus.MustNewConstMetric(c.backend, prometheus.GaugeValue, 1, b.id, b.hostname, b.port, b.weight, b.flag)
+	}
+}
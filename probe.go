@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ProbeHandler returns a handler which scrapes the Pgpool-II instance given
+// in the "target" query parameter, a "host:port" pair. User, password,
+// database and connection options are taken from the first of dsns. The credentials of
+// the auth module of modules named by the "auth_module" query parameter, if
+// any, replace those of the target. Without an auth module, only the addresses
+// of dsns and those matching --probe.allowed-targets are probed, and with
+// one, only those matching its targets, so that no credentials are sent to
+// any host a client names.
+// labels are added to every metric, and opts configure the exporter of every
+// probe, including its logger.
+func ProbeHandler(dsns []string, allowedTargets []string, modules map[string]AuthModule, labels prometheus.Labels, opts ...Option) http.HandlerFunc {
+	allowed := make([]string, 0, len(dsns)+len(allowedTargets))
+	for _, dsn := range dsns {
+		allowed = append(allowed, DSNLabel(dsn))
+	}
+	allowed = append(allowed, allowedTargets...)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+
+		dsn, err := targetDSN(dsns[0], target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var module *AuthModule
+		if name := r.URL.Query().Get("auth_module"); name != "" {
+			m, ok := modules[name]
+			if !ok {
+				http.Error(w, fmt.Sprintf("unknown auth_module %q", name), http.StatusBadRequest)
+				return
+			}
+			module = &m
+		}
+		switch {
+		case module == nil && !targetAllowed(allowed, DSNLabel(dsn)):
+			http.Error(w, fmt.Sprintf("target %s is not allowed: list it in --probe.allowed-targets or select an auth_module", DSNLabel(dsn)), http.StatusForbidden)
+			return
+		case module != nil:
+			if err := module.checkAddress(dsn); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+
+		// The connection is established on the first scrape, so an
+		// unreachable target is reported as pgpool2_up 0.
+		exporter := newExporter(dsn, opts...)
+		exporter.authModule = module
+		defer exporter.Close()
+		level.Debug(exporter.log(r.Context())).Log("msg", "Probing target", "target", MaskPassword(dsn), "auth_module", r.URL.Query().Get("auth_module"))
+
+		registry := prometheus.NewRegistry()
+		prometheus.WrapRegistererWith(labels, registry).MustRegister(probeCollector{exporter, r.Context()})
+
+		var gatherer prometheus.Gatherer = registry
+		if rules := RedactRules(); len(rules) > 0 {
+			gatherer, err = NewRelabelGatherer(registry, rules, []byte(*HashKey))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		h := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})
+		h.ServeHTTP(w, r)
+	}
+}
+
+// probeCollector wraps an Exporter as an unchecked collector, so registering
+// it does not run a full scrape just to describe the metrics. Queries are
+// cancelled when the probe request goes away.
+type probeCollector struct {
+	exporter *Exporter
+	ctx      context.Context
+}
+
+// Describe implements prometheus.Collector.
+func (c probeCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (c probeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.exporter.collect(c.ctx, ch)
+}
+
+// Build the DSN used to connect to a probe target, "host:port", from the
+// DSN of the data source. Complete DSNs are refused: they may name several
+// hosts, a hostaddr or a service, so that the credentials would be sent to
+// other hosts than the address checked against the allowed targets.
+func targetDSN(baseDSN string, target string) (string, error) {
+	if isURLDSN(target) || strings.ContainsAny(target, "=, \t\r\n") {
+		return "", fmt.Errorf("invalid target %q: must be host:port", target)
+	}
+
+	return setDSNHost(baseDSN, target)
+}
+
+// Whether address, "host:port", matches one of patterns, in which * and ?
+// are wildcards.
+func targetAllowed(patterns []string, address string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, address); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
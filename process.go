@@ -0,0 +1,176 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/procfs"
+)
+
+// Resource usage of the Pgpool-II processes of one role
+type processUsage struct {
+	count    float64
+	resident float64
+	cpu      float64
+	openFDs  float64
+}
+
+// Read the resource usage of a process from /proc.
+func (u *processUsage) add(proc procfs.Proc) (procfs.ProcStat, error) {
+	stat, err := proc.Stat()
+	if err != nil {
+		return stat, err
+	}
+	fds, err := proc.FileDescriptorsLen()
+	if err != nil {
+		return stat, err
+	}
+	u.count++
+	u.resident += float64(stat.ResidentMemory())
+	u.cpu += stat.CPUTime()
+	u.openFDs += float64(fds)
+	return stat, nil
+}
+
+// Query the PIDs of the child processes of Pgpool-II with "SHOW
+// pool_processes", and export the resource usage of the child processes and
+// of their parent process, by role.
+func (e *Exporter) collectProcess(ctx context.Context, ch chan<- prometheus.Metric) {
+	begun := time.Now()
+	usage, err := e.scrapeProcess(ctx)
+	if err != nil {
+		level.Error(e.log(ctx)).Log("msg", "Error reading Pgpool-II processes", "err", err)
+		e.scrapeErrors.WithLabelValues(errorType(err)).Inc()
+	}
+
+	labels := []string{"role"}
+	for role, u := range usage {
+		ch <- prometheus.MustNewConstMetric(
+			e.newDesc("process", "count", "Number of Pgpool-II processes read from /proc.", labels),
+			prometheus.GaugeValue,
+			u.count,
+			role,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			e.newDesc("process", "resident_memory_bytes", "Resident memory size of the Pgpool-II processes in bytes.", labels),
+			prometheus.GaugeValue,
+			u.resident,
+			role,
+		)
+		// Not a counter: the CPU time of child processes which exit is lost.
+		ch <- prometheus.MustNewConstMetric(
+			e.newDesc("process", "cpu_seconds", "User and system CPU time spent by the live Pgpool-II processes in seconds.", labels),
+			prometheus.GaugeValue,
+			u.cpu,
+			role,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			e.newDesc("process", "open_fds", "Number of open file descriptors of the Pgpool-II processes.", labels),
+			prometheus.GaugeValue,
+			u.openFDs,
+			role,
+		)
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		e.newDesc("process", "scrape_duration_seconds", "Duration of the last read of the Pgpool-II processes.", nil),
+		prometheus.GaugeValue,
+		time.Since(begun).Seconds(),
+	)
+}
+
+func (e *Exporter) scrapeProcess(ctx context.Context) (map[string]*processUsage, error) {
+	fs, err := procfs.NewFS(e.procfs)
+	if err != nil {
+		return nil, err
+	}
+
+	pids, err := e.childPIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := map[string]*processUsage{
+		"parent": {},
+		"child":  {},
+	}
+	parent := 0
+	for _, pid := range pids {
+		proc, err := fs.Proc(pid)
+		if err != nil {
+			// The process exited since "SHOW pool_processes", or runs on
+			// another host.
+			level.Debug(e.log(ctx)).Log("msg", "Error reading Pgpool-II child process", "pid", pid, "err", err)
+			continue
+		}
+		stat, err := usage["child"].add(proc)
+		if err != nil {
+			level.Debug(e.log(ctx)).Log("msg", "Error reading Pgpool-II child process", "pid", pid, "err", err)
+			continue
+		}
+		parent = stat.PPID
+	}
+
+	if len(pids) > 0 && usage["child"].count == 0 {
+		return usage, fmt.Errorf("none of the %d Pgpool-II child processes found in %s", len(pids), e.procfs)
+	}
+	if parent > 0 {
+		proc, err := fs.Proc(parent)
+		if err == nil {
+			_, err = usage["parent"].add(proc)
+		}
+		if err != nil {
+			return usage, fmt.Errorf("error reading Pgpool-II parent process %d: %w", parent, err)
+		}
+	}
+	return usage, nil
+}
+
+// The PIDs of the child processes listed by "SHOW pool_processes"
+func (e *Exporter) childPIDs(ctx context.Context) ([]int, error) {
+	rows, err := e.query(ctx, "pool_processes", "SHOW pool_processes;")
+	if err != nil {
+		return nil, fmt.Errorf("Error running query on database: %s %w", "pool_processes", err)
+	}
+	defer rows.Close()
+
+	var pids []int
+	for rows.Next() {
+		var value string
+		if err := scanColumns(rows, map[string]*string{"pool_pid": &value}); err != nil {
+			return nil, err
+		}
+		pid, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: pool_processes pool_pid %q", errParse, value)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, rows.Err()
+}
@@ -0,0 +1,284 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Pusher pushes the metrics of a Gatherer to a Prometheus Pushgateway, a
+// remote_write endpoint or an OpenTelemetry (OTLP/HTTP) endpoint, for
+// Pgpool-II hosts which Prometheus cannot scrape.
+type Pusher struct {
+	url      string
+	protocol string
+	job      string
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	logger   log.Logger
+	// Start of the cumulative OTLP sums
+	start time.Time
+	// Tag format of the statsd lines and last values of the counters
+	tagFormat string
+	previous  map[string]float64
+}
+
+// NewPusher returns a Pusher of the metrics of g to url with protocol:
+// "pushgateway" (under job, grouped by the host name as instance),
+// "remote-write" or "otlp" (url being the OTLP/HTTP metrics endpoint, e.g.
+// http://collector:4318/v1/metrics).
+func NewPusher(url string, protocol string, job string, g prometheus.Gatherer, logger log.Logger) (*Pusher, error) {
+	if protocol != "pushgateway" && protocol != "remote-write" && protocol != "otlp" {
+		return nil, fmt.Errorf("unknown push protocol: %q (must be pushgateway, remote-write or otlp)", protocol)
+	}
+	return &Pusher{
+		url:      url,
+		protocol: protocol,
+		job:      job,
+		gatherer: g,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		logger:   logger,
+		start:    time.Now(),
+	}, nil
+}
+
+// Run pushes the metrics every interval until ctx is done.
+func (p *Pusher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.Push(ctx); err != nil {
+			level.Error(p.logger).Log("msg", "Error pushing metrics", "url", MaskPassword(p.url), "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Push gathers the metrics and pushes them once.
+func (p *Pusher) Push(ctx context.Context) error {
+	if p.protocol == "pushgateway" {
+		instance, _ := os.Hostname()
+		return push.New(p.url, p.job).
+			Gatherer(p.gatherer).
+			Grouping("instance", instance).
+			Client(p.client).
+			PushContext(ctx)
+	}
+
+	mfs, err := p.gatherer.Gather()
+	if err != nil {
+		// Push the metrics gathered despite the error.
+		level.Warn(p.logger).Log("msg", "Error gathering metrics", "err", err)
+	}
+
+	if p.protocol == "statsd" {
+		return p.pushStatsd(mfs)
+	}
+
+	var body []byte
+	if p.protocol == "otlp" {
+		body, err = otlpRequest(mfs, p.start, time.Now())
+		if err != nil {
+			return err
+		}
+	} else {
+		body = snappyEncode(writeRequest(mfs, time.Now()))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "pgpool2_exporter")
+	if p.protocol == "otlp" {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s from %s endpoint: %s", resp.Status, p.protocol, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// Time series of a remote_write request or of a statsd sink
+type timeSeries struct {
+	labels    map[string]string
+	value     float64
+	timestamp int64
+	// Counter, or count of a histogram or summary
+	cumulative bool
+}
+
+// Split the metrics into time series, with the histograms and summaries
+// split into their series.
+func expandSeries(mfs []*dto.MetricFamily, now time.Time) []timeSeries {
+	var series []timeSeries
+
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			timestamp := now.UnixMilli()
+			if m.TimestampMs != nil {
+				timestamp = m.GetTimestampMs()
+			}
+			add := func(suffix string, value float64, cumulative bool, extra ...string) {
+				labels := map[string]string{"__name__": name + suffix}
+				for _, l := range m.Label {
+					labels[l.GetName()] = l.GetValue()
+				}
+				for i := 0; i+1 < len(extra); i += 2 {
+					labels[extra[i]] = extra[i+1]
+				}
+				series = append(series, timeSeries{labels, value, timestamp, cumulative})
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.Counter.GetValue(), true)
+			case dto.MetricType_GAUGE:
+				add("", m.Gauge.GetValue(), false)
+			case dto.MetricType_UNTYPED:
+				add("", m.Untyped.GetValue(), false)
+			case dto.MetricType_HISTOGRAM:
+				for _, b := range m.Histogram.Bucket {
+					add("_bucket", float64(b.GetCumulativeCount()), true, "le", formatFloat(b.GetUpperBound()))
+				}
+				add("_bucket", float64(m.Histogram.GetSampleCount()), true, "le", "+Inf")
+				add("_sum", m.Histogram.GetSampleSum(), true)
+				add("_count", float64(m.Histogram.GetSampleCount()), true)
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.Summary.Quantile {
+					add("", q.GetValue(), false, "quantile", formatFloat(q.GetQuantile()))
+				}
+				add("_sum", m.Summary.GetSampleSum(), true)
+				add("_count", float64(m.Summary.GetSampleCount()), true)
+			}
+		}
+	}
+
+	return series
+}
+
+// Encode the metrics as a remote_write WriteRequest protobuf message.
+func writeRequest(mfs []*dto.MetricFamily, now time.Time) []byte {
+	series := expandSeries(mfs, now)
+
+	// message WriteRequest { repeated TimeSeries timeseries = 1; }
+	// message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+	// message Label { string name = 1; string value = 2; }
+	// message Sample { double value = 1; int64 timestamp = 2; }
+	var request []byte
+	for _, s := range series {
+		names := make([]string, 0, len(s.labels))
+		for name := range s.labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var ts []byte
+		for _, name := range names {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, s.labels[name])
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, ts)
+	}
+
+	return request
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Encode src in the snappy block format required by remote_write, as
+// literals only: the requests are small, and this avoids a compression
+// library.
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+
+	for len(src) > 0 {
+		n := len(src)
+		if n > 65536 {
+			n = 65536
+		}
+		switch {
+		case n <= 60:
+			dst = append(dst, byte(n-1)<<2)
+		case n <= 256:
+			dst = append(dst, 60<<2, byte(n-1))
+		default:
+			dst = append(dst, 61<<2, byte(n-1), byte((n-1)>>8))
+		}
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+	}
+
+	return dst
+}
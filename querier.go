@@ -0,0 +1,350 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Rows is the result of a query. *sql.Rows implements it.
+type Rows interface {
+	Columns() ([]string, error)
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+	Close() error
+}
+
+// Querier runs the SHOW commands of the exporter on Pgpool-II.
+type Querier interface {
+	Query(ctx context.Context, query string) (Rows, error)
+	Close() error
+}
+
+// NewSQLQuerier returns a Querier running the queries on db.
+func NewSQLQuerier(db *sql.DB) Querier {
+	return &sqlQuerier{db}
+}
+
+type sqlQuerier struct {
+	db *sql.DB
+}
+
+func (q *sqlQuerier) Query(ctx context.Context, query string) (Rows, error) {
+	rows, err := q.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (q *sqlQuerier) Close() error {
+	return q.db.Close()
+}
+
+func (q *sqlQuerier) Stats() sql.DBStats {
+	return q.db.Stats()
+}
+
+// A Querier running the queries on a *sql.DB, whose connection pool
+// statistics are exported.
+type statsQuerier interface {
+	Stats() sql.DBStats
+}
+
+// Statistics of the pool of connections to Pgpool-II, to tell whether the
+// exporter leaks connections or waits for them. The counters carry on
+// across reconnections, which replace the *sql.DB.
+type dbStats struct {
+	open         prometheus.Gauge
+	inUse        prometheus.Gauge
+	idle         prometheus.Gauge
+	maxOpen      prometheus.Gauge
+	waitCount    prometheus.Counter
+	waitDuration prometheus.Counter
+
+	// The Querier of the last statistics, and their values
+	db   Querier
+	last sql.DBStats
+}
+
+func newDBStats(namespace string, constLabels prometheus.Labels) *dbStats {
+	gauge := func(name string, help string) prometheus.Gauge {
+		return prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   exporter,
+			Name:        "db_connections_" + name,
+			Help:        help,
+			ConstLabels: constLabels,
+		})
+	}
+	counter := func(name string, help string) prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   exporter,
+			Name:        "db_connections_" + name,
+			Help:        help,
+			ConstLabels: constLabels,
+		})
+	}
+	return &dbStats{
+		open:         gauge("open", "Number of connections to Pgpool-II open after the last scrape, in use or idle."),
+		inUse:        gauge("in_use", "Number of connections to Pgpool-II in use after the last scrape, which should be 0."),
+		idle:         gauge("idle", "Number of idle connections to Pgpool-II after the last scrape."),
+		maxOpen:      gauge("max_open", "Maximum number of connections to Pgpool-II (0 for no limit)."),
+		waitCount:    counter("wait_count", "Total number of times a query waited for a connection to Pgpool-II."),
+		waitDuration: counter("wait_duration_seconds", "Total time the queries waited for a connection to Pgpool-II."),
+	}
+}
+
+// Record the statistics of db, if it is a statsQuerier.
+func (s *dbStats) observe(db Querier) {
+	q, ok := db.(statsQuerier)
+	if !ok {
+		s.open.Set(0)
+		s.inUse.Set(0)
+		s.idle.Set(0)
+		return
+	}
+
+	stats := q.Stats()
+	if db != s.db {
+		s.db = db
+		s.last = sql.DBStats{}
+	}
+	s.open.Set(float64(stats.OpenConnections))
+	s.inUse.Set(float64(stats.InUse))
+	s.idle.Set(float64(stats.Idle))
+	s.maxOpen.Set(float64(stats.MaxOpenConnections))
+	s.waitCount.Add(float64(stats.WaitCount - s.last.WaitCount))
+	s.waitDuration.Add((stats.WaitDuration - s.last.WaitDuration).Seconds())
+	s.last = stats
+}
+
+func (s *dbStats) collect(ch chan<- prometheus.Metric) {
+	ch <- s.open
+	ch <- s.inUse
+	ch <- s.idle
+	ch <- s.maxOpen
+	ch <- s.waitCount
+	ch <- s.waitDuration
+}
+
+// DialFunc establishes the network connections to Pgpool-II, e.g. through
+// an SSH tunnel or a proxy.
+type DialFunc func(ctx context.Context, network string, address string) (net.Conn, error)
+
+// Adapt a DialFunc to the dialer interfaces of lib/pq.
+type pqDialer struct {
+	dial DialFunc
+}
+
+func (d pqDialer) Dial(network string, address string) (net.Conn, error) {
+	return d.dial(context.Background(), network, address)
+}
+
+func (d pqDialer) DialTimeout(network string, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.dial(ctx, network, address)
+}
+
+func (d pqDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	return d.dial(ctx, network, address)
+}
+
+// Connect with lib/pq through a DialFunc.
+type pqConnector struct {
+	dsn    string
+	dialer pqDialer
+}
+
+func (c *pqConnector) Connect(context.Context) (driver.Conn, error) {
+	return pq.DialOpen(c.dialer, c.dsn)
+}
+
+func (c *pqConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// Run query for namespace, and run it again once if it fails with a
+// transient error, e.g. as the child process of Pgpool-II serving the
+// connection exited. The connection which failed is discarded by the
+// driver, and the idle ones are checked before they are reused, so that
+// the query runs again on a working connection.
+func (e *Exporter) query(ctx context.Context, namespace string, query string) (Rows, error) {
+	if results, ok := ctx.Value(scrapeResultsKey{}).(*scrapeResults); ok && sharedNamespaces[namespace] {
+		return results.query(ctx, namespace, query, e.queryDB)
+	}
+	return e.queryDB(ctx, namespace, query)
+}
+
+func (e *Exporter) queryDB(ctx context.Context, namespace string, query string) (Rows, error) {
+	rows, err := e.DB.Query(ctx, query)
+	if err == nil || !isTransientError(err) || ctx.Err() != nil {
+		return rows, err
+	}
+
+	level.Warn(e.log(ctx)).Log("msg", "Retrying query after transient error", "namespace", namespace, "err", err)
+	e.queryRetries.WithLabelValues(namespace).Inc()
+	return e.DB.Query(ctx, query)
+}
+
+// The namespaces whose results other namespaces read in the same scrape,
+// e.g. the backend hostnames of pool_pools from pool_nodes.
+var sharedNamespaces = map[string]bool{"pool_nodes": true, "pool_status": true}
+
+type scrapeResultsKey struct{}
+
+// The results of the shared namespaces in a scrape, so that each of them
+// is queried once per scrape whichever namespace reads it first.
+type scrapeResults struct {
+	mutex   sync.Mutex
+	results map[string]*scrapeResult
+}
+
+type scrapeResult struct {
+	once    sync.Once
+	columns []string
+	rows    [][]interface{}
+	err     error
+}
+
+// Return a context in which the results of the shared namespaces are kept
+// by the queries of the exporter.
+func withScrapeResults(ctx context.Context) context.Context {
+	return context.WithValue(ctx, scrapeResultsKey{}, &scrapeResults{results: make(map[string]*scrapeResult)})
+}
+
+// Run query with run the first time it is asked for, and replay its rows
+// after that.
+func (s *scrapeResults) query(ctx context.Context, namespace string, query string, run func(context.Context, string, string) (Rows, error)) (Rows, error) {
+	s.mutex.Lock()
+	result, ok := s.results[query]
+	if !ok {
+		result = &scrapeResult{}
+		s.results[query] = result
+	}
+	s.mutex.Unlock()
+
+	result.once.Do(func() {
+		rows, err := run(ctx, namespace, query)
+		if err != nil {
+			result.err = err
+			return
+		}
+		result.columns, result.rows, result.err = readRows(rows)
+	})
+	if result.err != nil {
+		return nil, result.err
+	}
+	return &resultRows{columns: result.columns, rows: result.rows}, nil
+}
+
+// Read all the rows of a result and close it.
+func readRows(rows Rows) ([]string, [][]interface{}, error) {
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	var data [][]interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		scanArgs := make([]interface{}, len(columns))
+		for i := range values {
+			scanArgs[i] = &values[i]
+		}
+		if err := rows.Scan(scanArgs...); err != nil {
+			return nil, nil, err
+		}
+		data = append(data, values)
+	}
+	return columns, data, rows.Err()
+}
+
+// Rows replaying a result read by readRows.
+type resultRows struct {
+	columns []string
+	rows    [][]interface{}
+	next    int
+}
+
+func (r *resultRows) Columns() ([]string, error) {
+	return r.columns, nil
+}
+
+func (r *resultRows) Next() bool {
+	if r.next >= len(r.rows) {
+		return false
+	}
+	r.next++
+	return true
+}
+
+func (r *resultRows) Scan(dest ...interface{}) error {
+	if r.next == 0 {
+		return fmt.Errorf("Scan called without calling Next")
+	}
+	row := r.rows[r.next-1]
+	if len(dest) != len(row) {
+		return fmt.Errorf("expected %d destination arguments in Scan, not %d", len(row), len(dest))
+	}
+	for i, value := range row {
+		switch d := dest[i].(type) {
+		case *interface{}:
+			*d = value
+		case *string:
+			switch v := value.(type) {
+			case []byte:
+				*d = string(v)
+			case nil:
+				return fmt.Errorf("converting NULL to string is unsupported (column %s)", r.columns[i])
+			default:
+				*d = fmt.Sprint(v)
+			}
+		default:
+			return fmt.Errorf("unsupported Scan destination %T (column %s)", dest[i], r.columns[i])
+		}
+	}
+	return nil
+}
+
+func (r *resultRows) Err() error {
+	return nil
+}
+
+func (r *resultRows) Close() error {
+	return nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	fixtures "github.com/pgpool/pgpool2_exporter/testutil"
+)
+
+// countingQuerier counts the queries it runs.
+type countingQuerier struct {
+	Querier
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+func (q *countingQuerier) Query(ctx context.Context, query string) (Rows, error) {
+	q.mutex.Lock()
+	q.counts[query]++
+	q.mutex.Unlock()
+	return q.Querier.Query(ctx, query)
+}
+
+func TestScrapeQueriesSharedNamespacesOnce(t *testing.T) {
+	for _, concurrency := range []int{1, 4} {
+		db, err := fixtures.OpenVersion("4.4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := &countingQuerier{Querier: NewSQLQuerier(db), counts: map[string]int{}}
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(NewExporter("postgresql://pgpool@localhost:9999/postgres", WithQuerier(q), WithScrapeConcurrency(concurrency)))
+
+		// The first scrape also probes the SHOW commands the exporter user
+		// can run.
+		if _, err := registry.Gather(); err != nil {
+			t.Fatal(err)
+		}
+		for scrape := 1; scrape <= 2; scrape++ {
+			before := map[string]int{}
+			for query, count := range q.counts {
+				before[query] = count
+			}
+			mfs, err := registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// pool_pools reads the backend hostnames from pool_nodes.
+			found := false
+			for _, mf := range mfs {
+				if mf.GetName() == "pgpool2_backend_by_process_used" {
+					for _, l := range mf.Metric[0].Label {
+						found = found || l.GetName() == "backend_id"
+					}
+				}
+			}
+			if !found {
+				t.Errorf("concurrency %d: pgpool2_backend_by_process_used not exported", concurrency)
+			}
+			for _, query := range []string{"SHOW pool_nodes;", "SHOW pool_status;"} {
+				if runs := q.counts[query] - before[query]; runs != 1 {
+					t.Errorf("concurrency %d: %q run %d times in a scrape, want once", concurrency, query, runs)
+				}
+			}
+		}
+		db.Close()
+	}
+}
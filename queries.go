@@ -0,0 +1,137 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// UserQuery is a user-defined query loaded from the file given by
+// --extend.query-path.
+type UserQuery struct {
+	Query   string    `yaml:"query"`
+	Metrics []Mapping `yaml:"metrics"`
+}
+
+// Mapping maps a column name to how it should be exported.
+type Mapping map[string]MappingOptions
+
+// MappingOptions describes how a user-defined column is exported. Mapping
+// gives the values of the text values of a MAPPEDMETRIC column.
+type MappingOptions struct {
+	Usage       columnUsage        `yaml:"usage"`
+	Description string             `yaml:"description"`
+	Mapping     map[string]float64 `yaml:"mapping"`
+}
+
+// UserQueries maps a metric namespace to a user-defined query.
+type UserQueries map[string]UserQuery
+
+// Parse the content of a custom queries file into column mappings, the
+// value mappings of their MAPPEDMETRIC columns and the queries to run for
+// each namespace.
+func parseUserQueries(content []byte) (map[string]map[string]ColumnMapping, map[string]map[string]map[string]float64, map[string]string, error) {
+	var userQueries UserQueries
+
+	if err := yaml.Unmarshal(content, &userQueries); err != nil {
+		return nil, nil, nil, err
+	}
+
+	metricMaps := make(map[string]map[string]ColumnMapping)
+	valueMappings := make(map[string]map[string]map[string]float64)
+	queryOverrides := make(map[string]string)
+
+	for namespace, specs := range userQueries {
+		if specs.Query == "" {
+			return nil, nil, nil, fmt.Errorf("query for %s is empty", namespace)
+		}
+
+		newMetricMap := make(map[string]ColumnMapping)
+		newValueMappings := make(map[string]map[string]float64)
+		for _, metric := range specs.Metrics {
+			for columnName, options := range metric {
+				switch options.Usage {
+				case DISCARD, LABEL, COUNTER, GAUGE, DURATION, TIMESTAMP:
+					if len(options.Mapping) > 0 {
+						return nil, nil, nil, fmt.Errorf("mapping of column %s in %s requires usage MAPPEDMETRIC", columnName, namespace)
+					}
+				case MAPPEDMETRIC:
+					if len(options.Mapping) == 0 {
+						return nil, nil, nil, fmt.Errorf("mapping of MAPPEDMETRIC column %s in %s is empty", columnName, namespace)
+					}
+					mapping := make(map[string]float64, len(options.Mapping))
+					for text, value := range options.Mapping {
+						mapping[strings.ToLower(strings.TrimSpace(text))] = value
+					}
+					newValueMappings[columnName] = mapping
+				default:
+					return nil, nil, nil, fmt.Errorf("usage of column %s in %s is not supported", columnName, namespace)
+				}
+				newMetricMap[columnName] = ColumnMapping{options.Usage, options.Description}
+			}
+		}
+
+		metricMaps[namespace] = newMetricMap
+		valueMappings[namespace] = newValueMappings
+		queryOverrides[namespace] = specs.Query
+	}
+
+	return metricMaps, valueMappings, queryOverrides, nil
+}
+
+// Load the custom queries file and merge its queries into the built-in
+// metric maps and value mappings. The built-in maps are not modified.
+func addQueries(path string, builtin map[string]map[string]ColumnMapping, builtinValues map[string]map[string]map[string]float64) (map[string]map[string]ColumnMapping, map[string]map[string]map[string]float64, map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, nil, errors.New(fmt.Sprintln("Error reading custom queries file:", err))
+	}
+
+	userMetricMaps, userValueMappings, queryOverrides, err := parseUserQueries(content)
+	if err != nil {
+		return nil, nil, nil, errors.New(fmt.Sprintln("Error parsing custom queries file:", err))
+	}
+
+	merged := make(map[string]map[string]ColumnMapping, len(builtin)+len(userMetricMaps))
+	for namespace, mappings := range builtin {
+		merged[namespace] = mappings
+	}
+	for namespace, mappings := range userMetricMaps {
+		merged[namespace] = mappings
+	}
+
+	mergedValues := make(map[string]map[string]map[string]float64, len(builtinValues)+len(userValueMappings))
+	for namespace, mappings := range builtinValues {
+		mergedValues[namespace] = mappings
+	}
+	for namespace, mappings := range userValueMappings {
+		mergedValues[namespace] = mappings
+	}
+
+	return merged, mergedValues, queryOverrides, nil
+}
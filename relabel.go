@@ -0,0 +1,257 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+)
+
+// RelabelConfig is a rule of the metric_relabel section of the config
+// file, changing a label of the metrics before they are exported. Series
+// which end up with the same labels are merged: the values of counters,
+// untyped metrics, histograms and summaries are added, while gauges keep
+// the largest value, as adding e.g. ratios or delays is meaningless,
+// unless Merge is sum.
+type RelabelConfig struct {
+	// Regular expression matching the whole name of the metrics the rule
+	// applies to. All metrics if empty.
+	Metrics string `yaml:"metrics"`
+	// drop removes the label, rename renames it to Target and hash replaces
+	// its value by a keyed hash (see --metrics.hash-key).
+	Action string `yaml:"action"`
+	Label  string `yaml:"label"`
+	Target string `yaml:"target"`
+	// How the gauges of the merged series are merged: max (the default)
+	// or sum, for gauges which count something, e.g. the backend
+	// connection slots in use.
+	Merge string `yaml:"merge"`
+}
+
+type relabelRule struct {
+	RelabelConfig
+	metrics *regexp.Regexp
+	hashKey []byte
+}
+
+// errNoHashKey is returned for the hash action when no key is set, as an
+// unkeyed hash of a user or database name is easily reversed by hashing
+// guessed names.
+var errNoHashKey = errors.New("hashing label values requires --metrics.hash-key")
+
+// Check the rule and compile its regular expression.
+func (c RelabelConfig) compile() (relabelRule, error) {
+	rule := relabelRule{RelabelConfig: c}
+
+	switch c.Action {
+	case "drop", "hash":
+	case "rename":
+		if !model.LabelName(c.Target).IsValid() {
+			return rule, fmt.Errorf("invalid target label name in metric_relabel: %q", c.Target)
+		}
+	default:
+		return rule, fmt.Errorf("unknown action in metric_relabel: %q (must be drop, rename or hash)", c.Action)
+	}
+	if !model.LabelName(c.Label).IsValid() {
+		return rule, fmt.Errorf("invalid label name in metric_relabel: %q", c.Label)
+	}
+	switch c.Merge {
+	case "", "max", "sum":
+	default:
+		return rule, fmt.Errorf("unknown merge in metric_relabel: %q (must be max or sum)", c.Merge)
+	}
+
+	metrics := c.Metrics
+	if metrics == "" {
+		metrics = ".*"
+	}
+	re, err := regexp.Compile("^(?:" + metrics + ")$")
+	if err != nil {
+		return rule, fmt.Errorf("invalid metrics regular expression in metric_relabel: %s", err)
+	}
+	rule.metrics = re
+
+	return rule, nil
+}
+
+// Apply the rule to the labels of a metric, in place.
+func (r relabelRule) apply(labels map[string]string) {
+	value, ok := labels[r.Label]
+	if !ok {
+		return
+	}
+
+	switch r.Action {
+	case "drop":
+		delete(labels, r.Label)
+	case "rename":
+		delete(labels, r.Label)
+		labels[r.Target] = value
+	case "hash":
+		labels[r.Label] = hashLabelValue(r.hashKey, value)
+	}
+}
+
+// Replace a label value by the first 16 hex digits of its HMAC-SHA-256
+// with key, which tells the values apart without revealing them to those
+// who do not know the key.
+func hashLabelValue(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// RedactRules returns the rules hashing the values of the labels given with
+// --metrics.redact-labels in all metrics.
+func RedactRules() []RelabelConfig {
+	var rules []RelabelConfig
+	for _, label := range strings.Split(*RedactLabels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			rules = append(rules, RelabelConfig{Action: "hash", Label: label})
+		}
+	}
+	return rules
+}
+
+// NewRelabelGatherer returns a Gatherer applying the rules to the metrics
+// of g. hashKey is the secret key of the hash action, which is refused if
+// the key is empty.
+func NewRelabelGatherer(g prometheus.Gatherer, configs []RelabelConfig, hashKey []byte) (prometheus.Gatherer, error) {
+	var rules []relabelRule
+	for _, c := range configs {
+		rule, err := c.compile()
+		if err != nil {
+			return nil, err
+		}
+		if rule.Action == "hash" {
+			if len(hashKey) == 0 {
+				return nil, fmt.Errorf("%w (label %s)", errNoHashKey, rule.Label)
+			}
+			rule.hashKey = hashKey
+		}
+		rules = append(rules, rule)
+	}
+
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		for _, mf := range mfs {
+			relabelFamily(mf, rules)
+		}
+		return mfs, err
+	}), nil
+}
+
+// Apply the rules matching the name of mf to its metrics, and merge the
+// metrics left with the same labels.
+func relabelFamily(mf *dto.MetricFamily, rules []relabelRule) {
+	var matching []relabelRule
+	sumGauges := false
+	for _, rule := range rules {
+		if rule.metrics.MatchString(mf.GetName()) {
+			matching = append(matching, rule)
+			if rule.Merge != "" {
+				sumGauges = rule.Merge == "sum"
+			}
+		}
+	}
+	if len(matching) == 0 {
+		return
+	}
+
+	merged := make(map[string]*dto.Metric)
+	var metrics []*dto.Metric
+	for _, m := range mf.Metric {
+		labels := make(map[string]string, len(m.Label))
+		for _, l := range m.Label {
+			labels[l.GetName()] = l.GetValue()
+		}
+		for _, rule := range matching {
+			rule.apply(labels)
+		}
+
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		pairs := make([]*dto.LabelPair, 0, len(names))
+		keys := make([]string, 0, len(names))
+		for _, name := range names {
+			pairs = append(pairs, &dto.LabelPair{Name: proto.String(name), Value: proto.String(labels[name])})
+			keys = append(keys, name+"="+labels[name])
+		}
+		m.Label = pairs
+
+		key := strings.Join(keys, "\xff")
+		if first, ok := merged[key]; ok {
+			mergeMetric(first, m, sumGauges)
+			continue
+		}
+		merged[key] = m
+		metrics = append(metrics, m)
+	}
+	mf.Metric = metrics
+}
+
+// Add the value of m to into, or keep the largest value of a gauge unless
+// sumGauges is set.
+func mergeMetric(into *dto.Metric, m *dto.Metric, sumGauges bool) {
+	switch {
+	case into.Counter != nil && m.Counter != nil:
+		into.Counter.Value = proto.Float64(into.Counter.GetValue() + m.Counter.GetValue())
+	case into.Gauge != nil && m.Gauge != nil:
+		if sumGauges {
+			into.Gauge.Value = proto.Float64(into.Gauge.GetValue() + m.Gauge.GetValue())
+		} else {
+			into.Gauge.Value = proto.Float64(max(into.Gauge.GetValue(), m.Gauge.GetValue()))
+		}
+	case into.Untyped != nil && m.Untyped != nil:
+		into.Untyped.Value = proto.Float64(into.Untyped.GetValue() + m.Untyped.GetValue())
+	case into.Histogram != nil && m.Histogram != nil:
+		h := into.Histogram
+		h.SampleCount = proto.Uint64(h.GetSampleCount() + m.Histogram.GetSampleCount())
+		h.SampleSum = proto.Float64(h.GetSampleSum() + m.Histogram.GetSampleSum())
+		for i, b := range h.Bucket {
+			if i < len(m.Histogram.Bucket) && m.Histogram.Bucket[i].GetUpperBound() == b.GetUpperBound() {
+				b.CumulativeCount = proto.Uint64(b.GetCumulativeCount() + m.Histogram.Bucket[i].GetCumulativeCount())
+			}
+		}
+	case into.Summary != nil && m.Summary != nil:
+		// Quantiles cannot be merged.
+		s := into.Summary
+		s.SampleCount = proto.Uint64(s.GetSampleCount() + m.Summary.GetSampleCount())
+		s.SampleSum = proto.Float64(s.GetSampleSum() + m.Summary.GetSampleSum())
+		s.Quantile = nil
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRelabelHashKey(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	used := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "pgpool2_frontend_used", Help: "Used."}, []string{"username"})
+	used.WithLabelValues("alice").Set(1)
+	registry.MustRegister(used)
+	rules := []RelabelConfig{{Action: "hash", Label: "username"}}
+
+	if _, err := NewRelabelGatherer(registry, rules, nil); !errors.Is(err, errNoHashKey) {
+		t.Fatalf("hash without a key: got error %v, want %v", err, errNoHashKey)
+	}
+
+	hashed := func(key string) string {
+		gatherer, err := NewRelabelGatherer(registry, rules, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mfs, err := gatherer.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mfs[0].Metric[0].Label[0].GetValue()
+	}
+	first, second := hashed("key1"), hashed("key2")
+	if first == "alice" || len(first) != 16 {
+		t.Errorf("hashed username = %q, want 16 hex digits", first)
+	}
+	if first != hashLabelValue([]byte("key1"), "alice") {
+		t.Errorf("hashed username = %q, want %q", first, hashLabelValue([]byte("key1"), "alice"))
+	}
+	if first == second {
+		t.Errorf("hashed username %q does not depend on the key", first)
+	}
+}
+
+func TestRelabelMerge(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	used := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "pgpool2_backend_by_process_used", Help: "Used."}, []string{"pool_pid"})
+	ratio := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "pgpool2_backend_by_process_used_ratio", Help: "Ratio."}, []string{"pool_pid"})
+	queries := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "pgpool2_queries_total", Help: "Queries."}, []string{"pool_pid"})
+	for pid, value := range map[string]float64{"100": 0.25, "101": 0.5} {
+		used.WithLabelValues(pid).Set(1)
+		ratio.WithLabelValues(pid).Set(value)
+		queries.WithLabelValues(pid).Add(value * 4)
+	}
+	registry.MustRegister(used, ratio, queries)
+
+	gatherer, err := NewRelabelGatherer(registry, []RelabelConfig{
+		{Action: "drop", Label: "pool_pid"},
+		{Metrics: "pgpool2_backend_by_process_used", Action: "drop", Label: "pool_pid", Merge: "sum"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]float64{
+		// Gauges counting something are added with merge: sum.
+		"pgpool2_backend_by_process_used": 2,
+		// Other gauges keep the largest value.
+		"pgpool2_backend_by_process_used_ratio": 0.5,
+		// Counters are added.
+		"pgpool2_queries_total": 3,
+	}
+	for _, mf := range mfs {
+		if len(mf.Metric) != 1 {
+			t.Errorf("%s: got %d series, want 1", mf.GetName(), len(mf.Metric))
+			continue
+		}
+		m := mf.Metric[0]
+		value := m.GetGauge().GetValue()
+		if m.Counter != nil {
+			value = m.GetCounter().GetValue()
+		}
+		if value != want[mf.GetName()] {
+			t.Errorf("%s = %g, want %g", mf.GetName(), value, want[mf.GetName()])
+		}
+	}
+
+	if _, err := NewRelabelGatherer(registry, []RelabelConfig{{Action: "drop", Label: "pool_pid", Merge: "avg"}}, nil); err == nil {
+		t.Error("merge: avg accepted")
+	}
+}
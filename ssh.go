@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Connections to Pgpool-II through an SSH server. The SSH connection is
+// established on the first dial and shared by the following ones, until it
+// breaks.
+type sshTunnel struct {
+	mutex   sync.Mutex
+	address string
+	config  *ssh.ClientConfig
+	client  *ssh.Client
+}
+
+// NewSSHDialer returns a DialFunc connecting to Pgpool-II through the SSH
+// server at address ("host[:port]"), authenticating as user with the
+// private key in keyFile. The host key of the server is checked against
+// knownHostsFile, ~/.ssh/known_hosts if empty.
+func NewSSHDialer(address string, user string, keyFile string, knownHostsFile string) (DialFunc, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintln("Error reading SSH key file:", err))
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintln("Error parsing SSH key file:", err))
+	}
+
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintln("Error reading SSH known hosts file:", err))
+	}
+
+	t := &sshTunnel{
+		address: address,
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+		},
+	}
+	return t.dial, nil
+}
+
+// Return the SSH connection, establishing it if needed.
+func (t *sshTunnel) connect(ctx context.Context) (*ssh.Client, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.client != nil {
+		return t.client, nil
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", t.address)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to SSH server %s: %w", t.address, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, t.address, t.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error connecting to SSH server %s: %w", t.address, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	t.client = ssh.NewClient(sshConn, chans, reqs)
+	return t.client, nil
+}
+
+// Forget the SSH connection if it is still client, so that the next dial
+// establishes a new one.
+func (t *sshTunnel) reset(client *ssh.Client) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.client == client {
+		t.client.Close()
+		t.client = nil
+	}
+}
+
+func (t *sshTunnel) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	client, err := t.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.DialContext(ctx, network, address)
+	if err == nil || ctx.Err() != nil {
+		return conn, err
+	}
+
+	// The SSH connection may have been broken, e.g. by a restart of the
+	// SSH server: try again once with a new one.
+	t.reset(client)
+	if client, err = t.connect(ctx); err != nil {
+		return nil, err
+	}
+	return client.DialContext(ctx, network, address)
+}
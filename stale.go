@@ -0,0 +1,83 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Scrape Pgpool-II and send the metrics to ch. While Pgpool-II is
+// unreachable, the metrics of the last successful scrape are sent instead
+// for --metrics.serve-stale-for, so that its series do not disappear
+// during a short outage.
+func (e *Exporter) scrapeOrStale(ctx context.Context, ch chan<- prometheus.Metric) {
+	var metrics []prometheus.Metric
+
+	metricCh := make(chan prometheus.Metric)
+	doneCh := make(chan struct{})
+
+	go func() {
+		for m := range metricCh {
+			metrics = append(metrics, m)
+		}
+		close(doneCh)
+	}()
+
+	e.scrape(ctx, metricCh)
+	close(metricCh)
+	<-doneCh
+
+	e.staleMutex.Lock()
+	defer e.staleMutex.Unlock()
+
+	stale := 0.0
+	if e.connected.Load() {
+		e.lastGood = metrics
+		e.lastGoodTime = time.Now()
+	} else if e.lastGood != nil && time.Since(e.lastGoodTime) < e.serveStaleFor {
+		// The metrics of the failed scrape, if any, would duplicate the
+		// stale ones.
+		metrics = e.lastGood
+		stale = 1
+	}
+
+	for _, m := range metrics {
+		ch <- m
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		e.newDesc("", "stale_data", "Whether the Pgpool-II metrics are those of the last successful scrape, as Pgpool-II is unreachable (1 for yes, 0 for no)", nil),
+		prometheus.GaugeValue,
+		stale,
+	)
+	if !e.lastGoodTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			e.newDesc("", "last_successful_scrape_timestamp_seconds", "Time of the last successful scrape of Pgpool-II since unix epoch in seconds", nil),
+			prometheus.GaugeValue,
+			float64(e.lastGoodTime.UnixNano())/1e9,
+		)
+	}
+}
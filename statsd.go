@@ -0,0 +1,155 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Maximum size of a statsd datagram, fitting in the usual MTU
+const statsdPacketSize = 1432
+
+// Replaces the characters which statsd tags cannot hold
+var statsdTagReplacer = strings.NewReplacer(",", "_", "|", "_", ":", "_", "=", "_", " ", "_", "#", "_")
+
+// NewStatsdPusher returns a Pusher sending the metrics of g over UDP to the
+// statsd server at address, with the labels as tags in tagFormat:
+// "dogstatsd" (name:1|g|#label:value) or "influxdb" (name,label=value:1|g).
+func NewStatsdPusher(address string, tagFormat string, g prometheus.Gatherer, logger log.Logger) (*Pusher, error) {
+	if tagFormat != "dogstatsd" && tagFormat != "influxdb" {
+		return nil, fmt.Errorf("unknown statsd tag format: %q (must be dogstatsd or influxdb)", tagFormat)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("invalid statsd address %q: %w", address, err)
+	}
+	return &Pusher{
+		url:       address,
+		protocol:  "statsd",
+		gatherer:  g,
+		logger:    logger,
+		start:     time.Now(),
+		tagFormat: tagFormat,
+		previous:  make(map[string]float64),
+	}, nil
+}
+
+// Send the metrics as statsd lines: gauges as gauges, and counters as the
+// increase since the previous push, so nothing is sent for a counter on the
+// first push.
+func (p *Pusher) pushStatsd(mfs []*dto.MetricFamily) error {
+	conn, err := net.Dial("udp", p.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var packet []byte
+	flush := func() error {
+		if len(packet) == 0 {
+			return nil
+		}
+		_, err := conn.Write(packet)
+		packet = packet[:0]
+		return err
+	}
+
+	previous := make(map[string]float64)
+	for _, s := range expandSeries(mfs, time.Now()) {
+		if math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+			continue
+		}
+
+		name := s.labels["__name__"]
+		tags := make([]string, 0, len(s.labels))
+		for label, value := range s.labels {
+			if label == "__name__" {
+				continue
+			}
+			separator := ":"
+			if p.tagFormat == "influxdb" {
+				separator = "="
+			}
+			tags = append(tags, label+separator+statsdTagReplacer.Replace(value))
+		}
+		sort.Strings(tags)
+
+		var lines []string
+		if s.cumulative {
+			key := name + "," + strings.Join(tags, ",")
+			previous[key] = s.value
+			last, ok := p.previous[key]
+			if !ok {
+				continue
+			}
+			delta := s.value - last
+			// The counter was reset.
+			if delta < 0 {
+				delta = s.value
+			}
+			lines = append(lines, statsdLine(name, tags, delta, "c", p.tagFormat))
+		} else {
+			// A signed gauge value is a change of the gauge for statsd.
+			if s.value < 0 {
+				lines = append(lines, statsdLine(name, tags, 0, "g", p.tagFormat))
+			}
+			lines = append(lines, statsdLine(name, tags, s.value, "g", p.tagFormat))
+		}
+
+		for _, line := range lines {
+			if len(packet)+len(line)+1 > statsdPacketSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+		}
+	}
+	p.previous = previous
+
+	return flush()
+}
+
+// Format a statsd line.
+func statsdLine(name string, tags []string, value float64, statsdType string, tagFormat string) string {
+	formatted := strconv.FormatFloat(value, 'f', -1, 64)
+	if len(tags) == 0 {
+		return fmt.Sprintf("%s:%s|%s", name, formatted, statsdType)
+	}
+	if tagFormat == "influxdb" {
+		return fmt.Sprintf("%s,%s:%s|%s", name, strings.Join(tags, ","), formatted, statsdType)
+	}
+	return fmt.Sprintf("%s:%s|%s|#%s", name, formatted, statsdType, strings.Join(tags, ","))
+}
@@ -0,0 +1,179 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// Status is the state of a Pgpool-II instance as returned by
+// /api/v1/status, parsed from its SHOW commands.
+type Status struct {
+	Instance          string              `json:"instance"`
+	Version           string              `json:"version,omitempty"`
+	Nodes             []map[string]string `json:"pool_nodes"`
+	Processes         *ProcessSummary     `json:"pool_processes,omitempty"`
+	QueryCacheEnabled *bool               `json:"query_cache_enabled,omitempty"`
+	Cache             map[string]string   `json:"pool_cache,omitempty"`
+	// Errors of the queries, by command
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// ProcessSummary summarizes the child processes listed by SHOW
+// pool_processes.
+type ProcessSummary struct {
+	Total int `json:"total"`
+	// Processes with a client connection
+	Used       int            `json:"used"`
+	ByDatabase map[string]int `json:"by_database"`
+	// Reported by Pgpool-II 4.2 and later
+	ByStatus map[string]int `json:"by_status,omitempty"`
+}
+
+// StatusHandler returns a handler which answers with the Status of each
+// Pgpool-II instance of exporters as a JSON array, queried on their
+// connection.
+func StatusHandler(exporters []*Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		statuses := make([]Status, 0, len(exporters))
+		for _, e := range exporters {
+			statuses = append(statuses, e.status(r.Context()))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(statuses)
+	}
+}
+
+// Query the status of Pgpool-II. Failed queries are reported in the
+// Errors of the status.
+func (e *Exporter) status(ctx context.Context) Status {
+	if e.scrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.scrapeTimeout)
+		defer cancel()
+	}
+
+	// A snapshot, as a scrape may reconnect in the meantime
+	db, dsn := e.connection()
+	status := Status{
+		Instance: DSNLabel(dsn),
+		Nodes:    []map[string]string{},
+		Errors:   map[string]string{},
+	}
+
+	if db == nil {
+		status.Errors["connection"] = "not connected to Pgpool-II"
+		return status
+	}
+
+	if v, err := QueryVersion(ctx, db); err != nil {
+		status.Errors["pool_version"] = err.Error()
+	} else {
+		status.Version = v.String()
+	}
+
+	if nodes, err := queryRows(ctx, db, "SHOW pool_nodes;"); err != nil {
+		status.Errors["pool_nodes"] = err.Error()
+	} else {
+		status.Nodes = nodes
+	}
+
+	if processes, err := queryRows(ctx, db, "SHOW pool_processes;"); err != nil {
+		status.Errors["pool_processes"] = err.Error()
+	} else {
+		summary := &ProcessSummary{ByDatabase: map[string]int{}}
+		for _, process := range processes {
+			summary.Total++
+			if database := process["database"]; database != "" {
+				summary.Used++
+				if e.redactedLabels["database"] {
+					database = hashLabelValue(e.hashKey, database)
+				}
+				summary.ByDatabase[database]++
+			}
+			if processStatus, ok := process["status"]; ok {
+				if summary.ByStatus == nil {
+					summary.ByStatus = map[string]int{}
+				}
+				summary.ByStatus[processStatus]++
+			}
+		}
+		status.Processes = summary
+	}
+
+	cache, err := queryRows(ctx, db, "SHOW pool_cache;")
+	switch {
+	case err == nil:
+		enabled := true
+		status.QueryCacheEnabled = &enabled
+		if len(cache) > 0 {
+			status.Cache = cache[0]
+		}
+	case isQueryCacheDisabled(err):
+		enabled := false
+		status.QueryCacheEnabled = &enabled
+	default:
+		status.Errors["pool_cache"] = err.Error()
+	}
+
+	return status
+}
+
+// Run query and return its rows as maps from the column names to the
+// values.
+func queryRows(ctx context.Context, db Querier, query string) ([]map[string]string, error) {
+	rows, err := db.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columnNames, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []map[string]string
+	for rows.Next() {
+		row := make(map[string]*string, len(columnNames))
+		values := make(map[string]string, len(columnNames))
+		for _, name := range columnNames {
+			var value string
+			row[name] = &value
+		}
+		if err := scanColumns(rows, row); err != nil {
+			return nil, err
+		}
+		for name, value := range row {
+			values[name] = *value
+		}
+		result = append(result, values)
+	}
+
+	return result, rows.Err()
+}
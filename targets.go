@@ -0,0 +1,351 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// TargetConfig is a Pgpool-II instance listed in the file given by
+// --targets.file.
+type TargetConfig struct {
+	// Host and port of Pgpool-II, connected to with the user, database and
+	// options of the configured data source
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+	// Complete DSN, instead of Host and Port
+	DSN  string `yaml:"dsn"`
+	User string `yaml:"user"`
+	// File to read the password from, e.g. a mounted secret
+	PasswordFile string `yaml:"password_file"`
+	// Labels added to the metrics of the target
+	Labels map[string]string `yaml:"labels"`
+}
+
+// LoadTargets reads and validates the targets file at path.
+func LoadTargets(path string) ([]TargetConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintln("Error reading targets file:", err))
+	}
+	return parseTargets(content)
+}
+
+func parseTargets(content []byte) ([]TargetConfig, error) {
+	var targets []TargetConfig
+	if err := yaml.UnmarshalStrict(content, &targets); err != nil {
+		return nil, errors.New(fmt.Sprintln("Error parsing targets file:", err))
+	}
+
+	for i, t := range targets {
+		if (t.Host == "") == (t.DSN == "") {
+			return nil, fmt.Errorf("target %d of the targets file must have either a host or a dsn", i)
+		}
+		for name := range t.Labels {
+			if !model.LabelName(name).IsValid() {
+				return nil, fmt.Errorf("invalid label name in targets file: %s", name)
+			}
+		}
+	}
+
+	return targets, nil
+}
+
+// Return the DSN of the target. Host targets are connected to with the
+// user, database and options of baseDSN.
+func (t TargetConfig) dsn(baseDSN string) (string, error) {
+	dsn := t.DSN
+	if t.Host != "" {
+		port := t.Port
+		if port == 0 {
+			port = 9999
+		}
+		var err error
+		dsn, err = setDSNHost(baseDSN, net.JoinHostPort(t.Host, strconv.Itoa(port)))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if t.User == "" && t.PasswordFile == "" {
+		return dsn, nil
+	}
+	var password string
+	if t.PasswordFile != "" {
+		content, err := os.ReadFile(t.PasswordFile)
+		if err != nil {
+			return "", errors.New(fmt.Sprintln("Error reading password file:", err))
+		}
+		password = strings.TrimRight(string(content), "\r\n")
+	}
+	return setDSNCredentials(dsn, t.User, password)
+}
+
+// TargetManager scrapes the Pgpool-II instances listed in the targets file,
+// and picks up the targets added to or removed from the file without a
+// restart. The exporter of a target is kept as long as it is listed
+// unchanged.
+type TargetManager struct {
+	path    string
+	baseDSN string
+	labels  prometheus.Labels
+	opts    []Option
+	logger  log.Logger
+
+	mutex   sync.Mutex
+	content []byte
+	targets map[string]*fileTarget
+}
+
+// Target of the targets file, scraped with its own registry which adds its
+// labels.
+type fileTarget struct {
+	exporter *Exporter
+	registry *prometheus.Registry
+	// Collects in flight, added to under the mutex of the manager while the
+	// target is listed, and waited for before closing the exporter
+	collects sync.WaitGroup
+}
+
+// NewTargetManager loads the targets file at path. labels are added to the
+// metrics of every target, and opts configure their exporters.
+func NewTargetManager(path, baseDSN string, labels prometheus.Labels, logger log.Logger, opts ...Option) (*TargetManager, error) {
+	m := &TargetManager{
+		path:    path,
+		baseDSN: baseDSN,
+		labels:  labels,
+		opts:    opts,
+		logger:  logger,
+		targets: map[string]*fileTarget{},
+	}
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Run reloads the targets when the targets file changes, until ctx is done.
+// The directory of the file is watched rather than the file itself, so that
+// a file replaced by a rename, e.g. an updated Kubernetes ConfigMap, is
+// still picked up. The file is also read every interval, if not zero, in
+// case its changes are not notified, e.g. on a network file system.
+func (m *TargetManager) Run(ctx context.Context, interval time.Duration) {
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer watcher.Close()
+		err = watcher.Add(filepath.Dir(m.path))
+	}
+	if err != nil {
+		level.Warn(m.logger).Log("msg", "Error watching targets file, reading it every interval only", "file", m.path, "interval", interval, "err", err)
+	} else {
+		events, watchErrors = watcher.Events, watcher.Errors
+	}
+
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	for {
+		// Every change in the directory is a reason to read the file
+		// again: it is only reloaded if its content changed.
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+		case <-events:
+		case err := <-watchErrors:
+			level.Error(m.logger).Log("msg", "Error watching targets file", "file", m.path, "err", err)
+			continue
+		}
+		if err := m.reload(); err != nil {
+			// The targets of the last valid file are kept.
+			level.Error(m.logger).Log("msg", "Error reloading targets file", "file", m.path, "err", err)
+		}
+	}
+}
+
+// Read the targets file, and create the exporters of the new targets and
+// close those of the removed ones.
+func (m *TargetManager) reload() error {
+	removed, err := m.update()
+	// The removed targets may still be gathered: their exporters are closed
+	// once their collects in flight are done, without holding up the
+	// gathering of the other targets.
+	for _, t := range removed {
+		t.collects.Wait()
+		t.exporter.Close()
+	}
+	return err
+}
+
+// Read the targets file and update the targets, returning the removed ones.
+func (m *TargetManager) update() ([]*fileTarget, error) {
+	content, err := os.ReadFile(m.path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintln("Error reading targets file:", err))
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.content != nil && bytes.Equal(content, m.content) {
+		return nil, nil
+	}
+	configs, err := parseTargets(content)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make(map[string]*fileTarget, len(configs))
+	for _, config := range configs {
+		dsn, err := config.dsn(m.baseDSN)
+		if err != nil {
+			return nil, err
+		}
+		labels := prometheus.Labels{}
+		for name, value := range m.labels {
+			labels[name] = value
+		}
+		for name, value := range config.Labels {
+			labels[name] = value
+		}
+		labels["pgpool_host"] = DSNLabel(dsn)
+
+		key := targetKey(dsn, labels)
+		if _, ok := targets[key]; ok {
+			return nil, fmt.Errorf("duplicate target in targets file: %s", MaskPassword(dsn))
+		}
+		if t, ok := m.targets[key]; ok {
+			targets[key] = t
+			continue
+		}
+
+		// The connection is established on the first scrape, so that an
+		// unreachable target does not hold up the others.
+		exporter := newExporter(dsn, append([]Option{WithLogger(m.logger)}, m.opts...)...)
+		// A rotated password is read again when authentication fails.
+		exporter.SetDSNSource(func() (string, error) {
+			return config.dsn(m.baseDSN)
+		})
+		registry := prometheus.NewRegistry()
+		prometheus.WrapRegistererWith(labels, registry).MustRegister(probeCollector{exporter, exporter.ctx})
+		targets[key] = &fileTarget{exporter: exporter, registry: registry}
+		level.Info(m.logger).Log("msg", "Added target", "dsn", MaskPassword(dsn))
+	}
+
+	var removed []*fileTarget
+	for key, t := range m.targets {
+		if _, ok := targets[key]; !ok {
+			_, dsn := t.exporter.connection()
+			level.Info(m.logger).Log("msg", "Removed target", "dsn", MaskPassword(dsn))
+			removed = append(removed, t)
+		}
+	}
+	m.targets = targets
+	m.content = content
+
+	return removed, nil
+}
+
+// Identity of a target: its DSN and labels.
+func targetKey(dsn string, labels prometheus.Labels) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	key := []string{dsn}
+	for _, name := range names {
+		key = append(key, name+"="+labels[name])
+	}
+	return strings.Join(key, "\xff")
+}
+
+// Gather implements prometheus.Gatherer, scraping the targets concurrently.
+func (m *TargetManager) Gather() ([]*dto.MetricFamily, error) {
+	m.mutex.Lock()
+	targets := make([]*fileTarget, 0, len(m.targets))
+	for _, t := range m.targets {
+		t.collects.Add(1)
+		targets = append(targets, t)
+	}
+	m.mutex.Unlock()
+
+	results := make([][]*dto.MetricFamily, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t *fileTarget) {
+			defer wg.Done()
+			defer t.collects.Done()
+			results[i], errs[i] = t.registry.Gather()
+		}(i, t)
+	}
+	wg.Wait()
+
+	// Merged and checked for consistency as by a single registry
+	gatherers := make(prometheus.Gatherers, len(targets))
+	for i := range targets {
+		mfs, err := results[i], errs[i]
+		gatherers[i] = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return mfs, err
+		})
+	}
+	return gatherers.Gather()
+}
+
+// Close closes the exporters of the targets, once their collects in flight
+// are done.
+func (m *TargetManager) Close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, t := range m.targets {
+		t.collects.Wait()
+		t.exporter.Close()
+	}
+}
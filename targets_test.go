@@ -0,0 +1,131 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/pgpool/pgpool2_exporter/testutil"
+)
+
+func TestTargetManagerWaitsForCollects(t *testing.T) {
+	db, err := testutil.OpenVersion("4.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	path := filepath.Join(t.TempDir(), "targets.yml")
+	if err := os.WriteFile(path, []byte("- host: pgpool1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	q := &blockingQuerier{Querier: NewSQLQuerier(db), started: make(chan struct{}, 1), release: make(chan struct{})}
+	m, err := NewTargetManager(path, "postgresql://pgpool@localhost:9999/postgres", nil, log.NewNopLogger(), WithQuerier(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	var exporter *Exporter
+	for _, target := range m.targets {
+		exporter = target.exporter
+	}
+
+	gathered := make(chan error)
+	go func() {
+		_, err := m.Gather()
+		gathered <- err
+	}()
+	<-q.started
+
+	// The target is removed while it is collected.
+	if err := os.WriteFile(path, []byte("[]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := make(chan error)
+	go func() { reloaded <- m.reload() }()
+	select {
+	case <-reloaded:
+		t.Fatal("reload returned while the removed target was collected")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if exporter.ctx.Err() != nil {
+		t.Fatal("exporter of the removed target closed while it was collected")
+	}
+
+	close(q.release)
+	if err := <-gathered; err != nil {
+		t.Error(err)
+	}
+	if err := <-reloaded; err != nil {
+		t.Fatal(err)
+	}
+	if exporter.ctx.Err() == nil {
+		t.Error("exporter of the removed target not closed")
+	}
+}
+
+func TestTargetManagerWatchesFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "targets.yml")
+	if err := os.WriteFile(path, []byte("- host: pgpool1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewTargetManager(path, "postgresql://pgpool@localhost:9999/postgres", nil, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Without polling, only the notifications reload the targets.
+	go m.Run(ctx, 0)
+
+	// Replaced by a rename, as done by editors and Kubernetes.
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		tmp := filepath.Join(dir, ".targets.yml.tmp")
+		if err := os.WriteFile(tmp, []byte("- host: pgpool1\n- host: pgpool2\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+
+		m.mutex.Lock()
+		n := len(m.targets)
+		m.mutex.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d targets, want 2", n)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
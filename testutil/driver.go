@@ -0,0 +1,144 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package testutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// NewDB returns a database whose queries are answered from fixtures.
+// Queries without a fixture fail like unknown SHOW commands.
+func NewDB(fixtures Fixtures) *sql.DB {
+	return sql.OpenDB(&connector{fixtures})
+}
+
+// OpenVersion returns a database answering the SHOW commands with the
+// recorded outputs of Pgpool-II version.
+func OpenVersion(version string) (*sql.DB, error) {
+	fixtures, err := LoadFixtures(version)
+	if err != nil {
+		return nil, err
+	}
+	return NewDB(fixtures), nil
+}
+
+type connector struct {
+	fixtures Fixtures
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{c.fixtures}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return fixtureDriver{}
+}
+
+// The driver of databases opened with NewDB, not meant to be registered
+type fixtureDriver struct{}
+
+func (fixtureDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("testutil: use NewDB to open a fixture database")
+}
+
+type conn struct {
+	fixtures Fixtures
+}
+
+func (c *conn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if len(args) > 0 {
+		return nil, errors.New("testutil: query arguments are not supported")
+	}
+	result, ok := c.fixtures.Lookup(query)
+	if !ok {
+		return nil, fmt.Errorf("ERROR:  unrecognized SHOW command: %q", query)
+	}
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	return &rows{result: result}, nil
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{c, query}, nil
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return nil, errors.New("testutil: transactions are not supported")
+}
+
+type stmt struct {
+	conn  *conn
+	query string
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return 0
+}
+
+func (s *stmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("testutil: statements are not supported")
+}
+
+func (s *stmt) Query([]driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, nil)
+}
+
+type rows struct {
+	result *Result
+	next   int
+}
+
+func (r *rows) Columns() []string {
+	return r.result.Columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+// Values are returned as strings, as with the simple protocol used with
+// Pgpool-II.
+func (r *rows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.Rows) {
+		return io.EOF
+	}
+	for i, value := range r.result.Rows[r.next] {
+		dest[i] = value
+	}
+	r.next++
+	return nil
+}
@@ -0,0 +1,173 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package testutil serves recorded outputs of the SHOW commands of
+// Pgpool-II through database/sql, so that code querying Pgpool-II can be
+// tested without a running instance.
+//
+// The outputs are kept in fixtures/<version>/<command>.txt, as printed by
+// psql, e.g. fixtures/4.2/pool_nodes.txt for "SHOW pool_nodes" on
+// Pgpool-II 4.2. A <command>.error file holds the error message returned
+// instead of a result.
+package testutil
+
+import (
+	"bufio"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//go:embed fixtures
+var fixtureFS embed.FS
+
+// Result is the output of a query.
+type Result struct {
+	Columns []string
+	Rows    [][]string
+	// Returned instead of the columns and rows if set
+	Err error
+}
+
+// Fixtures maps queries, normalized by Normalize, to their result.
+type Fixtures map[string]*Result
+
+// Add sets the result of query.
+func (f Fixtures) Add(query string, result *Result) {
+	f[Normalize(query)] = result
+}
+
+// Lookup returns the result of query.
+func (f Fixtures) Lookup(query string) (*Result, bool) {
+	result, ok := f[Normalize(query)]
+	return result, ok
+}
+
+// Normalize returns query in lower case without the trailing semicolon and
+// with single spaces, so that "SHOW POOL_VERSION;" and "show pool_version"
+// share a fixture.
+func Normalize(query string) string {
+	query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+	return strings.ToLower(strings.Join(strings.Fields(query), " "))
+}
+
+// Versions returns the Pgpool-II versions of the recorded outputs, sorted.
+func Versions() []string {
+	entries, err := fixtureFS.ReadDir("fixtures")
+	if err != nil {
+		return nil
+	}
+
+	var versions []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			versions = append(versions, entry.Name())
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// LoadFixtures returns the recorded outputs of the SHOW commands of
+// Pgpool-II version, e.g. "4.2".
+func LoadFixtures(version string) (Fixtures, error) {
+	dir := path.Join("fixtures", version)
+	entries, err := fixtureFS.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("no fixtures for Pgpool-II %s", version)
+	}
+
+	fixtures := make(Fixtures)
+	for _, entry := range entries {
+		name := entry.Name()
+		command, ext := strings.TrimSuffix(name, path.Ext(name)), path.Ext(name)
+		switch ext {
+		case ".txt":
+			f, err := fixtureFS.Open(path.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			result, err := ParseResult(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path.Join(dir, name), err)
+			}
+			fixtures.Add("SHOW "+command, result)
+		case ".error":
+			content, err := fs.ReadFile(fixtureFS, path.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			fixtures.Add("SHOW "+command, &Result{Err: errors.New(strings.TrimSpace(string(content)))})
+		}
+	}
+
+	return fixtures, nil
+}
+
+// Separator line and row count footer of the psql output
+var (
+	separatorRegex = regexp.MustCompile(`^[-+]+$`)
+	footerRegex    = regexp.MustCompile(`^\(\d+ rows?\)$`)
+)
+
+// ParseResult parses the output of a query as printed by psql: a header
+// line, a separator line and rows, with columns separated by "|". The
+// separator line and the row count footer are optional.
+func ParseResult(r io.Reader) (*Result, error) {
+	result := &Result{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || separatorRegex.MatchString(line) || footerRegex.MatchString(line) {
+			continue
+		}
+
+		fields := strings.Split(line, "|")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if result.Columns == nil {
+			result.Columns = fields
+			continue
+		}
+		if len(fields) != len(result.Columns) {
+			return nil, fmt.Errorf("row %d has %d columns, expected %d", len(result.Rows)+1, len(fields), len(result.Columns))
+		}
+		result.Rows = append(result.Rows, fields)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if result.Columns == nil {
+		return nil, errors.New("missing header line")
+	}
+
+	return result, nil
+}
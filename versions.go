@@ -0,0 +1,87 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"fmt"
+
+	"github.com/blang/semver"
+)
+
+// Pgpool-II releases which added namespaces or columns
+var (
+	version36 = semver.MustParse("3.6.0") // oldest supported release
+	version40 = semver.MustParse("4.0.0")
+	version41 = semver.MustParse("4.1.0")
+	version42 = semver.MustParse("4.2.0")
+	version43 = semver.MustParse("4.3.0")
+)
+
+// Minimum Pgpool-II version of the namespaces which are not available in
+// every supported version
+var namespaceMinVersions = map[string]semver.Version{
+	// Both added by Pgpool-II 4.2, not 4.1
+	"pool_backend_stats":      version42,
+	"pool_health_check_stats": version42,
+}
+
+// Minimum Pgpool-II version of the columns which are not reported by every
+// supported version. Columns not listed here are reported since 3.6.
+var columnMinVersions = map[string]map[string]semver.Version{
+	"pool_nodes": {
+		"last_status_change":     version40,
+		"replication_state":      version41,
+		"replication_sync_state": version41,
+		"pg_status":              version43,
+		"pg_role":                version43,
+	},
+	"pool_processes": {
+		"status":      version42,
+		"client_host": version42,
+		"client_port": version42,
+		"statement":   version42,
+	},
+}
+
+// Whether namespace can be queried on Pgpool-II version v. An unknown
+// (zero) version is treated as the oldest supported version.
+func namespaceSupported(namespace string, v semver.Version) bool {
+	minVersion, ok := namespaceMinVersions[namespace]
+	return !ok || v.GE(minVersion)
+}
+
+// Whether Pgpool-II version v reports column in namespace.
+func columnSupported(namespace string, column string, v semver.Version) bool {
+	minVersion, ok := columnMinVersions[namespace][column]
+	return !ok || v.GE(minVersion)
+}
+
+// Whether namespace can be queried on Pgpool-II version v, and if not, the
+// reason exported in pgpool2_collector_supported, e.g. "requires_4.2".
+func collectorSupport(namespace string, v semver.Version) (bool, string) {
+	if namespaceSupported(namespace, v) {
+		return true, "supported"
+	}
+	minVersion := namespaceMinVersions[namespace]
+	return false, fmt.Sprintf("requires_%d.%d", minVersion.Major, minVersion.Minor)
+}
@@ -0,0 +1,160 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"testing"
+
+	"github.com/blang/semver"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/pgpool/pgpool2_exporter/testutil"
+)
+
+// gatherFixtures scrapes an exporter configured with opts, answering with
+// the recorded outputs of Pgpool-II version, and returns the gathered
+// families by name.
+func gatherFixtures(t *testing.T, version string, opts ...Option) map[string]*dto.MetricFamily {
+	t.Helper()
+
+	db, err := testutil.OpenVersion(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewExporter("postgresql://pgpool@localhost:9999/postgres", append(opts, WithDB(db))...))
+
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	families := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+	return families
+}
+
+// Value of the series of family with the given labels, and whether it exists.
+func seriesValue(mf *dto.MetricFamily, labels map[string]string) (float64, bool) {
+	if mf == nil {
+		return 0, false
+	}
+	for _, m := range mf.GetMetric() {
+		matched := 0
+		for _, pair := range m.GetLabel() {
+			if value, ok := labels[pair.GetName()]; ok && value == pair.GetValue() {
+				matched++
+			}
+		}
+		if matched != len(labels) {
+			continue
+		}
+		switch {
+		case m.GetGauge() != nil:
+			return m.GetGauge().GetValue(), true
+		case m.GetCounter() != nil:
+			return m.GetCounter().GetValue(), true
+		case m.GetUntyped() != nil:
+			return m.GetUntyped().GetValue(), true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func TestCollectFixtureVersions(t *testing.T) {
+	// Series exported by every supported version
+	common := []string{
+		"pgpool2_pool_nodes_status",
+		"pgpool2_pool_nodes_lb_weight",
+		"pgpool2_pool_nodes_select_total",
+		"pgpool2_pool_nodes_replication_delay",
+		"pgpool2_pool_status_num_init_children",
+		"pgpool2_pool_status_info",
+		"pgpool2_frontend_total",
+		"pgpool2_frontend_used",
+		"pgpool2_backend_total",
+		"pgpool2_backend_used",
+		"pgpool2_primary_nodes",
+		"pgpool2_standby_nodes",
+	}
+	// Series of the namespaces and columns added by later versions
+	since := map[string]semver.Version{
+		"pgpool2_pool_nodes_last_status_change_timestamp_seconds":  version40,
+		"pgpool2_pool_nodes_replication_state":                     version41,
+		"pgpool2_pool_nodes_replication_sync_state":                version41,
+		"pgpool2_frontend_by_status":                               version42,
+		"pgpool2_pool_backend_stats_select_total":                  version42,
+		"pgpool2_pool_health_check_stats_total_count":              version42,
+		"pgpool2_pool_health_check_stats_average_duration_seconds": version42,
+		"pgpool2_pool_nodes_pg_status":                             version43,
+		"pgpool2_pool_nodes_pg_role":                               version43,
+	}
+
+	versions := testutil.Versions()
+	if len(versions) == 0 {
+		t.Fatal("no recorded Pgpool-II outputs")
+	}
+
+	for _, version := range versions {
+		t.Run(version, func(t *testing.T) {
+			v := semver.MustParse(version + ".0")
+			families := gatherFixtures(t, version)
+
+			if value, ok := seriesValue(families["pgpool2_up"], nil); !ok || value != 1 {
+				t.Errorf("pgpool2_up = %v (exported %v), want 1", value, ok)
+			}
+			if _, ok := seriesValue(families["pgpool2_version_info"], map[string]string{"short_version": version}); !ok {
+				t.Errorf("pgpool2_version_info{short_version=%q} not exported", version)
+			}
+
+			for _, name := range common {
+				if _, ok := families[name]; !ok {
+					t.Errorf("%s not exported", name)
+				}
+			}
+			for name, minVersion := range since {
+				_, ok := families[name]
+				if want := v.GE(minVersion); ok != want {
+					t.Errorf("%s exported = %v, want %v", name, ok, want)
+				}
+			}
+
+			// Missing columns are counted as unsupported_version errors.
+			scrapeErrors := families["pgpool2_exporter_scrape_errors_total"]
+			for _, errType := range []string{"unsupported_version", "parse"} {
+				if value, _ := seriesValue(scrapeErrors, map[string]string{"type": errType}); value != 0 {
+					t.Errorf("pgpool2_exporter_scrape_errors_total{type=%q} = %v, want 0", errType, value)
+				}
+			}
+			if _, ok := families["pgpool2_exporter_parse_errors_total"]; ok {
+				t.Errorf("pgpool2_exporter_parse_errors_total exported: %v", families["pgpool2_exporter_parse_errors_total"])
+			}
+		})
+	}
+}
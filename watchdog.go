@@ -0,0 +1,112 @@
+/*
+Copyright (c) 2021 PgPool Global Development Group
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pgpool2_exporter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Quorum status reported by the watchdog
+const watchdogQuorumExists = 1
+
+// Emit the pgpool2_watchdog_* metrics, which describe the watchdog cluster
+// as seen from the local Pgpool-II.
+func (e *Exporter) collectWatchdog(ch chan<- prometheus.Metric, watchdog *pcpWatchdogInfo) {
+	quorumExists := 0.0
+	if watchdog.QuorumStatus == watchdogQuorumExists {
+		quorumExists = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.newDesc("watchdog", "quorum_status", "Quorum status of the watchdog cluster (1 for quorum exists, 0 for quorum on the edge, -1 for quorum absent)", nil),
+		prometheus.GaugeValue,
+		float64(watchdog.QuorumStatus),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.newDesc("watchdog", "quorum_exists", "Whether the watchdog cluster holds the quorum (1 for yes, 0 for no)", nil),
+		prometheus.GaugeValue,
+		quorumExists,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.newDesc("watchdog", "remote_nodes", "Number of remote watchdog nodes configured", nil),
+		prometheus.GaugeValue,
+		float64(watchdog.RemoteNodeCount),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.newDesc("watchdog", "alive_nodes", "Number of alive remote watchdog nodes", nil),
+		prometheus.GaugeValue,
+		float64(watchdog.AliveNodeCount),
+	)
+
+	leader := watchdog.LeaderNodeName
+	if leader == "" {
+		leader = watchdog.MasterNodeName
+	}
+	if leader != "" {
+		ch <- prometheus.MustNewConstMetric(
+			e.newDesc("watchdog", "leader_info", "Watchdog leader node as the node_name label", []string{"node_name"}),
+			prometheus.GaugeValue,
+			1,
+			leader,
+		)
+	}
+
+	if len(watchdog.WatchdogNodes) == 0 {
+		return
+	}
+	local := watchdog.WatchdogNodes[0]
+
+	isLeader, isStandby := 0.0, 0.0
+	switch local.StateName {
+	case "LEADER", "MASTER":
+		isLeader = 1
+	case "STANDBY":
+		isStandby = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.newDesc("watchdog", "leader", "Whether the local Pgpool-II is the watchdog leader (1 for yes, 0 for no)", nil),
+		prometheus.GaugeValue,
+		isLeader,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.newDesc("watchdog", "standby", "Whether the local Pgpool-II is a watchdog standby (1 for yes, 0 for no)", nil),
+		prometheus.GaugeValue,
+		isStandby,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		e.newDesc("watchdog", "local_state_info", "Watchdog state of the local Pgpool-II as the state label", []string{"state"}),
+		prometheus.GaugeValue,
+		1,
+		local.StateName,
+	)
+
+	delegateIPUp := 0.0
+	if watchdog.Escalated {
+		delegateIPUp = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		e.newDesc("watchdog", "delegate_ip_up", "Whether the local Pgpool-II holds the delegate IP (1 for yes, 0 for no)", []string{"delegate_ip"}),
+		prometheus.GaugeValue,
+		delegateIPUp,
+		local.DelegateIP,
+	)
+}